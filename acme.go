@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ACMESettings struct {
+	Directory             string `json:"directory"`             // ACME directory URL
+	CACertFile            string `json:"caCertFile"`            // Extra roots for the ACME server, e.g. Pebble's
+	Email                 string `json:"email"`                 // Default account email
+	KeyType               string `json:"keyType"`               // ec256, ec384, rsa2048, rsa3072 or rsa4096
+	HTTPMode              string `json:"httpMode"`              // HTTP-01: webroot or responder
+	Webroot               string `json:"webroot"`               // Served by nginx at /.well-known/acme-challenge/
+	HTTPListen            string `json:"httpListen"`            // Standalone responder address; empty answers on this server's port
+	TLSALPNListen         string `json:"tlsAlpnListen"`         // TLS-ALPN-01 responder address; nginx holds :443, so unset by default
+	DNSResolver           string `json:"dnsResolver"`           // host:port to check TXT propagation against
+	DNSPropagationTimeout int    `json:"dnsPropagationTimeout"` // Seconds
+	RenewBeforeDays       int    `json:"renewBeforeDays"`       // Skip issuing over a cert with more days left, unless forced
+}
+
+// ACMEAccount is a registered account; its key is stored next to it
+type ACMEAccount struct {
+	ID        string `json:"id"`
+	Directory string `json:"directory"`
+	Email     string `json:"email"`
+	URL       string `json:"url"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"createdAt"`
+}
+
+const (
+	letsEncryptDirectory        = "https://acme-v02.api.letsencrypt.org/directory"
+	letsEncryptStagingDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
+)
+
+var certKeyTypes = []string{"ec256", "ec384", "rsa2048", "rsa3072", "rsa4096"}
+
+var (
+	acmeSettings = ACMESettings{
+		Directory:             letsEncryptDirectory,
+		KeyType:               "ec256",
+		HTTPMode:              "webroot",
+		Webroot:               "/var/www/html",
+		DNSPropagationTimeout: 120,
+		RenewBeforeDays:       30,
+	}
+	acmeSettingsLock sync.RWMutex
+	acmeSettingsFile = filepath.Join("/app/data", "acme.json")
+	acmeAccountsDir  = filepath.Join("/app/data", "acme", "accounts")
+
+	// Serializes account creation so concurrent issuance shares one account
+	acmeAccountLock sync.Mutex
+
+	certNameRegex = regexp.MustCompile(`^(\*\.)?[A-Za-z0-9]([A-Za-z0-9-]{0,62}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,62}[A-Za-z0-9])?)*$`)
+)
+
+// Get or update the ACME client settings
+func handleACMESettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		acmeSettingsLock.RLock()
+		defer acmeSettingsLock.RUnlock()
+		sendJSON(w, acmeSettings)
+	case http.MethodPost:
+		var settings ACMESettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Directory == "" {
+			settings.Directory = letsEncryptDirectory
+		}
+		if settings.KeyType == "" {
+			settings.KeyType = "ec256"
+		}
+		if !containsString(certKeyTypes, settings.KeyType) {
+			sendError(w, "Invalid key type: "+settings.KeyType, http.StatusBadRequest)
+			return
+		}
+		if settings.HTTPMode != "webroot" && settings.HTTPMode != "responder" {
+			sendError(w, "httpMode must be webroot or responder", http.StatusBadRequest)
+			return
+		}
+		if settings.HTTPMode == "webroot" && settings.Webroot == "" {
+			sendError(w, "webroot is required in webroot mode", http.StatusBadRequest)
+			return
+		}
+		if settings.DNSPropagationTimeout <= 0 {
+			settings.DNSPropagationTimeout = 120
+		}
+		if settings.RenewBeforeDays < 0 {
+			sendError(w, "renewBeforeDays must not be negative", http.StatusBadRequest)
+			return
+		}
+		if settings.CACertFile != "" {
+			if _, err := acmeHTTPClient(settings.CACertFile); err != nil {
+				sendError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		acmeSettingsLock.Lock()
+		acmeSettings = settings
+		acmeSettingsLock.Unlock()
+
+		if err := saveACMESettings(); err != nil {
+			log.Printf("Warning: Failed to save ACME settings: %v", err)
+		}
+
+		sendJSON(w, map[string]interface{}{
+			"status":   "ok",
+			"settings": settings,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// List (GET), register (POST) or deactivate (DELETE ?id=) ACME accounts
+func handleACMEAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		accounts, err := listACMEAccounts()
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, accounts)
+	case http.MethodPost:
+		var req struct {
+			Email     string `json:"email"`
+			Directory string `json:"directory"`
+			Staging   bool   `json:"staging"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+		_, account, err := acmeAccountClient(ctx, acmeDirectoryURL(req.Directory, req.Staging), req.Email, log.Printf)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		sendJSON(w, map[string]interface{}{
+			"status":  "ok",
+			"account": account,
+		})
+	case http.MethodDelete:
+		account, key, err := readACMEAccount(r.URL.Query().Get("id"))
+		if err != nil {
+			sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+		client, err := connectACME(ctx, account.Directory, key, log.Printf)
+		if err == nil {
+			client.kid = account.URL
+			err = client.deactivate(ctx)
+		}
+		if err != nil && r.URL.Query().Get("force") != "true" {
+			sendError(w, "Failed to deactivate account: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		os.Remove(filepath.Join(acmeAccountsDir, account.ID+".json"))
+		os.Remove(filepath.Join(acmeAccountsDir, account.ID+".key"))
+		sendJSON(w, map[string]interface{}{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Issue a certificate for req.Domains and install it into ssl/.
+// Progress goes to logf. Returns the certificate and key paths.
+func issueCertificate(ctx context.Context, req ObtainCertRequest, logf func(string, ...interface{})) (_, _ string, err error) {
+	if req.Challenge == "dns-01" {
+		if req.Provider, req.Credentials, err = resolveDNSCredentials(req); err != nil {
+			return "", "", err
+		}
+		// DNS credentials stay out of the log and errors, even when a
+		// provider's API echoes them back
+		logf = maskedLogf(logf, req.Credentials)
+		defer func() {
+			if err != nil {
+				err = errors.New(maskSecrets(err.Error(), req.Credentials))
+			}
+		}()
+	}
+
+	if len(req.Domains) == 0 {
+		return "", "", errors.New("at least one domain is required")
+	}
+	for _, domain := range req.Domains {
+		if net.ParseIP(domain) == nil && !certNameRegex.MatchString(domain) {
+			return "", "", fmt.Errorf("invalid domain: %s", domain)
+		}
+	}
+
+	acmeSettingsLock.RLock()
+	settings := acmeSettings
+	acmeSettingsLock.RUnlock()
+
+	keyType := req.KeyType
+	if keyType == "" {
+		keyType = settings.KeyType
+	}
+	if !containsString(certKeyTypes, keyType) {
+		return "", "", fmt.Errorf("invalid key type: %s (expected %s)", keyType, strings.Join(certKeyTypes, ", "))
+	}
+	email := req.Email
+	if email == "" {
+		email = settings.Email
+	}
+
+	sslDir := filepath.Join(configDir, "ssl")
+	if err := os.MkdirAll(sslDir, 0755); err != nil {
+		return "", "", err
+	}
+	name := strings.TrimPrefix(req.Domains[0], "*.")
+	certPath := filepath.Join(sslDir, name+".crt")
+	keyPath := filepath.Join(sslDir, name+".key")
+
+	// Like acme.sh, don't reissue a cert that still covers the names for a while
+	if existing := parseCertificate(certPath); existing != nil && !req.Force && settings.RenewBeforeDays > 0 {
+		if existing.DaysLeft > settings.RenewBeforeDays && certCoversNames(existing, req.Domains) {
+			return "", "", fmt.Errorf("%s is still valid for %d days; use force to renew now", certPath, existing.DaysLeft)
+		}
+	}
+
+	solvers, err := acmeSolvers(req, settings, logf)
+	if err != nil {
+		return "", "", err
+	}
+
+	directory := acmeDirectoryURL(req.Directory, req.Staging)
+	logf("Using ACME directory %s", directory)
+	client, account, err := acmeAccountClient(ctx, directory, email, logf)
+	if err != nil {
+		return "", "", err
+	}
+	logf("Using ACME account %s", account.URL)
+
+	certKey, err := generateCertKey(keyType)
+	if err != nil {
+		return "", "", err
+	}
+	logf("Generated %s certificate key", keyType)
+
+	chain, err := client.obtain(ctx, req.Domains, certKey, solvers)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPEM, err := encodePrivateKeyPEM(certKey)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writeCertificatePair(certPath, chain, keyPath, keyPEM); err != nil {
+		return "", "", fmt.Errorf("writing %v", err)
+	}
+	logf("Installed %s and %s", certPath, keyPath)
+
+	return certPath, keyPath, nil
+}
+
+// Map each challenge type the request allows to its solver
+func acmeSolvers(req ObtainCertRequest, settings ACMESettings, logf func(string, ...interface{})) (map[string]acmeSolver, error) {
+	solvers := map[string]acmeSolver{}
+	switch req.Challenge {
+	case "http-01":
+		if settings.HTTPMode == "responder" {
+			solvers["http-01"] = &httpResponderSolver{listen: settings.HTTPListen}
+		} else {
+			solvers["http-01"] = &httpWebrootSolver{webroot: settings.Webroot}
+		}
+	case "tls-alpn-01":
+		if settings.TLSALPNListen == "" {
+			return nil, errors.New("TLS-ALPN-01 needs tlsAlpnListen in the ACME settings: nginx holds port 443, so pass acme-tls/1 connections to a responder address with ssl_preread, or use :443 only where nginx doesn't listen on it")
+		}
+		solvers["tls-alpn-01"] = &tlsALPNSolver{listen: settings.TLSALPNListen}
+	case "dns-01":
+		if req.Provider == "" {
+			return nil, errors.New("DNS provider is required for dns-01 challenge")
+		}
+		provider, err := newDNSProvider(req.Provider, req.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		solvers["dns-01"] = &dnsSolver{
+			provider: provider,
+			resolver: settings.DNSResolver,
+			timeout:  time.Duration(settings.DNSPropagationTimeout) * time.Second,
+			logf:     logf,
+		}
+	default:
+		return nil, errors.New("challenge must be http-01, dns-01, or tls-alpn-01")
+	}
+	return solvers, nil
+}
+
+func acmeDirectoryURL(directory string, staging bool) string {
+	if directory != "" {
+		return directory
+	}
+	if staging {
+		return letsEncryptStagingDirectory
+	}
+	acmeSettingsLock.RLock()
+	defer acmeSettingsLock.RUnlock()
+	return acmeSettings.Directory
+}
+
+// HTTP client for talking to the ACME server, trusting caCertFile as well
+// as the system roots
+func acmeHTTPClient(caCertFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caCertFile == "" {
+		return client, nil
+	}
+
+	data, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", caCertFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client.Transport = transport
+	return client, nil
+}
+
+// Client for directory signing with key, trusting the configured CA file
+func connectACME(ctx context.Context, directory string, key *ecdsa.PrivateKey, logf func(string, ...interface{})) (*acmeClient, error) {
+	acmeSettingsLock.RLock()
+	caCertFile := acmeSettings.CACertFile
+	acmeSettingsLock.RUnlock()
+
+	httpClient, err := acmeHTTPClient(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	return newACMEClient(ctx, directory, httpClient, key, logf)
+}
+
+// Client for the account registered with directory under email, registering
+// a new account on first use
+func acmeAccountClient(ctx context.Context, directory, email string, logf func(string, ...interface{})) (*acmeClient, *ACMEAccount, error) {
+	acmeAccountLock.Lock()
+	defer acmeAccountLock.Unlock()
+
+	id := acmeAccountID(directory, email)
+	if account, key, err := readACMEAccount(id); err == nil {
+		client, err := connectACME(ctx, directory, key, logf)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.kid = account.URL
+		return client, account, nil
+	}
+
+	key, err := generateACMEAccountKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := connectACME(ctx, directory, key, logf)
+	if err != nil {
+		return nil, nil, err
+	}
+	logf("Registering ACME account for %q", email)
+	accountURL, err := client.register(ctx, email)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registering account: %v", err)
+	}
+
+	account := &ACMEAccount{
+		ID:        id,
+		Directory: directory,
+		Email:     email,
+		URL:       accountURL,
+		Status:    "valid",
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := writeACMEAccount(account, key); err != nil {
+		return nil, nil, fmt.Errorf("saving account: %v", err)
+	}
+	return client, account, nil
+}
+
+func acmeAccountID(directory, email string) string {
+	sum := sha1.Sum([]byte(directory + "|" + strings.ToLower(email)))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+func readACMEAccount(id string) (*ACMEAccount, *ecdsa.PrivateKey, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, nil, fmt.Errorf("account not found: %s", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(acmeAccountsDir, id+".json"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("account not found: %s", id)
+	}
+	account := &ACMEAccount{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(acmeAccountsDir, id+".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, nil, errors.New("account key is not a P-256 key")
+	}
+	return account, ecKey, nil
+}
+
+func writeACMEAccount(account *ACMEAccount, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(acmeAccountsDir, 0700); err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(acmeAccountsDir, account.ID+".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(acmeAccountsDir, account.ID+".json"), data, 0644)
+}
+
+func listACMEAccounts() ([]ACMEAccount, error) {
+	accounts := []ACMEAccount{}
+	matches, err := filepath.Glob(filepath.Join(acmeAccountsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var account ACMEAccount
+		if json.Unmarshal(data, &account) == nil {
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].CreatedAt < accounts[j].CreatedAt })
+	return accounts, nil
+}
+
+// Whether the certificate's names include every requested name
+func certCoversNames(info *CertificateInfo, names []string) bool {
+	for _, name := range names {
+		if !containsString(info.DNSNames, name) && !containsString(info.IPAddresses, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ec256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ec384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("invalid key type: %s", keyType)
+}
+
+// PEM in the traditional per-algorithm form nginx and openssl expect
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Write through a temp file so nginx never reads a half-written cert
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := writeTempFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Install a certificate and its key together. Both are written to temp
+// files first, and the old certificate is kept under a hard link until the
+// key is in place too, so any failure leaves the old pair rather than a new
+// certificate next to the old key.
+func writeCertificatePair(certPath string, certPEM []byte, keyPath string, keyPEM []byte) error {
+	certTmp := certPath + ".tmp"
+	keyTmp := keyPath + ".tmp"
+	certOld := certPath + ".old"
+	cleanup := func() {
+		os.Remove(certTmp)
+		os.Remove(keyTmp)
+		os.Remove(certOld)
+	}
+
+	if err := writeTempFile(certTmp, certPEM, 0644); err != nil {
+		cleanup()
+		return fmt.Errorf("certificate: %v", err)
+	}
+	if err := writeTempFile(keyTmp, keyPEM, 0600); err != nil {
+		cleanup()
+		return fmt.Errorf("key: %v", err)
+	}
+
+	os.Remove(certOld)
+	hadCert := false
+	if err := os.Link(certPath, certOld); err == nil {
+		hadCert = true
+	} else if !os.IsNotExist(err) {
+		cleanup()
+		return fmt.Errorf("certificate: keeping the old one: %v", err)
+	}
+
+	if err := os.Rename(certTmp, certPath); err != nil {
+		cleanup()
+		return fmt.Errorf("certificate: %v", err)
+	}
+	if err := os.Rename(keyTmp, keyPath); err != nil {
+		keyErr := fmt.Errorf("key: %v", err)
+		// Put the old certificate back beside the old key
+		if hadCert {
+			if err := os.Rename(certOld, certPath); err != nil {
+				keyErr = fmt.Errorf("%v; restoring the old certificate failed: %v", keyErr, err)
+			}
+		} else {
+			os.Remove(certPath)
+		}
+		cleanup()
+		return keyErr
+	}
+	cleanup()
+	return nil
+}
+
+func writeTempFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// ACME settings persistence
+func saveACMESettings() error {
+	acmeSettingsLock.RLock()
+	defer acmeSettingsLock.RUnlock()
+
+	data, err := json.MarshalIndent(acmeSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(acmeSettingsFile, data, 0644)
+}
+
+func loadACMESettings() error {
+	data, err := os.ReadFile(acmeSettingsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	acmeSettingsLock.Lock()
+	defer acmeSettingsLock.Unlock()
+	return json.Unmarshal(data, &acmeSettings)
+}
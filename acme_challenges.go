@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// acmeSolver makes one challenge answerable and removes it again
+type acmeSolver interface {
+	Present(ctx context.Context, domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string)
+}
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var (
+	// HTTP-01 key authorizations served by the in-process responder
+	acmeHTTPTokens     = map[string]string{}
+	acmeHTTPTokensLock sync.RWMutex
+
+	// id-pe-acmeIdentifier, RFC 8737
+	acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+)
+
+// Answer HTTP-01 challenges from memory. Mounted on the main server so nginx
+// can proxy /.well-known/acme-challenge/ to us, and on standalone listeners.
+func handleACMEHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+
+	acmeHTTPTokensLock.RLock()
+	keyAuth, ok := acmeHTTPTokens[token]
+	acmeHTTPTokensLock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+// HTTP-01 by writing the key authorization under the webroot nginx serves
+type httpWebrootSolver struct {
+	webroot string
+}
+
+func (s *httpWebrootSolver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	dir := filepath.Join(s.webroot, acmeChallengePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, token), []byte(keyAuth), 0644)
+}
+
+func (s *httpWebrootSolver) CleanUp(domain, token, keyAuth string) {
+	os.Remove(filepath.Join(s.webroot, acmeChallengePath, token))
+}
+
+// HTTP-01 answered by this process: on its own port through nginx, or on a
+// standalone listener (e.g. :80 when nothing else is bound there)
+type httpResponderSolver struct {
+	listen string
+
+	server *http.Server
+}
+
+func (s *httpResponderSolver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	acmeHTTPTokensLock.Lock()
+	acmeHTTPTokens[token] = keyAuth
+	acmeHTTPTokensLock.Unlock()
+
+	if s.listen == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return fmt.Errorf("HTTP-01 responder: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(acmeChallengePath, handleACMEHTTPChallenge)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go s.server.Serve(ln)
+	return nil
+}
+
+func (s *httpResponderSolver) CleanUp(domain, token, keyAuth string) {
+	acmeHTTPTokensLock.Lock()
+	delete(acmeHTTPTokens, token)
+	acmeHTTPTokensLock.Unlock()
+
+	if s.server != nil {
+		s.server.Close()
+		s.server = nil
+	}
+}
+
+// TLS-ALPN-01: a listener that answers the acme-tls/1 protocol with a
+// self-signed certificate carrying the key authorization digest
+type tlsALPNSolver struct {
+	listen string
+
+	listener net.Listener
+}
+
+func (s *tlsALPNSolver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	cert, err := tlsALPNCertificate(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"acme-tls/1"},
+	}
+	ln, err := tls.Listen("tcp", s.listen, config)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("TLS-ALPN-01 responder: %s is already in use, usually by nginx; set tlsAlpnListen to a free address nginx passes acme-tls/1 to", s.listen)
+	}
+	if err != nil {
+		return fmt.Errorf("TLS-ALPN-01 responder: %v", err)
+	}
+	s.listener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// The handshake is all the validator needs
+			go func() {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+func (s *tlsALPNSolver) CleanUp(domain, token, keyAuth string) {
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+}
+
+func tlsALPNCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ACME TLS-ALPN-01"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: acmeIdentifierOID, Critical: true, Value: value},
+		},
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{domain}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// DNS-01 through a provider plugin, waiting until the TXT record resolves
+type dnsSolver struct {
+	provider dnsProvider
+	resolver string // host:port to check propagation against; empty for the system resolver
+	timeout  time.Duration
+	logf     func(string, ...interface{})
+}
+
+func (s *dnsSolver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	fqdn, value := dnsChallengeRecord(domain, keyAuth)
+	s.logf("Creating TXT record %s", fqdn)
+	if err := s.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	return s.waitForRecord(ctx, fqdn, value)
+}
+
+func (s *dnsSolver) CleanUp(domain, token, keyAuth string) {
+	fqdn, value := dnsChallengeRecord(domain, keyAuth)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.provider.CleanUp(ctx, fqdn, value); err != nil {
+		s.logf("Warning: Failed to remove TXT record %s: %v", fqdn, err)
+	}
+}
+
+// Poll until the record is visible. A timeout is only a warning: the CA
+// may still see the record even when our resolver doesn't yet.
+func (s *dnsSolver) waitForRecord(ctx context.Context, fqdn, value string) error {
+	resolver := net.DefaultResolver
+	if s.resolver != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, s.resolver)
+			},
+		}
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	for {
+		records, _ := resolver.LookupTXT(ctx, fqdn)
+		for _, record := range records {
+			if record == value {
+				s.logf("TXT record %s is visible", fqdn)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			s.logf("Warning: TXT record %s not visible after %v, continuing anyway", fqdn, s.timeout)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// The _acme-challenge name and TXT value for a domain; wildcards share the
+// base domain's name
+func dnsChallengeRecord(domain, keyAuth string) (string, string) {
+	digest := sha256.Sum256([]byte(keyAuth))
+	fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+	return fqdn, base64.RawURLEncoding.EncodeToString(digest[:])
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeClient speaks ACME v2 (RFC 8555) to one directory with one account key
+type acmeClient struct {
+	directoryURL string
+	dir          acmeDirectory
+	http         *http.Client
+	key          *ecdsa.PrivateKey // Account key; requests are signed with ES256
+	kid          string            // Account URL, once registered
+	logf         func(format string, args ...interface{})
+
+	nonces    []string
+	nonceLock sync.Mutex
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+	Meta       struct {
+		TermsOfService          string `json:"termsOfService"`
+		ExternalAccountRequired bool   `json:"externalAccountRequired"`
+	} `json:"meta"`
+}
+
+// acmeProblem is an RFC 7807 error document returned by the server
+type acmeProblem struct {
+	Type        string        `json:"type"`
+	Detail      string        `json:"detail"`
+	Status      int           `json:"status"`
+	Subproblems []acmeProblem `json:"subproblems,omitempty"`
+}
+
+func (p *acmeProblem) Error() string {
+	msg := strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:") + ": " + p.Detail
+	for _, sub := range p.Subproblems {
+		msg += "; " + sub.Detail
+	}
+	return msg
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"` // dns or ip
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	URL            string           `json:"-"`
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Identifier acmeIdentifier  `json:"identifier"`
+	Status     string          `json:"status"`
+	Wildcard   bool            `json:"wildcard"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// Fetch the directory and return a client for it
+func newACMEClient(ctx context.Context, directoryURL string, httpClient *http.Client, key *ecdsa.PrivateKey, logf func(string, ...interface{})) (*acmeClient, error) {
+	c := &acmeClient{
+		directoryURL: directoryURL,
+		http:         httpClient,
+		key:          key,
+		logf:         logf,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, directoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching ACME directory: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching ACME directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("decoding ACME directory: %v", err)
+	}
+	if c.dir.NewNonce == "" || c.dir.NewAccount == "" || c.dir.NewOrder == "" {
+		return nil, fmt.Errorf("%s is not an ACME v2 directory", directoryURL)
+	}
+	return c, nil
+}
+
+// Register the account key, or look up the existing account for it.
+// Returns the account URL.
+func (c *acmeClient) register(ctx context.Context, email string) (string, error) {
+	if c.dir.Meta.ExternalAccountRequired {
+		return "", errors.New("this ACME server requires external account binding, which is not supported")
+	}
+
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+
+	resp, _, err := c.post(ctx, c.dir.NewAccount, payload, nil)
+	if err != nil {
+		return "", err
+	}
+	c.kid = resp.Header.Get("Location")
+	if c.kid == "" {
+		return "", errors.New("ACME server did not return an account URL")
+	}
+	return c.kid, nil
+}
+
+// Deactivate the account; the server will refuse further requests with its key
+func (c *acmeClient) deactivate(ctx context.Context) error {
+	_, _, err := c.post(ctx, c.kid, map[string]string{"status": "deactivated"}, nil)
+	return err
+}
+
+// Run an order for the identifiers through to a certificate, solving each
+// authorization with the first offered challenge type that has a solver.
+// Returns the PEM certificate chain.
+func (c *acmeClient) obtain(ctx context.Context, identifiers []string, certKey crypto.Signer, solvers map[string]acmeSolver) ([]byte, error) {
+	idents := []acmeIdentifier{}
+	for _, name := range identifiers {
+		if net.ParseIP(name) != nil {
+			idents = append(idents, acmeIdentifier{Type: "ip", Value: name})
+		} else {
+			idents = append(idents, acmeIdentifier{Type: "dns", Value: name})
+		}
+	}
+
+	order := &acmeOrder{}
+	resp, _, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": idents}, order)
+	if err != nil {
+		return nil, fmt.Errorf("creating order: %v", err)
+	}
+	order.URL = resp.Header.Get("Location")
+	c.logf("Created order %s (status: %s)", order.URL, order.Status)
+
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(ctx, authzURL, solvers); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.pollOrder(ctx, order, "ready"); err != nil {
+		return nil, err
+	}
+
+	csr, err := acmeCSR(identifiers, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating CSR: %v", err)
+	}
+	c.logf("Finalizing order")
+	if _, _, err := c.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, order); err != nil {
+		return nil, fmt.Errorf("finalizing order: %v", err)
+	}
+	if err := c.pollOrder(ctx, order, "valid"); err != nil {
+		return nil, err
+	}
+
+	c.logf("Downloading certificate from %s", order.Certificate)
+	_, chain, err := c.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("downloading certificate: %v", err)
+	}
+	if block, _ := pem.Decode(chain); block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("ACME server returned a certificate that is not PEM")
+	}
+	return chain, nil
+}
+
+// Solve one authorization and wait for it to become valid
+func (c *acmeClient) authorize(ctx context.Context, authzURL string, solvers map[string]acmeSolver) error {
+	authz := &acmeAuthorization{}
+	if _, _, err := c.post(ctx, authzURL, nil, authz); err != nil {
+		return fmt.Errorf("fetching authorization: %v", err)
+	}
+
+	domain := authz.Identifier.Value
+	if authz.Wildcard {
+		domain = "*." + domain
+	}
+	if authz.Status == "valid" {
+		c.logf("Authorization for %s is already valid", domain)
+		return nil
+	}
+
+	var challenge *acmeChallenge
+	var solver acmeSolver
+	offered := []string{}
+	for i := range authz.Challenges {
+		offered = append(offered, authz.Challenges[i].Type)
+		if s, ok := solvers[authz.Challenges[i].Type]; ok && challenge == nil {
+			challenge = &authz.Challenges[i]
+			solver = s
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no configured challenge for %s (server offers %s)", domain, strings.Join(offered, ", "))
+	}
+
+	keyAuth := challenge.Token + "." + c.thumbprint()
+	c.logf("Solving %s for %s", challenge.Type, domain)
+	if err := solver.Present(ctx, authz.Identifier.Value, challenge.Token, keyAuth); err != nil {
+		solver.CleanUp(authz.Identifier.Value, challenge.Token, keyAuth)
+		return fmt.Errorf("preparing %s for %s: %v", challenge.Type, domain, err)
+	}
+	defer solver.CleanUp(authz.Identifier.Value, challenge.Token, keyAuth)
+
+	// An empty object tells the server to start validating
+	if _, _, err := c.post(ctx, challenge.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("starting %s for %s: %v", challenge.Type, domain, err)
+	}
+
+	for {
+		resp, _, err := c.post(ctx, authzURL, nil, authz)
+		if err != nil {
+			return fmt.Errorf("polling authorization: %v", err)
+		}
+
+		switch authz.Status {
+		case "valid":
+			c.logf("Authorization for %s is valid", domain)
+			return nil
+		case "pending", "processing":
+		default:
+			for _, ch := range authz.Challenges {
+				if ch.Type == challenge.Type && ch.Error != nil {
+					return fmt.Errorf("%s for %s failed: %v", challenge.Type, domain, ch.Error)
+				}
+			}
+			return fmt.Errorf("authorization for %s is %s", domain, authz.Status)
+		}
+
+		if err := acmeWait(ctx, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Poll an order until it reaches the wanted status
+func (c *acmeClient) pollOrder(ctx context.Context, order *acmeOrder, want string) error {
+	for {
+		if order.Status == want {
+			return nil
+		}
+		if order.Status == "invalid" {
+			if order.Error != nil {
+				return fmt.Errorf("order failed: %v", order.Error)
+			}
+			return errors.New("order failed")
+		}
+		if want == "ready" && order.Status == "valid" {
+			return nil
+		}
+
+		resp, _, err := c.post(ctx, order.URL, nil, order)
+		if err != nil {
+			return fmt.Errorf("polling order: %v", err)
+		}
+		if order.Status == want {
+			return nil
+		}
+		if err := acmeWait(ctx, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Sleep for the server's Retry-After (2s by default, 30s at most)
+func acmeWait(ctx context.Context, resp *http.Response) error {
+	delay := 2 * time.Second
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		delay = time.Duration(secs) * time.Second
+	}
+	if delay > 30*time.Second {
+		delay = 30 * time.Second
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Send a JWS-signed POST. A nil payload is a POST-as-GET. Decodes a JSON
+// response into out when given, and retries a few times on a bad nonce.
+func (c *acmeClient) post(ctx context.Context, url string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := c.sign(url, nonce, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		req.Header.Set("Accept", "application/json, application/pem-certificate-chain")
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.saveNonce(resp)
+
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+				return resp, data, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			return resp, data, problem
+		}
+
+		if out != nil && len(data) > 0 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return resp, data, fmt.Errorf("decoding response from %s: %v", url, err)
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+func (c *acmeClient) nonce(ctx context.Context) (string, error) {
+	c.nonceLock.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.nonceLock.Unlock()
+		return nonce, nil
+	}
+	c.nonceLock.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching nonce: %v", err)
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+func (c *acmeClient) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.nonceLock.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.nonceLock.Unlock()
+	}
+}
+
+// Build the flattened JWS body. Account creation carries the public key;
+// everything after it names the account by URL.
+func (c *acmeClient) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	body := []byte{}
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// JWS wants the fixed-size r||s form, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": enc.EncodeToString(header),
+		"payload":   enc.EncodeToString(body),
+		"signature": enc.EncodeToString(sig),
+	})
+}
+
+func (c *acmeClient) jwk() map[string]string {
+	enc := base64.RawURLEncoding
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   enc.EncodeToString(c.key.X.FillBytes(make([]byte, 32))),
+		"y":   enc.EncodeToString(c.key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// RFC 7638 thumbprint of the account key, used in key authorizations
+func (c *acmeClient) thumbprint() string {
+	jwk := c.jwk()
+	// Members in lexicographic order, no whitespace
+	canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// DER CSR for the identifiers; the first one is also the subject CN
+func acmeCSR(identifiers []string, key crypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{}
+	for _, name := range identifiers {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	if len(identifiers[0]) <= 64 && net.ParseIP(identifiers[0]) == nil {
+		template.Subject = pkix.Name{CommonName: identifiers[0]}
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
+
+func generateACMEAccountKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Serial numbers for the short-lived certificates we mint ourselves
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialProfile is a named set of DNS provider credentials. The values
+// are only ever held encrypted on disk and are never sent over the API.
+type CredentialProfile struct {
+	Name      string   `json:"name"`
+	Provider  string   `json:"provider"`
+	Keys      []string `json:"keys"` // Credential names, without their values
+	CreatedAt string   `json:"createdAt"`
+	UpdatedAt string   `json:"updatedAt"`
+
+	secret string // base64 of the AES-GCM nonce and sealed values
+}
+
+// On-disk form of a profile
+type storedCredentialProfile struct {
+	CredentialProfile
+	Secret string `json:"secret"`
+}
+
+var (
+	credentialProfiles     = map[string]*CredentialProfile{}
+	credentialProfilesLock sync.Mutex
+	credentialProfilesFile = filepath.Join("/app/data", "credentials.json")
+
+	// Used when SERVER_MANAGER_CREDENTIALS_KEY isn't set; created on first use
+	// unless SERVER_MANAGER_CREDENTIALS_KEY_FILE points elsewhere
+	credentialsKeyFile = filepath.Join("/app/data", "credentials.key")
+	credentialsKey     []byte
+	credentialsKeyLock sync.Mutex
+
+	credentialProfileNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+// List profiles (GET), create or update one (POST) or delete one (DELETE ?name=)
+func handleCredentialProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendJSON(w, listCredentialProfiles())
+	case http.MethodPost:
+		var req struct {
+			Name        string            `json:"name"`
+			Provider    string            `json:"provider"`
+			Credentials map[string]string `json:"credentials"` // Empty values keep the stored ones
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !credentialProfileNameRegex.MatchString(req.Name) {
+			sendError(w, "Invalid profile name: "+req.Name, http.StatusBadRequest)
+			return
+		}
+		req.Provider = strings.ToLower(req.Provider)
+		if !dnsProviderKnown(req.Provider) {
+			sendError(w, "Unknown DNS provider: "+req.Provider, http.StatusBadRequest)
+			return
+		}
+
+		creds := map[string]string{}
+		if _, existing, err := lookupCredentialProfile(req.Name); err == nil {
+			for key, value := range req.Credentials {
+				if value == "" {
+					value = existing[key]
+				}
+				creds[key] = value
+			}
+		} else {
+			for key, value := range req.Credentials {
+				creds[key] = value
+			}
+		}
+		if _, err := newDNSProvider(req.Provider, creds); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		profile, err := storeCredentialProfile(req.Name, req.Provider, creds)
+		if err != nil {
+			sendError(w, "Failed to save profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, map[string]interface{}{"status": "ok", "profile": profile})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		credentialProfilesLock.Lock()
+		_, ok := credentialProfiles[name]
+		credentialProfilesLock.Unlock()
+		if !ok {
+			sendError(w, "Profile not found: "+name, http.StatusNotFound)
+			return
+		}
+
+		// Renewals would start failing
+		if users := credentialProfileUsers(name); len(users) > 0 && r.URL.Query().Get("force") != "true" {
+			sendError(w, "Profile is used by "+strings.Join(users, ", ")+"; use force to delete it anyway", http.StatusConflict)
+			return
+		}
+
+		credentialProfilesLock.Lock()
+		delete(credentialProfiles, name)
+		credentialProfilesLock.Unlock()
+		if err := saveCredentialProfiles(); err != nil {
+			sendError(w, "Failed to save profiles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, map[string]interface{}{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Profiles by name, without secrets
+func listCredentialProfiles() []CredentialProfile {
+	credentialProfilesLock.Lock()
+	defer credentialProfilesLock.Unlock()
+
+	profiles := []CredentialProfile{}
+	for _, profile := range credentialProfiles {
+		p := *profile
+		p.secret = ""
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// Managed certificates renewed with a profile
+func credentialProfileUsers(name string) []string {
+	managedCertsLock.Lock()
+	defer managedCertsLock.Unlock()
+
+	users := []string{}
+	for _, cert := range managedCerts {
+		if cert.Request.CredentialProfile == name {
+			users = append(users, cert.Name)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Encrypt and save a profile, replacing any with the same name
+func storeCredentialProfile(name, provider string, creds map[string]string) (CredentialProfile, error) {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return CredentialProfile{}, err
+	}
+	secret, err := sealCredentials(name, data)
+	if err != nil {
+		return CredentialProfile{}, err
+	}
+
+	keys := []string{}
+	for key := range creds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	now := time.Now().Format(time.RFC3339)
+
+	credentialProfilesLock.Lock()
+	profile, ok := credentialProfiles[name]
+	if !ok {
+		profile = &CredentialProfile{Name: name, CreatedAt: now}
+		credentialProfiles[name] = profile
+	}
+	profile.Provider = provider
+	profile.Keys = keys
+	profile.UpdatedAt = now
+	profile.secret = secret
+	result := *profile
+	credentialProfilesLock.Unlock()
+
+	result.secret = ""
+	return result, saveCredentialProfiles()
+}
+
+// Decrypt a profile's provider and credentials
+func lookupCredentialProfile(name string) (string, map[string]string, error) {
+	credentialProfilesLock.Lock()
+	profile, ok := credentialProfiles[name]
+	var provider, secret string
+	if ok {
+		provider, secret = profile.Provider, profile.secret
+	}
+	credentialProfilesLock.Unlock()
+	if !ok {
+		return "", nil, fmt.Errorf("credential profile not found: %s", name)
+	}
+
+	data, err := openCredentials(name, secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("credential profile %s: %v", name, err)
+	}
+	creds := map[string]string{}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", nil, fmt.Errorf("credential profile %s: %v", name, err)
+	}
+	return provider, creds, nil
+}
+
+// The provider and credentials a DNS-01 request uses: its profile's, or the
+// ones posted with it
+func resolveDNSCredentials(req ObtainCertRequest) (string, map[string]string, error) {
+	if req.CredentialProfile == "" {
+		return req.Provider, req.Credentials, nil
+	}
+
+	provider, creds, err := lookupCredentialProfile(req.CredentialProfile)
+	if err != nil {
+		return "", nil, err
+	}
+	if req.Provider != "" && !strings.EqualFold(req.Provider, provider) {
+		return "", nil, fmt.Errorf("credential profile %s is for %s, not %s", req.CredentialProfile, provider, req.Provider)
+	}
+	// Posted values override the profile's for this request only
+	for key, value := range req.Credentials {
+		creds[key] = value
+	}
+	return provider, creds, nil
+}
+
+// Replace credential values in s with ****
+func maskSecrets(s string, creds map[string]string) string {
+	for _, value := range creds {
+		// Too short to mask without mangling the rest of the line
+		if len(value) < 4 {
+			continue
+		}
+		s = strings.ReplaceAll(s, value, "****")
+	}
+	return s
+}
+
+func maskedLogf(logf func(string, ...interface{}), creds map[string]string) func(string, ...interface{}) {
+	if len(creds) == 0 {
+		return logf
+	}
+	return func(format string, args ...interface{}) {
+		logf("%s", maskSecrets(fmt.Sprintf(format, args...), creds))
+	}
+}
+
+// AES-256-GCM with the profile name as additional data, so a secret can't
+// be moved to another profile
+func sealCredentials(name string, plaintext []byte) (string, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openCredentials(name, secret string) ([]byte, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secret is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, errors.New("cannot decrypt; was the credentials key changed?")
+	}
+	return plaintext, nil
+}
+
+func credentialsCipher() (cipher.AEAD, error) {
+	key, err := loadCredentialsKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The 256-bit key from SERVER_MANAGER_CREDENTIALS_KEY, or from the key file
+// (generated the first time it's needed)
+func loadCredentialsKey() ([]byte, error) {
+	credentialsKeyLock.Lock()
+	defer credentialsKeyLock.Unlock()
+
+	if credentialsKey != nil {
+		return credentialsKey, nil
+	}
+
+	if value := os.Getenv("SERVER_MANAGER_CREDENTIALS_KEY"); value != "" {
+		credentialsKey = parseCredentialsKey(value)
+		return credentialsKey, nil
+	}
+
+	path := credentialsKeyFile
+	if p := os.Getenv("SERVER_MANAGER_CREDENTIALS_KEY_FILE"); p != "" {
+		path = p
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("creating credentials key: %v", err)
+		}
+		log.Printf("Created credentials key %s", path)
+		credentialsKey = key
+		return credentialsKey, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials key: %v", err)
+	}
+	credentialsKey = parseCredentialsKey(string(data))
+	return credentialsKey, nil
+}
+
+// A base64-encoded 32-byte key is used as is; anything else is a
+// passphrase and hashed down to one
+func parseCredentialsKey(value string) []byte {
+	value = strings.TrimSpace(value)
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(value))
+	return sum[:]
+}
+
+// Credential profile persistence
+func saveCredentialProfiles() error {
+	credentialProfilesLock.Lock()
+	stored := []storedCredentialProfile{}
+	for _, profile := range credentialProfiles {
+		stored = append(stored, storedCredentialProfile{*profile, profile.secret})
+	}
+	credentialProfilesLock.Unlock()
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Name < stored[j].Name })
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(credentialProfilesFile, data, 0600)
+}
+
+func loadCredentialProfiles() error {
+	data, err := os.ReadFile(credentialProfilesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	stored := []storedCredentialProfile{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	credentialProfilesLock.Lock()
+	defer credentialProfilesLock.Unlock()
+	for _, s := range stored {
+		profile := s.CredentialProfile
+		profile.secret = s.Secret
+		credentialProfiles[profile.Name] = &profile
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dnsProvider creates and removes the TXT records for DNS-01.
+// fqdn is fully qualified with a trailing dot.
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+type dnsProviderPlugin struct {
+	Name        string   `json:"name"`
+	Credentials []string `json:"credentials"`    // First accepted name of each required credential
+	Hook        bool     `json:"hook,omitempty"` // A script in dnsHookDir
+	create      func(creds map[string]string) (dnsProvider, error)
+}
+
+// DNS-01 provider plugins. Credential names follow the lego/acme.sh
+// environment variables so existing settings carry over.
+var dnsProviderPlugins = map[string]dnsProviderPlugin{
+	"cloudflare": {
+		Credentials: []string{"CLOUDFLARE_DNS_API_TOKEN"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			token := credential(creds, "CLOUDFLARE_DNS_API_TOKEN", "CF_DNS_API_TOKEN", "CF_Token")
+			if token != "" {
+				return &cloudflareDNS{token: token}, nil
+			}
+			// Global API key, as older acme.sh/lego setups used
+			key := credential(creds, "CLOUDFLARE_API_KEY", "CF_API_KEY", "CF_Key")
+			email := credential(creds, "CLOUDFLARE_EMAIL", "CF_API_EMAIL", "CF_Email")
+			if key != "" && email != "" {
+				return &cloudflareDNS{key: key, email: email}, nil
+			}
+			return nil, fmt.Errorf("CLOUDFLARE_DNS_API_TOKEN, or CLOUDFLARE_API_KEY and CLOUDFLARE_EMAIL, are required")
+		},
+	},
+	"digitalocean": {
+		Credentials: []string{"DO_AUTH_TOKEN"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			token := credential(creds, "DO_AUTH_TOKEN", "DO_API_KEY")
+			if token == "" {
+				return nil, fmt.Errorf("DO_AUTH_TOKEN is required")
+			}
+			return &digitalOceanDNS{token: token}, nil
+		},
+	},
+	"duckdns": {
+		Credentials: []string{"DUCKDNS_TOKEN"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			token := credential(creds, "DUCKDNS_TOKEN", "DuckDNS_Token")
+			if token == "" {
+				return nil, fmt.Errorf("DUCKDNS_TOKEN is required")
+			}
+			return &duckDNS{token: token}, nil
+		},
+	},
+	"godaddy": {
+		Credentials: []string{"GODADDY_API_KEY", "GODADDY_API_SECRET"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			key := credential(creds, "GODADDY_API_KEY", "GD_Key")
+			secret := credential(creds, "GODADDY_API_SECRET", "GD_Secret")
+			if key == "" || secret == "" {
+				return nil, fmt.Errorf("GODADDY_API_KEY and GODADDY_API_SECRET are required")
+			}
+			return &goDaddyDNS{key: key, secret: secret}, nil
+		},
+	},
+	"namecheap": {
+		Credentials: []string{"NAMECHEAP_API_USER", "NAMECHEAP_API_KEY", "NAMECHEAP_CLIENT_IP"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			user := credential(creds, "NAMECHEAP_API_USER", "NAMECHEAP_USERNAME")
+			key := credential(creds, "NAMECHEAP_API_KEY")
+			clientIP := credential(creds, "NAMECHEAP_CLIENT_IP", "NAMECHEAP_SOURCEIP")
+			if user == "" || key == "" || clientIP == "" {
+				return nil, fmt.Errorf("NAMECHEAP_API_USER, NAMECHEAP_API_KEY and NAMECHEAP_CLIENT_IP (the whitelisted IP) are required")
+			}
+			return &namecheapDNS{user: user, key: key, clientIP: clientIP}, nil
+		},
+	},
+	"route53": {
+		Credentials: []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			p := &route53DNS{
+				accessKey:    credential(creds, "AWS_ACCESS_KEY_ID"),
+				secretKey:    credential(creds, "AWS_SECRET_ACCESS_KEY"),
+				sessionToken: credential(creds, "AWS_SESSION_TOKEN"),
+				zoneID:       strings.TrimPrefix(credential(creds, "AWS_HOSTED_ZONE_ID"), "/hostedzone/"),
+			}
+			if p.accessKey == "" || p.secretKey == "" {
+				return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+			}
+			return p, nil
+		},
+	},
+	"gcloud": {
+		Credentials: []string{"GCE_SERVICE_ACCOUNT"},
+		create:      newGoogleCloudDNS,
+	},
+	"namesilo": {
+		Credentials: []string{"NAMESILO_API_KEY"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			key := credential(creds, "NAMESILO_API_KEY", "Namesilo_Key")
+			if key == "" {
+				return nil, fmt.Errorf("NAMESILO_API_KEY is required")
+			}
+			return &nameSiloDNS{key: key}, nil
+		},
+	},
+	"vultr": {
+		Credentials: []string{"VULTR_API_KEY"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			key := credential(creds, "VULTR_API_KEY")
+			if key == "" {
+				return nil, fmt.Errorf("VULTR_API_KEY is required")
+			}
+			return &vultrDNS{key: key}, nil
+		},
+	},
+	"linode": {
+		Credentials: []string{"LINODE_TOKEN"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			token := credential(creds, "LINODE_TOKEN", "LINODE_V4_API_KEY")
+			if token == "" {
+				return nil, fmt.Errorf("LINODE_TOKEN is required")
+			}
+			return &linodeDNS{token: token}, nil
+		},
+	},
+	"challtestsrv": {
+		Credentials: []string{"CHALLTESTSRV_URL"},
+		create: func(creds map[string]string) (dnsProvider, error) {
+			endpoint := credential(creds, "CHALLTESTSRV_URL")
+			if endpoint == "" {
+				endpoint = "http://127.0.0.1:8055"
+			}
+			return &challTestSrvDNS{endpoint: strings.TrimSuffix(endpoint, "/")}, nil
+		},
+	},
+}
+
+var dnsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Other providers are scripts installed here by the administrator, named
+// after the provider. Only the server side decides what can be run.
+var dnsHookDir = dnsHookDirectory()
+
+var dnsHookNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Credential names that would change how a hook runs rather than what it sees
+var dnsHookReservedEnv = regexp.MustCompile(`^(LD_|DYLD_|BASH_FUNC_)|^(PATH|ENV|BASH_ENV|SHELLOPTS|BASHOPTS|IFS|PS4|CDPATH|GCONV_PATH|NLSPATH|HOSTALIASES|LOCALDOMAIN|RES_OPTIONS|TMPDIR|HOME)$`)
+
+var dnsHookEnvNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func dnsHookDirectory() string {
+	if dir := os.Getenv("DNS_HOOK_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("/app/data", "dns-hooks")
+}
+
+// List the DNS-01 providers and the credentials each one needs
+func handleDNSProviders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plugins := []dnsProviderPlugin{}
+	for name, plugin := range dnsProviderPlugins {
+		plugin.Name = name
+		plugins = append(plugins, plugin)
+	}
+	for _, name := range dnsHookNames() {
+		if _, builtin := dnsProviderPlugins[name]; !builtin {
+			plugins = append(plugins, dnsProviderPlugin{Name: name, Credentials: []string{}, Hook: true})
+		}
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	sendJSON(w, plugins)
+}
+
+func newDNSProvider(name string, creds map[string]string) (dnsProvider, error) {
+	name = strings.ToLower(name)
+	if plugin, ok := dnsProviderPlugins[name]; ok {
+		return plugin.create(creds)
+	}
+	if name == "exec" {
+		return nil, fmt.Errorf("EXEC_PATH is no longer accepted; install the script as %s/<name> and use <name> as the provider", dnsHookDir)
+	}
+
+	path, err := dnsHookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	for key := range creds {
+		if !dnsHookEnvNameRegex.MatchString(key) || dnsHookReservedEnv.MatchString(key) {
+			return nil, fmt.Errorf("credential name not allowed for a hook: %s", key)
+		}
+	}
+	return &execDNS{path: path, env: creds}, nil
+}
+
+// Whether a provider is built in or installed as a hook
+func dnsProviderKnown(name string) bool {
+	name = strings.ToLower(name)
+	if _, ok := dnsProviderPlugins[name]; ok {
+		return true
+	}
+	_, err := dnsHookPath(name)
+	return err == nil
+}
+
+// The executable for a hook provider. Hooks must live in dnsHookDir, never
+// in the config directory, which the file API can write to.
+func dnsHookPath(name string) (string, error) {
+	if !dnsHookNameRegex.MatchString(name) {
+		return "", fmt.Errorf("unknown DNS provider: %s", name)
+	}
+	dir, err := filepath.EvalSymlinks(dnsHookDir)
+	if err != nil {
+		return "", fmt.Errorf("unknown DNS provider: %s", name)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("unknown DNS provider: %s (no hook at %s)", name, filepath.Join(dnsHookDir, name))
+	}
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("DNS hook %s must be inside %s", name, dnsHookDir)
+	}
+	if config, err := filepath.EvalSymlinks(configDir); err == nil && strings.HasPrefix(path+string(filepath.Separator), config+string(filepath.Separator)) {
+		return "", fmt.Errorf("DNS hook %s must not be inside the nginx config directory", name)
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("DNS hook %s is not an executable file", path)
+	}
+	return path, nil
+}
+
+// Names of the installed hooks
+func dnsHookNames() []string {
+	names := []string{}
+	entries, err := os.ReadDir(dnsHookDir)
+	if err != nil {
+		return names
+	}
+	for _, entry := range entries {
+		if _, err := dnsHookPath(entry.Name()); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// First non-empty credential among the accepted names
+func credential(creds map[string]string, names ...string) string {
+	for _, name := range names {
+		if v := creds[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Candidate zones for a name, longest first: a.b.example.com → b.example.com, example.com
+func dnsZoneCandidates(fqdn string) []string {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	zones := []string{}
+	for i := 1; i < len(labels)-1; i++ {
+		zones = append(zones, strings.Join(labels[i:], "."))
+	}
+	return zones
+}
+
+// Send a JSON API request and decode the response
+func dnsAPIRequest(ctx context.Context, method, url string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Host+req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// Cloudflare with a scoped API token (Zone:Read, DNS:Edit) or the global key
+type cloudflareDNS struct {
+	token      string
+	key, email string
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+func (p *cloudflareDNS) headers() map[string]string {
+	if p.token == "" {
+		return map[string]string{"X-Auth-Key": p.key, "X-Auth-Email": p.email}
+	}
+	return map[string]string{"Authorization": "Bearer " + p.token}
+}
+
+func (p *cloudflareDNS) zoneID(ctx context.Context, fqdn string) (string, error) {
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		var resp struct {
+			Result []struct {
+				ID string `json:"id"`
+			} `json:"result"`
+		}
+		if err := dnsAPIRequest(ctx, http.MethodGet, cloudflareAPI+"/zones?name="+url.QueryEscape(zone), p.headers(), nil, &resp); err != nil {
+			return "", err
+		}
+		if len(resp.Result) > 0 {
+			return resp.Result[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", fqdn)
+}
+
+func (p *cloudflareDNS) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]interface{}{
+		"type":    "TXT",
+		"name":    strings.TrimSuffix(fqdn, "."),
+		"content": value,
+		"ttl":     120,
+	}
+	return dnsAPIRequest(ctx, http.MethodPost, cloudflareAPI+"/zones/"+zoneID+"/dns_records", p.headers(), record, nil)
+}
+
+func (p *cloudflareDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Result []struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}, "content": {value}}
+	if err := dnsAPIRequest(ctx, http.MethodGet, cloudflareAPI+"/zones/"+zoneID+"/dns_records?"+query.Encode(), p.headers(), nil, &resp); err != nil {
+		return err
+	}
+	for _, record := range resp.Result {
+		if err := dnsAPIRequest(ctx, http.MethodDelete, cloudflareAPI+"/zones/"+zoneID+"/dns_records/"+record.ID, p.headers(), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DigitalOcean with a personal access token
+type digitalOceanDNS struct {
+	token string
+}
+
+const digitalOceanAPI = "https://api.digitalocean.com/v2"
+
+func (p *digitalOceanDNS) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.token}
+}
+
+// The managed domain and the record name relative to it
+func (p *digitalOceanDNS) zone(ctx context.Context, fqdn string) (string, string, error) {
+	name := strings.TrimSuffix(fqdn, ".")
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		err := dnsAPIRequest(ctx, http.MethodGet, digitalOceanAPI+"/domains/"+zone, p.headers(), nil, nil)
+		if err == nil {
+			return zone, strings.TrimSuffix(name, "."+zone), nil
+		}
+		if !strings.Contains(err.Error(), "404") {
+			return "", "", err
+		}
+	}
+	return "", "", fmt.Errorf("no DigitalOcean domain found for %s", fqdn)
+}
+
+func (p *digitalOceanDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, name, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]interface{}{"type": "TXT", "name": name, "data": value, "ttl": 30}
+	return dnsAPIRequest(ctx, http.MethodPost, digitalOceanAPI+"/domains/"+zone+"/records", p.headers(), record, nil)
+}
+
+func (p *digitalOceanDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, _, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		DomainRecords []struct {
+			ID   int64  `json:"id"`
+			Data string `json:"data"`
+		} `json:"domain_records"`
+	}
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}}
+	if err := dnsAPIRequest(ctx, http.MethodGet, digitalOceanAPI+"/domains/"+zone+"/records?"+query.Encode(), p.headers(), nil, &resp); err != nil {
+		return err
+	}
+	for _, record := range resp.DomainRecords {
+		if record.Data != value {
+			continue
+		}
+		if err := dnsAPIRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/domains/%s/records/%d", digitalOceanAPI, zone, record.ID), p.headers(), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DuckDNS keeps a single TXT value per subdomain
+type duckDNS struct {
+	token string
+}
+
+func (p *duckDNS) update(ctx context.Context, fqdn string, params url.Values) error {
+	// _acme-challenge.<sub>.duckdns.org → <sub>
+	name := strings.TrimSuffix(strings.TrimPrefix(fqdn, "_acme-challenge."), ".")
+	name = strings.TrimSuffix(name, ".duckdns.org")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	params.Set("domains", name)
+	params.Set("token", p.token)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.duckdns.org/update?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if strings.TrimSpace(string(body)) != "OK" {
+		return fmt.Errorf("DuckDNS update failed: %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (p *duckDNS) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, url.Values{"txt": {value}})
+}
+
+func (p *duckDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, url.Values{"txt": {""}, "clear": {"true"}})
+}
+
+// Any other provider through a hook script: <hook> present|cleanup <fqdn> <value>.
+// The credentials are passed in its environment.
+type execDNS struct {
+	path string
+	env  map[string]string
+}
+
+func (p *execDNS) run(ctx context.Context, action, fqdn, value string) error {
+	cmd := exec.CommandContext(ctx, p.path, action, fqdn, value)
+	for k, v := range p.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Env = append(cmd.Env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.path, action, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (p *execDNS) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// pebble-challtestsrv's management API, for testing against Pebble
+type challTestSrvDNS struct {
+	endpoint string
+}
+
+func (p *challTestSrvDNS) Present(ctx context.Context, fqdn, value string) error {
+	return dnsAPIRequest(ctx, http.MethodPost, p.endpoint+"/set-txt", nil, map[string]string{"host": fqdn, "value": value}, nil)
+}
+
+func (p *challTestSrvDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return dnsAPIRequest(ctx, http.MethodPost, p.endpoint+"/clear-txt", nil, map[string]string{"host": fqdn}, nil)
+}
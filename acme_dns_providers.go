@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record name relative to its zone: _acme-challenge.www.example.com. → _acme-challenge.www
+func dnsRelativeName(fqdn, zone string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), "."+zone)
+}
+
+// Send a request whose body isn't JSON and return the response body
+func dnsRawRequest(req *http.Request) ([]byte, error) {
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host+req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// GoDaddy replaces all TXT values of a name at once, so values are merged
+type goDaddyDNS struct {
+	key, secret string
+}
+
+const goDaddyAPI = "https://api.godaddy.com/v1"
+
+type goDaddyRecord struct {
+	Data string `json:"data"`
+	TTL  int    `json:"ttl"`
+}
+
+func (p *goDaddyDNS) headers() map[string]string {
+	return map[string]string{"Authorization": "sso-key " + p.key + ":" + p.secret}
+}
+
+func (p *goDaddyDNS) records(ctx context.Context, fqdn string) (string, string, []goDaddyRecord, error) {
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		err := dnsAPIRequest(ctx, http.MethodGet, goDaddyAPI+"/domains/"+zone, p.headers(), nil, nil)
+		if err != nil {
+			if strings.Contains(err.Error(), "404") {
+				continue
+			}
+			return "", "", nil, err
+		}
+		name := dnsRelativeName(fqdn, zone)
+		records := []goDaddyRecord{}
+		err = dnsAPIRequest(ctx, http.MethodGet, goDaddyAPI+"/domains/"+zone+"/records/TXT/"+name, p.headers(), nil, &records)
+		return zone, name, records, err
+	}
+	return "", "", nil, fmt.Errorf("no GoDaddy domain found for %s", fqdn)
+}
+
+func (p *goDaddyDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, name, records, err := p.records(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	records = append(records, goDaddyRecord{Data: value, TTL: 600})
+	return dnsAPIRequest(ctx, http.MethodPut, goDaddyAPI+"/domains/"+zone+"/records/TXT/"+name, p.headers(), records, nil)
+}
+
+func (p *goDaddyDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, name, records, err := p.records(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	kept := []goDaddyRecord{}
+	for _, record := range records {
+		if record.Data != value {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		return dnsAPIRequest(ctx, http.MethodDelete, goDaddyAPI+"/domains/"+zone+"/records/TXT/"+name, p.headers(), nil, nil)
+	}
+	return dnsAPIRequest(ctx, http.MethodPut, goDaddyAPI+"/domains/"+zone+"/records/TXT/"+name, p.headers(), kept, nil)
+}
+
+// Namecheap can only replace a domain's whole host list, so every change
+// reads the list and writes it back. API access needs a whitelisted client IP.
+type namecheapDNS struct {
+	user, key, clientIP string
+}
+
+const namecheapAPI = "https://api.namecheap.com/xml.response"
+
+type namecheapHost struct {
+	Name    string `xml:"Name,attr"`
+	Type    string `xml:"Type,attr"`
+	Address string `xml:"Address,attr"`
+	MXPref  string `xml:"MXPref,attr"`
+	TTL     string `xml:"TTL,attr"`
+}
+
+type namecheapResponse struct {
+	Status string `xml:"Status,attr"`
+	Errors []struct {
+		Number  string `xml:"Number,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"Errors>Error"`
+	Hosts struct {
+		EmailType string          `xml:"EmailType,attr"`
+		Hosts     []namecheapHost `xml:"host"`
+	} `xml:"CommandResponse>DomainDNSGetHostsResult"`
+}
+
+func (p *namecheapDNS) call(ctx context.Context, command string, params url.Values) (*namecheapResponse, error) {
+	params.Set("ApiUser", p.user)
+	params.Set("ApiKey", p.key)
+	params.Set("UserName", p.user)
+	params.Set("ClientIp", p.clientIP)
+	params.Set("Command", command)
+
+	// setHosts can exceed URL limits, so parameters go in the body
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, namecheapAPI, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := dnsRawRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp namecheapResponse
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("namecheap %s: %v", command, err)
+	}
+	if resp.Status != "OK" {
+		messages := []string{}
+		for _, e := range resp.Errors {
+			messages = append(messages, strings.TrimSpace(e.Message)+" ("+e.Number+")")
+		}
+		return &resp, fmt.Errorf("namecheap %s: %s", command, strings.Join(messages, "; "))
+	}
+	return &resp, nil
+}
+
+func (p *namecheapDNS) hosts(ctx context.Context, fqdn string) (string, *namecheapResponse, error) {
+	var lastErr error
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		sld, tld, _ := strings.Cut(zone, ".")
+		resp, err := p.call(ctx, "namecheap.domains.dns.getHosts", url.Values{"SLD": {sld}, "TLD": {tld}})
+		if err == nil {
+			return zone, resp, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no Namecheap domain found for %s", fqdn)
+	}
+	return "", nil, lastErr
+}
+
+func (p *namecheapDNS) setHosts(ctx context.Context, zone, emailType string, hosts []namecheapHost) error {
+	sld, tld, _ := strings.Cut(zone, ".")
+	params := url.Values{"SLD": {sld}, "TLD": {tld}}
+	if emailType != "" {
+		params.Set("EmailType", emailType)
+	}
+	for i, host := range hosts {
+		n := strconv.Itoa(i + 1)
+		params.Set("HostName"+n, host.Name)
+		params.Set("RecordType"+n, host.Type)
+		params.Set("Address"+n, host.Address)
+		params.Set("MXPref"+n, host.MXPref)
+		params.Set("TTL"+n, host.TTL)
+	}
+	_, err := p.call(ctx, "namecheap.domains.dns.setHosts", params)
+	return err
+}
+
+func (p *namecheapDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, resp, err := p.hosts(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	hosts := append(resp.Hosts.Hosts, namecheapHost{Name: dnsRelativeName(fqdn, zone), Type: "TXT", Address: value, MXPref: "10", TTL: "60"})
+	return p.setHosts(ctx, zone, resp.Hosts.EmailType, hosts)
+}
+
+func (p *namecheapDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, resp, err := p.hosts(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	name := dnsRelativeName(fqdn, zone)
+	hosts := []namecheapHost{}
+	for _, host := range resp.Hosts.Hosts {
+		if !(host.Type == "TXT" && host.Name == name && host.Address == value) {
+			hosts = append(hosts, host)
+		}
+	}
+	return p.setHosts(ctx, zone, resp.Hosts.EmailType, hosts)
+}
+
+// Route 53 through its REST API, signed with AWS Signature Version 4.
+// Without AWS_HOSTED_ZONE_ID the zone is looked up by name.
+type route53DNS struct {
+	accessKey, secretKey, sessionToken string
+	zoneID                             string
+}
+
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+type route53RecordSet struct {
+	Name   string   `xml:"Name"`
+	Type   string   `xml:"Type"`
+	TTL    int      `xml:"TTL"`
+	Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+func (p *route53DNS) do(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, error) {
+	endpoint := route53API + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signAWSRequest(req, body, p.accessKey, p.secretKey, p.sessionToken, "us-east-1", "route53", time.Now())
+	return dnsRawRequest(req)
+}
+
+func (p *route53DNS) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		data, err := p.do(ctx, http.MethodGet, "/hostedzonesbyname", url.Values{"dnsname": {zone}, "maxitems": {"1"}}, nil)
+		if err != nil {
+			return "", err
+		}
+		var resp struct {
+			Zones []struct {
+				ID     string `xml:"Id"`
+				Name   string `xml:"Name"`
+				Config struct {
+					Private bool `xml:"PrivateZone"`
+				} `xml:"Config"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		if err := xml.Unmarshal(data, &resp); err != nil {
+			return "", err
+		}
+		for _, z := range resp.Zones {
+			if z.Name == zone+"." && !z.Config.Private {
+				return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no Route 53 hosted zone found for %s", fqdn)
+}
+
+// The current TXT record set for fqdn, if any
+func (p *route53DNS) recordSet(ctx context.Context, zoneID, fqdn string) (*route53RecordSet, error) {
+	query := url.Values{"name": {fqdn}, "type": {"TXT"}, "maxitems": {"1"}}
+	data, err := p.do(ctx, http.MethodGet, "/hostedzone/"+zoneID+"/rrset", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Sets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	for _, set := range resp.Sets {
+		if strings.EqualFold(set.Name, fqdn) && set.Type == "TXT" {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *route53DNS) change(ctx context.Context, zoneID, action string, set route53RecordSet) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	body.WriteString(`<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeBatch><Changes><Change>`)
+	fmt.Fprintf(&body, "<Action>%s</Action><ResourceRecordSet><Name>", action)
+	xml.EscapeText(&body, []byte(set.Name))
+	fmt.Fprintf(&body, "</Name><Type>TXT</Type><TTL>%d</TTL><ResourceRecords>", set.TTL)
+	for _, value := range set.Values {
+		body.WriteString("<ResourceRecord><Value>")
+		xml.EscapeText(&body, []byte(value))
+		body.WriteString("</Value></ResourceRecord>")
+	}
+	body.WriteString("</ResourceRecords></ResourceRecordSet></Change></Changes></ChangeBatch></ChangeResourceRecordSetsRequest>")
+
+	_, err := p.do(ctx, http.MethodPost, "/hostedzone/"+zoneID+"/rrset", nil, body.Bytes())
+	return err
+}
+
+func (p *route53DNS) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	set, err := p.recordSet(ctx, zoneID, fqdn)
+	if err != nil {
+		return err
+	}
+	// The apex and wildcard challenges share a name, so keep other values
+	if set == nil {
+		set = &route53RecordSet{Name: fqdn, TTL: 60}
+	}
+	set.Values = append(set.Values, strconv.Quote(value))
+	return p.change(ctx, zoneID, "UPSERT", *set)
+}
+
+func (p *route53DNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	set, err := p.recordSet(ctx, zoneID, fqdn)
+	if err != nil || set == nil {
+		return err
+	}
+	kept := []string{}
+	for _, v := range set.Values {
+		if v != strconv.Quote(value) {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		return p.change(ctx, zoneID, "DELETE", *set)
+	}
+	set.Values = kept
+	return p.change(ctx, zoneID, "UPSERT", *set)
+}
+
+// Sign a request with AWS Signature Version 4
+func signAWSRequest(req *http.Request, body []byte, accessKey, secretKey, sessionToken, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Query parameters sorted and encoded with %20 for spaces
+	query := req.URL.Query()
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(pairs, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// Google Cloud DNS with a service account key (roles/dns.admin)
+type googleCloudDNS struct {
+	email   string
+	key     *rsa.PrivateKey
+	project string
+
+	token       string
+	tokenExpiry time.Time
+	tokenLock   sync.Mutex
+}
+
+const (
+	googleDNSAPI   = "https://dns.googleapis.com/dns/v1/projects/"
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+type googleRecordSet struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	RRDatas []string `json:"rrdatas"`
+}
+
+// GCE_SERVICE_ACCOUNT holds the key file's JSON; the project defaults to the key's
+func newGoogleCloudDNS(creds map[string]string) (dnsProvider, error) {
+	raw := credential(creds, "GCE_SERVICE_ACCOUNT", "GCE_SERVICE_ACCOUNT_JSON")
+	if raw == "" {
+		return nil, fmt.Errorf("GCE_SERVICE_ACCOUNT (the service account key JSON) is required")
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		ProjectID   string `json:"project_id"`
+	}
+	if err := json.Unmarshal([]byte(raw), &account); err != nil {
+		return nil, fmt.Errorf("GCE_SERVICE_ACCOUNT is not a service account key: %v", err)
+	}
+	key, err := parsePrivateKeyPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("GCE_SERVICE_ACCOUNT private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok || account.ClientEmail == "" {
+		return nil, fmt.Errorf("GCE_SERVICE_ACCOUNT is not a service account key")
+	}
+	project := credential(creds, "GCE_PROJECT")
+	if project == "" {
+		project = account.ProjectID
+	}
+	if project == "" {
+		return nil, fmt.Errorf("GCE_PROJECT is required")
+	}
+	return &googleCloudDNS{email: account.ClientEmail, key: rsaKey, project: project}, nil
+}
+
+// Exchange a signed JWT for an access token
+func (p *googleCloudDNS) accessToken(ctx context.Context) (string, error) {
+	p.tokenLock.Lock()
+	defer p.tokenLock.Unlock()
+	if p.token != "" && time.Now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   p.email,
+		"scope": "https://www.googleapis.com/auth/ndev.clouddns.readwrite",
+		"aud":   googleTokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := dnsRawRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil || resp.AccessToken == "" {
+		return "", errors.New("google token exchange returned no access token")
+	}
+	p.token = resp.AccessToken
+	p.tokenExpiry = now.Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+	return p.token, nil
+}
+
+func (p *googleCloudDNS) request(ctx context.Context, method, path string, body, out interface{}) error {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"Authorization": "Bearer " + token}
+	return dnsAPIRequest(ctx, method, googleDNSAPI+url.PathEscape(p.project)+path, headers, body, out)
+}
+
+func (p *googleCloudDNS) zone(ctx context.Context, fqdn string) (string, error) {
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		var resp struct {
+			ManagedZones []struct {
+				Name       string `json:"name"`
+				Visibility string `json:"visibility"`
+			} `json:"managedZones"`
+		}
+		if err := p.request(ctx, http.MethodGet, "/managedZones?dnsName="+url.QueryEscape(zone+"."), nil, &resp); err != nil {
+			return "", err
+		}
+		for _, z := range resp.ManagedZones {
+			if z.Visibility != "private" {
+				return z.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no Google Cloud DNS zone found for %s", fqdn)
+}
+
+// Replace fqdn's TXT values; the old set has to be deleted in the same change
+func (p *googleCloudDNS) update(ctx context.Context, fqdn string, edit func([]string) []string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		RRSets []googleRecordSet `json:"rrsets"`
+	}
+	query := url.Values{"name": {fqdn}, "type": {"TXT"}}
+	if err := p.request(ctx, http.MethodGet, "/managedZones/"+zone+"/rrsets?"+query.Encode(), nil, &resp); err != nil {
+		return err
+	}
+
+	change := map[string][]googleRecordSet{"additions": {}, "deletions": {}}
+	current := []string{}
+	if len(resp.RRSets) > 0 {
+		change["deletions"] = resp.RRSets[:1]
+		current = resp.RRSets[0].RRDatas
+	}
+	if values := edit(current); len(values) > 0 {
+		change["additions"] = []googleRecordSet{{Name: fqdn, Type: "TXT", TTL: 60, RRDatas: values}}
+	}
+	if len(change["additions"]) == 0 && len(change["deletions"]) == 0 {
+		return nil
+	}
+	return p.request(ctx, http.MethodPost, "/managedZones/"+zone+"/changes", change, nil)
+}
+
+func (p *googleCloudDNS) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, func(values []string) []string {
+		return append(values, strconv.Quote(value))
+	})
+}
+
+func (p *googleCloudDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, func(values []string) []string {
+		kept := []string{}
+		for _, v := range values {
+			if v != strconv.Quote(value) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	})
+}
+
+// NameSilo's API takes everything as query parameters and reports errors
+// in the reply code (300 is success)
+type nameSiloDNS struct {
+	key string
+}
+
+const nameSiloAPI = "https://www.namesilo.com/api/"
+
+type nameSiloRecord struct {
+	ID    string `json:"record_id"`
+	Type  string `json:"type"`
+	Host  string `json:"host"`
+	Value string `json:"value"`
+}
+
+func (p *nameSiloDNS) call(ctx context.Context, operation string, params url.Values) ([]nameSiloRecord, error) {
+	params.Set("version", "1")
+	params.Set("type", "json")
+	params.Set("key", p.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nameSiloAPI+operation+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dnsRawRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Reply struct {
+			Code    json.Number     `json:"code"`
+			Detail  string          `json:"detail"`
+			Records json.RawMessage `json:"resource_record"`
+		} `json:"reply"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("namesilo %s: %v", operation, err)
+	}
+	if resp.Reply.Code.String() != "300" {
+		return nil, fmt.Errorf("namesilo %s: %s (%s)", operation, resp.Reply.Detail, resp.Reply.Code)
+	}
+
+	// A single record comes back as an object rather than a list
+	records := []nameSiloRecord{}
+	if len(resp.Reply.Records) > 0 {
+		if err := json.Unmarshal(resp.Reply.Records, &records); err != nil {
+			var record nameSiloRecord
+			if json.Unmarshal(resp.Reply.Records, &record) == nil {
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+func (p *nameSiloDNS) zone(ctx context.Context, fqdn string) (string, []nameSiloRecord, error) {
+	var lastErr error
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		records, err := p.call(ctx, "dnsListRecords", url.Values{"domain": {zone}})
+		if err == nil {
+			return zone, records, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no NameSilo domain found for %s", fqdn)
+	}
+	return "", nil, lastErr
+}
+
+func (p *nameSiloDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, _, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	params := url.Values{"domain": {zone}, "rrtype": {"TXT"}, "rrhost": {dnsRelativeName(fqdn, zone)}, "rrvalue": {value}, "rrttl": {"3600"}}
+	_, err = p.call(ctx, "dnsAddRecord", params)
+	return err
+}
+
+func (p *nameSiloDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, records, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Type != "TXT" || record.Host != strings.TrimSuffix(fqdn, ".") || record.Value != value {
+			continue
+		}
+		if _, err := p.call(ctx, "dnsDeleteRecord", url.Values{"domain": {zone}, "rrid": {record.ID}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Vultr API v2
+type vultrDNS struct {
+	key string
+}
+
+const vultrAPI = "https://api.vultr.com/v2"
+
+func (p *vultrDNS) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.key}
+}
+
+func (p *vultrDNS) zone(ctx context.Context, fqdn string) (string, error) {
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		err := dnsAPIRequest(ctx, http.MethodGet, vultrAPI+"/domains/"+zone, p.headers(), nil, nil)
+		if err == nil {
+			return zone, nil
+		}
+		if !strings.Contains(err.Error(), "404") {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no Vultr domain found for %s", fqdn)
+}
+
+func (p *vultrDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]interface{}{"type": "TXT", "name": dnsRelativeName(fqdn, zone), "data": strconv.Quote(value), "ttl": 120}
+	return dnsAPIRequest(ctx, http.MethodPost, vultrAPI+"/domains/"+zone+"/records", p.headers(), record, nil)
+}
+
+func (p *vultrDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Records []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+			Name string `json:"name"`
+			Data string `json:"data"`
+		} `json:"records"`
+	}
+	if err := dnsAPIRequest(ctx, http.MethodGet, vultrAPI+"/domains/"+zone+"/records?per_page=500", p.headers(), nil, &resp); err != nil {
+		return err
+	}
+	name := dnsRelativeName(fqdn, zone)
+	for _, record := range resp.Records {
+		if record.Type != "TXT" || record.Name != name || strings.Trim(record.Data, `"`) != value {
+			continue
+		}
+		if err := dnsAPIRequest(ctx, http.MethodDelete, vultrAPI+"/domains/"+zone+"/records/"+record.ID, p.headers(), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Linode (Akamai) API v4. Its name servers pick up changes slowly, so
+// dnsPropagationTimeout may need raising.
+type linodeDNS struct {
+	token string
+}
+
+const linodeAPI = "https://api.linode.com/v4"
+
+func (p *linodeDNS) headers(filter string) map[string]string {
+	headers := map[string]string{"Authorization": "Bearer " + p.token}
+	if filter != "" {
+		headers["X-Filter"] = filter
+	}
+	return headers
+}
+
+func (p *linodeDNS) zone(ctx context.Context, fqdn string) (string, int64, error) {
+	for _, zone := range dnsZoneCandidates(fqdn) {
+		var resp struct {
+			Data []struct {
+				ID     int64  `json:"id"`
+				Domain string `json:"domain"`
+			} `json:"data"`
+		}
+		filter, _ := json.Marshal(map[string]string{"domain": zone})
+		if err := dnsAPIRequest(ctx, http.MethodGet, linodeAPI+"/domains", p.headers(string(filter)), nil, &resp); err != nil {
+			return "", 0, err
+		}
+		for _, d := range resp.Data {
+			if strings.EqualFold(d.Domain, zone) {
+				return zone, d.ID, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("no Linode domain found for %s", fqdn)
+}
+
+func (p *linodeDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, id, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]interface{}{"type": "TXT", "name": dnsRelativeName(fqdn, zone), "target": value, "ttl_sec": 300}
+	return dnsAPIRequest(ctx, http.MethodPost, fmt.Sprintf("%s/domains/%d/records", linodeAPI, id), p.headers(""), record, nil)
+}
+
+func (p *linodeDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, id, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Data []struct {
+			ID     int64  `json:"id"`
+			Type   string `json:"type"`
+			Name   string `json:"name"`
+			Target string `json:"target"`
+		} `json:"data"`
+	}
+	if err := dnsAPIRequest(ctx, http.MethodGet, fmt.Sprintf("%s/domains/%d/records?page_size=500", linodeAPI, id), p.headers(""), nil, &resp); err != nil {
+		return err
+	}
+	name := dnsRelativeName(fqdn, zone)
+	for _, record := range resp.Data {
+		if record.Type != "TXT" || record.Name != name || record.Target != value {
+			continue
+		}
+		if err := dnsAPIRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/domains/%d/records/%d", linodeAPI, id, record.ID), p.headers(""), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
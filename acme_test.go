@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs against a local Pebble with pebble-challtestsrv as its DNS server:
+//
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	pebble-challtestsrv -http01 "" -https01 "" -tlsalpn01 "" -defaultIPv4 127.0.0.1
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_CA_CERT=test/certs/pebble.minica.pem go test -run Pebble
+//
+// HTTP-01 is answered by the standalone responder on Pebble's httpPort (5002)
+// and DNS-01 through challtestsrv's management API.
+func TestPebbleObtainCertificate(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+
+	configDir = t.TempDir()
+	acmeAccountsDir = filepath.Join(t.TempDir(), "accounts")
+	acmeSettings = ACMESettings{
+		Directory:             directory,
+		CACertFile:            os.Getenv("PEBBLE_CA_CERT"),
+		Email:                 "test@example.com",
+		KeyType:               "ec256",
+		HTTPMode:              "responder",
+		HTTPListen:            envOrDefault("PEBBLE_HTTP_LISTEN", ":5002"),
+		DNSResolver:           envOrDefault("PEBBLE_DNS_RESOLVER", "127.0.0.1:8053"),
+		DNSPropagationTimeout: 30,
+	}
+
+	tests := []struct {
+		name string
+		req  ObtainCertRequest
+	}{
+		{
+			name: "http-01",
+			req:  ObtainCertRequest{Domains: []string{"http01.example.test", "www.http01.example.test"}, Challenge: "http-01"},
+		},
+		{
+			name: "dns-01",
+			req: ObtainCertRequest{
+				Domains:     []string{"dns01.example.test", "*.dns01.example.test"},
+				Challenge:   "dns-01",
+				Provider:    "challtestsrv",
+				Credentials: map[string]string{"CHALLTESTSRV_URL": envOrDefault("PEBBLE_CHALLTESTSRV_URL", "http://127.0.0.1:8055")},
+				KeyType:     "rsa2048",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+
+			certPath, keyPath, err := issueCertificate(ctx, tt.req, t.Logf)
+			if err != nil {
+				t.Fatalf("issueCertificate: %v", err)
+			}
+
+			name := tt.req.Domains[0]
+			if want := filepath.Join(configDir, "ssl", name+".crt"); certPath != want {
+				t.Errorf("certificate installed at %s, want %s", certPath, want)
+			}
+			if want := filepath.Join(configDir, "ssl", name+".key"); keyPath != want {
+				t.Errorf("key installed at %s, want %s", keyPath, want)
+			}
+			if info, err := os.Stat(keyPath); err != nil {
+				t.Errorf("key file: %v", err)
+			} else if info.Mode().Perm() != 0600 {
+				t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+			}
+
+			// The pair has to load the way nginx will use it
+			if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+				t.Fatalf("certificate and key don't match: %v", err)
+			}
+			info := parseCertificate(certPath)
+			if info == nil {
+				t.Fatal("installed certificate can't be parsed")
+			}
+			if !certCoversNames(info, tt.req.Domains) {
+				t.Errorf("certificate names %v don't cover %v", info.DNSNames, tt.req.Domains)
+			}
+			if info.ChainLength < 2 {
+				t.Errorf("chain has %d certificates, want the leaf and its issuer", info.ChainLength)
+			}
+		})
+	}
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -13,7 +13,7 @@ cd ..
 
 # Build Go binary
 echo "🔧 Building Go binary..."
-go build -o server-manager main.go
+go build -o server-manager .
 
 echo "✅ Build complete!"
 echo ""
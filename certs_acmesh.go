@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Before certificates were issued in-process, acme.sh issued them and a
+// cron job renewed them. Its per-domain configs are imported once so those
+// certificates keep renewing.
+var (
+	acmeShDir          = acmeShDirectory()
+	acmeShImportMarker = filepath.Join("/app/data", "acme-sh-imported")
+)
+
+// ACME_SH_DIR points at a copy of the old container's /root/.acme.sh
+func acmeShDirectory() string {
+	if dir := os.Getenv("ACME_SH_DIR"); dir != "" {
+		return dir
+	}
+	return "/root/.acme.sh"
+}
+
+type acmeShDNSAPI struct {
+	provider string
+	saved    []string // Credentials acme.sh keeps as SAVED_<name> in account.conf
+}
+
+// acme.sh DNS APIs (--dns dns_xx) and the built-in providers that replace them
+var acmeShDNSAPIs = map[string]acmeShDNSAPI{
+	"dns_cf":        {"cloudflare", []string{"CF_Token", "CF_Key", "CF_Email"}},
+	"dns_dgon":      {"digitalocean", []string{"DO_API_KEY"}},
+	"dns_duckdns":   {"duckdns", []string{"DuckDNS_Token"}},
+	"dns_gd":        {"godaddy", []string{"GD_Key", "GD_Secret"}},
+	"dns_namecheap": {"namecheap", []string{"NAMECHEAP_USERNAME", "NAMECHEAP_API_KEY", "NAMECHEAP_SOURCEIP"}},
+	"dns_aws":       {"route53", []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}},
+	"dns_gcloud":    {"gcloud", nil}, // Used the gcloud CLI's login; needs a service account now
+	"dns_namesilo":  {"namesilo", []string{"Namesilo_Key"}},
+	"dns_vultr":     {"vultr", []string{"VULTR_API_KEY"}},
+	"dns_linode_v4": {"linode", []string{"LINODE_V4_API_KEY"}},
+}
+
+var acmeShKeyTypes = map[string]string{
+	"ec-256": "ec256",
+	"ec-384": "ec384",
+	"2048":   "rsa2048",
+	"3072":   "rsa3072",
+	"4096":   "rsa4096",
+}
+
+// Import the certificates acme.sh issued into ssl/ as managed certificates.
+// Runs once; certificates already managed are left alone.
+func importAcmeShCerts() error {
+	if _, err := os.Stat(acmeShImportMarker); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(acmeShDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	account, err := parseAcmeShConf(filepath.Join(acmeShDir, "account.conf"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	confs, err := filepath.Glob(filepath.Join(acmeShDir, "*", "*.conf"))
+	if err != nil {
+		return err
+	}
+	// An empty mount (docker creates a missing host dir) isn't an import yet
+	if len(confs) == 0 {
+		return nil
+	}
+
+	imported := 0
+	for _, path := range confs {
+		// <domain>/<domain>.conf, or <domain>_ecc/<domain>.conf for EC keys
+		domain := strings.TrimSuffix(filepath.Base(path), ".conf")
+		if strings.TrimSuffix(filepath.Base(filepath.Dir(path)), "_ecc") != domain {
+			continue
+		}
+		conf, err := parseAcmeShConf(path)
+		if err != nil {
+			log.Printf("Warning: Failed to read acme.sh config %s: %v", path, err)
+			continue
+		}
+		cert, ok := acmeShManagedCert(conf, account)
+		if !ok {
+			continue
+		}
+
+		// Only certificates that were installed into ssl/ are ours to renew
+		if _, err := os.Stat(filepath.Join(configDir, "ssl", cert.Name+".crt")); err != nil {
+			continue
+		}
+		managedCertsLock.Lock()
+		_, exists := managedCerts[cert.Name]
+		managedCertsLock.Unlock()
+		if exists {
+			continue
+		}
+
+		if err := moveCredentialsToProfile(cert.Name, &cert.Request); err != nil {
+			cert.Request.Credentials = nil
+			cert.LastError = fmt.Sprintf("failed to import the acme.sh credentials: %v", err)
+		}
+
+		managedCertsLock.Lock()
+		managedCerts[cert.Name] = cert
+		managedCertsLock.Unlock()
+		imported++
+		log.Printf("Imported acme.sh certificate %s (%s)", cert.Name, strings.Join(cert.Request.Domains, ", "))
+	}
+
+	if imported > 0 {
+		if err := saveManagedCerts(); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(acmeShImportMarker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// The renewal record for one acme.sh domain config
+func acmeShManagedCert(conf, account map[string]string) (*ManagedCert, bool) {
+	primary := conf["Le_Domain"]
+	if primary == "" {
+		return nil, false
+	}
+
+	req := ObtainCertRequest{
+		Domains: []string{primary},
+		Email:   account["ACCOUNT_EMAIL"],
+		KeyType: acmeShKeyTypes[conf["Le_Keylength"]],
+	}
+	if alt := conf["Le_Alt"]; alt != "" && alt != "no" {
+		for _, name := range strings.Split(alt, ",") {
+			if name = strings.TrimSpace(name); name != "" && !containsString(req.Domains, name) {
+				req.Domains = append(req.Domains, name)
+			}
+		}
+	}
+
+	switch api := conf["Le_API"]; {
+	case strings.Contains(api, "staging"):
+		req.Staging = true
+	case api != "" && api != letsEncryptDirectory:
+		req.Directory = api
+	}
+
+	cert := &ManagedCert{
+		Name:     strings.TrimPrefix(primary, "*."),
+		Issuer:   "acme",
+		IssuedAt: time.Now().Format(time.RFC3339),
+	}
+
+	// Le_Webroot is the webroot, "dns_xx", "alpn", or "no" for standalone
+	switch webroot := conf["Le_Webroot"]; {
+	case strings.HasPrefix(webroot, "dns_"):
+		req.Challenge = "dns-01"
+		if api, ok := acmeShDNSAPIs[webroot]; ok {
+			req.Provider = api.provider
+			for _, name := range api.saved {
+				value := conf["SAVED_"+name]
+				if value == "" {
+					value = account["SAVED_"+name]
+				}
+				if value == "" {
+					continue
+				}
+				if req.Credentials == nil {
+					req.Credentials = map[string]string{}
+				}
+				req.Credentials[name] = value
+			}
+		} else {
+			// Earlier versions passed dns_<provider> straight through
+			req.Provider = strings.TrimPrefix(webroot, "dns_")
+			if !dnsProviderKnown(req.Provider) {
+				cert.LastError = fmt.Sprintf("acme.sh DNS API %s has no built-in provider; add a DNS hook named %s", webroot, req.Provider)
+			}
+		}
+	case webroot == "alpn":
+		req.Challenge = "tls-alpn-01"
+	default:
+		req.Challenge = "http-01"
+	}
+
+	cert.Request = req
+	return cert, true
+}
+
+// Read the KEY='value' lines acme.sh writes its configs as
+func parseAcmeShConf(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = strings.ReplaceAll(value, `'\''`, "'")
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type ImportCertRequest struct {
+	Name        string `json:"name"`        // ssl/<name>.crt; defaults to the leaf's domain
+	Certificate string `json:"certificate"` // PEM leaf, optionally followed by its chain and key
+	Key         string `json:"key"`         // PEM private key, unencrypted
+	Chain       string `json:"chain"`       // PEM intermediates
+	PKCS12      string `json:"pkcs12"`      // base64 PKCS#12 bundle, instead of the PEM fields
+	Password    string `json:"password"`    // PKCS#12 password
+	Force       bool   `json:"force"`       // Replace an existing certificate
+}
+
+var certFileNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Import a certificate and its key into ssl/
+func handleImportCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ImportCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var certs []*x509.Certificate
+	var keyPEM []byte
+	if req.PKCS12 != "" {
+		data, err := base64.StdEncoding.DecodeString(req.PKCS12)
+		if err != nil {
+			sendError(w, "pkcs12 must be base64: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		bundle, err := decodePKCS12(r.Context(), data, req.Password)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		certs, keyPEM = decodeCertificateBundle(bundle)
+	} else {
+		certs, keyPEM = decodeCertificateBundle([]byte(req.Certificate + "\n" + req.Chain))
+		if req.Key != "" {
+			keyPEM = []byte(req.Key)
+		}
+	}
+	if len(certs) == 0 {
+		sendError(w, "No certificate found", http.StatusBadRequest)
+		return
+	}
+	if keyPEM == nil {
+		sendError(w, "No private key found", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		sendError(w, "Invalid private key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		sendError(w, "Unsupported private key type", http.StatusBadRequest)
+		return
+	}
+	chain, reordered, err := orderCertificateChain(certs, key)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	leaf := chain[0]
+
+	name := req.Name
+	if name == "" {
+		name = leaf.Subject.CommonName
+		if name == "" && len(leaf.DNSNames) > 0 {
+			name = leaf.DNSNames[0]
+		}
+		name = strings.TrimPrefix(name, "*.")
+	}
+	if !certFileNameRegex.MatchString(name) {
+		sendError(w, "Invalid certificate name: "+name, http.StatusBadRequest)
+		return
+	}
+
+	sslDir := filepath.Join(configDir, "ssl")
+	certPath := filepath.Join(sslDir, name+".crt")
+	keyPath := filepath.Join(sslDir, name+".key")
+	if _, err := os.Stat(certPath); err == nil && !req.Force {
+		sendError(w, "Certificate already exists: "+name+"; use force to replace it", http.StatusConflict)
+		return
+	}
+
+	warnings := []string{}
+	if reordered {
+		warnings = append(warnings, "Chain was out of order and has been reordered leaf first")
+	}
+	if duplicates := len(certs) - len(chain); duplicates > 0 {
+		warnings = append(warnings, fmt.Sprintf("Removed %d duplicate certificate(s) from the chain", duplicates))
+	}
+	if time.Now().After(leaf.NotAfter) {
+		warnings = append(warnings, "Certificate expired on "+leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if err := verifyCertificateChain(leaf, chain); err != nil {
+		warnings = append(warnings, "Chain does not verify against the system roots or the local CA: "+err.Error())
+	}
+
+	keyOut, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var certOut bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	if err := os.MkdirAll(sslDir, 0755); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeCertificatePair(certPath, certOut.Bytes(), keyPath, keyOut); err != nil {
+		sendError(w, "Failed to write "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Renewal would overwrite the imported certificate with a reissued one
+	if forgetManagedCert(name) {
+		warnings = append(warnings, "Automatic renewal was turned off for "+name)
+	}
+	log.Printf("Imported certificate %s (%d in chain)", certPath, len(chain))
+
+	sendJSON(w, map[string]interface{}{
+		"success":     true,
+		"name":        name,
+		"certFile":    certPath,
+		"keyFile":     keyPath,
+		"certificate": parseCertificate(certPath),
+		"warnings":    warnings,
+	})
+}
+
+// Unpack a PKCS#12 bundle into PEM with openssl, since the standard library
+// can't read them. The password goes through the environment, not argv.
+func decodePKCS12(ctx context.Context, data []byte, password string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	run := func(extra ...string) ([]byte, error) {
+		args := append([]string{"pkcs12", "-nodes", "-passin", "env:PKCS12_PASSWORD"}, extra...)
+		cmd := exec.CommandContext(ctx, "openssl", args...)
+		cmd.Env = append(os.Environ(), "PKCS12_PASSWORD="+password)
+		cmd.Stdin = bytes.NewReader(data)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return output, nil
+	}
+
+	output, err := run()
+	if err != nil {
+		// OpenSSL 3 needs -legacy for RC2/3DES bundles, which older tools still write
+		if legacy, legacyErr := run("-legacy"); legacyErr == nil {
+			return legacy, nil
+		}
+		if strings.Contains(err.Error(), "executable file not found") {
+			return nil, errors.New("openssl is required to import PKCS#12 bundles")
+		}
+		return nil, fmt.Errorf("cannot read PKCS#12 bundle (wrong password?): %v", err)
+	}
+	return output, nil
+}
+
+// Put the certificate matching the key first, then each issuer after the
+// certificate it signed. Duplicates are dropped; reports whether the
+// remaining certificates were in a different order.
+func orderCertificateChain(certs []*x509.Certificate, key crypto.Signer) ([]*x509.Certificate, bool, error) {
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, false, errors.New("unsupported private key type")
+	}
+
+	var leaf *x509.Certificate
+	unique := []*x509.Certificate{}
+	rest := []*x509.Certificate{}
+	seen := map[string]bool{}
+	for _, cert := range certs {
+		if seen[string(cert.Raw)] {
+			continue
+		}
+		seen[string(cert.Raw)] = true
+		unique = append(unique, cert)
+		if leaf == nil && public.Equal(cert.PublicKey) {
+			leaf = cert
+			continue
+		}
+		rest = append(rest, cert)
+	}
+	if leaf == nil {
+		return nil, false, errors.New("private key does not match any of the certificates")
+	}
+
+	chain := []*x509.Certificate{leaf}
+	for len(rest) > 0 {
+		current := chain[len(chain)-1]
+		if bytes.Equal(current.RawIssuer, current.RawSubject) {
+			break
+		}
+		next := -1
+		for i, cert := range rest {
+			if current.CheckSignatureFrom(cert) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		chain = append(chain, rest[next])
+		rest = append(rest[:next], rest[next+1:]...)
+	}
+	if len(rest) > 0 {
+		return nil, false, fmt.Errorf("certificate %q is not part of the chain for %q", certificateLabel(rest[0]), certificateLabel(leaf))
+	}
+
+	// Every unique certificate ends up in the chain, so only the order differs
+	reordered := false
+	for i := range chain {
+		if chain[i] != unique[i] {
+			reordered = true
+			break
+		}
+	}
+	return chain, reordered, nil
+}
+
+// Subject, or the first SAN for certificates with an empty subject
+func certificateLabel(cert *x509.Certificate) string {
+	if subject := cert.Subject.String(); subject != "" {
+		return subject
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return fmt.Sprintf("serial %X", cert.SerialNumber)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type CertificateInfo struct {
+	Domain     string `json:"domain"`
+	Path       string `json:"path"`
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+	NotBefore  string `json:"notBefore"`
+	NotAfter   string `json:"notAfter"`
+	DaysLeft   int    `json:"daysLeft"`
+	IsWildcard bool   `json:"isWildcard"`
+
+	Subject            string   `json:"subject"`
+	Issuer             string   `json:"issuer"`
+	SerialNumber       string   `json:"serialNumber"`
+	DNSNames           []string `json:"dnsNames"`
+	IPAddresses        []string `json:"ipAddresses"`
+	EmailAddresses     []string `json:"emailAddresses,omitempty"`
+	KeyType            string   `json:"keyType"` // RSA, ECDSA or Ed25519
+	KeySize            int      `json:"keySize"` // Bits; the curve size for ECDSA
+	SignatureAlgorithm string   `json:"signatureAlgorithm"`
+	FingerprintSHA1    string   `json:"fingerprintSha1"`
+	FingerprintSHA256  string   `json:"fingerprintSha256"`
+	IsCA               bool     `json:"isCA"`
+	SelfSigned         bool     `json:"selfSigned"`
+	ChainLength        int      `json:"chainLength"` // Certificates in the file, leaf included
+	ChainValid         bool     `json:"chainValid"`  // Verifies against the system roots or the local CA
+	ChainError         string   `json:"chainError,omitempty"`
+	KeyMatch           bool     `json:"keyMatch"` // KeyFile holds the leaf's private key
+	KeyError           string   `json:"keyError,omitempty"`
+
+	Vhosts []string    `json:"vhosts"` // Server names using the certificate or its key
+	UsedBy []CertUsage `json:"usedBy"` // Directives referencing them
+}
+
+// Parse a certificate file (PEM bundle or DER). The first non-CA
+// certificate is the leaf; the rest of the bundle is its chain.
+// Returns nil when the file holds no certificates, e.g. a key-only .pem.
+func parseCertificate(certPath string) *CertificateInfo {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil
+	}
+
+	certs, bundledKey := decodeCertificateBundle(data)
+	if len(certs) == 0 {
+		return nil
+	}
+
+	leaf := certs[0]
+	for _, cert := range certs {
+		if !cert.IsCA {
+			leaf = cert
+			break
+		}
+	}
+
+	info := &CertificateInfo{
+		Path:               certPath,
+		CertFile:           certPath,
+		NotBefore:          leaf.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:           leaf.NotAfter.UTC().Format(time.RFC3339),
+		DaysLeft:           int(time.Until(leaf.NotAfter).Hours() / 24),
+		Subject:            leaf.Subject.String(),
+		Issuer:             leaf.Issuer.String(),
+		SerialNumber:       fmt.Sprintf("%X", leaf.SerialNumber),
+		DNSNames:           []string{},
+		IPAddresses:        []string{},
+		EmailAddresses:     leaf.EmailAddresses,
+		SignatureAlgorithm: leaf.SignatureAlgorithm.String(),
+		IsCA:               leaf.IsCA,
+		SelfSigned:         leaf.CheckSignatureFrom(leaf) == nil,
+		ChainLength:        len(certs),
+		Vhosts:             []string{},
+		UsedBy:             []CertUsage{},
+	}
+	info.KeyType, info.KeySize = publicKeyInfo(leaf.PublicKey)
+	sum1 := sha1.Sum(leaf.Raw)
+	sum256 := sha256.Sum256(leaf.Raw)
+	info.FingerprintSHA1 = certFingerprint(sum1[:])
+	info.FingerprintSHA256 = certFingerprint(sum256[:])
+
+	info.DNSNames = append(info.DNSNames, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, name := range info.DNSNames {
+		if strings.HasPrefix(name, "*.") {
+			info.IsWildcard = true
+		}
+	}
+
+	// Prefer the CN the old listing showed; fall back to the first SAN
+	info.Domain = leaf.Subject.CommonName
+	if info.Domain == "" && len(info.DNSNames) > 0 {
+		info.Domain = info.DNSNames[0]
+	}
+	if info.Domain == "" && len(info.IPAddresses) > 0 {
+		info.Domain = info.IPAddresses[0]
+	}
+	if info.Domain == "" {
+		info.Domain = strings.TrimSuffix(filepath.Base(certPath), filepath.Ext(certPath))
+	}
+	if strings.HasPrefix(info.Domain, "*.") {
+		info.IsWildcard = true
+	}
+
+	if err := verifyCertificateChain(leaf, certs); err != nil {
+		info.ChainError = err.Error()
+	} else {
+		info.ChainValid = true
+	}
+
+	// Find corresponding key file, or use a key bundled with the certificate
+	var keyPEM []byte
+	keyPath := strings.TrimSuffix(certPath, filepath.Ext(certPath)) + ".key"
+	if bundledKey != nil {
+		info.KeyFile = certPath
+		keyPEM = bundledKey
+	} else if data, err := os.ReadFile(keyPath); err == nil {
+		info.KeyFile = keyPath
+		keyPEM = data
+	}
+	if keyPEM != nil {
+		if err := matchPrivateKey(leaf, keyPEM); err != nil {
+			info.KeyError = err.Error()
+		} else {
+			info.KeyMatch = true
+		}
+	}
+
+	return info
+}
+
+// Split PEM data into certificates and the first private key block.
+// Data without any PEM blocks is tried as a single DER certificate.
+func decodeCertificateBundle(data []byte) ([]*x509.Certificate, []byte) {
+	certs := []*x509.Certificate{}
+	var key []byte
+	sawPEM := false
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		sawPEM = true
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				certs = append(certs, cert)
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+			key = pem.EncodeToMemory(block)
+		}
+	}
+
+	if !sawPEM {
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, key
+}
+
+// Verify the leaf against the system roots and the local CA's, using the
+// rest of the bundle as intermediates
+func verifyCertificateChain(leaf *x509.Certificate, bundle []*x509.Certificate) error {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if root := localCARoot(); root != nil {
+		roots.AddCert(root)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range bundle {
+		if cert != leaf {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// Check that a PEM private key belongs to the certificate
+func matchPrivateKey(cert *x509.Certificate, keyPEM []byte) error {
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+	return nil
+}
+
+// Parse a PKCS#1, SEC 1 or PKCS#8 private key
+func parsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, errors.New("private key is encrypted")
+		}
+	}
+}
+
+func publicKeyInfo(key crypto.PublicKey) (string, int) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return "unknown", 0
+}
+
+// Colon-separated uppercase hex, as openssl prints fingerprints
+func certFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertJob is one background certificate operation and its log
+type CertJob struct {
+	ID         string        `json:"id"`
+	Kind       string        `json:"kind"` // obtain or renew
+	Domains    []string      `json:"domains"`
+	Challenge  string        `json:"challenge"`
+	Provider   string        `json:"provider,omitempty"`
+	Profile    string        `json:"credentialProfile,omitempty"`
+	Staging    bool          `json:"staging,omitempty"`
+	Status     string        `json:"status"` // queued, running, succeeded, failed or cancelled
+	CreatedAt  string        `json:"createdAt"`
+	StartedAt  string        `json:"startedAt,omitempty"`
+	FinishedAt string        `json:"finishedAt,omitempty"`
+	CertFile   string        `json:"certFile,omitempty"`
+	KeyFile    string        `json:"keyFile,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Log        []CertJobLine `json:"log,omitempty"`
+
+	cancel      context.CancelFunc
+	subscribers map[chan CertJobLine]bool
+	done        chan struct{} // Closed once the job has finished
+	savedAt     time.Time     // Last write of the job file
+}
+
+type CertJobLine struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+var (
+	certJobs     = map[string]*CertJob{}
+	certJobsLock sync.Mutex
+	certJobsDir  = filepath.Join("/app/data", "cert-jobs")
+
+	// Saves share a temp file per job; one at a time keeps the newest last
+	certJobsSaveLock sync.Mutex
+
+	// Jobs run one at a time: the HTTP-01 and TLS-ALPN-01 responders
+	// can't share their ports
+	certJobSlot = make(chan struct{}, 1)
+)
+
+const (
+	maxCertJobs       = 200
+	maxCertJobLogSize = 5000
+
+	// Log lines rewrite the job file at most this often; status changes
+	// and the finish are always written
+	certJobSaveInterval = 2 * time.Second
+)
+
+// List jobs newest first (GET), or one job with its log (GET ?id=)
+func handleCertJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		job := certJobSnapshot(id, true)
+		if job == nil {
+			sendError(w, "Job not found: "+id, http.StatusNotFound)
+			return
+		}
+		sendJSON(w, job)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			sendError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	jobs := listCertJobs(false)
+	total := len(jobs)
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	sendJSON(w, map[string]interface{}{
+		"jobs":  jobs,
+		"total": total,
+	})
+}
+
+// Cancel a queued or running job
+func handleCertJobCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		var req struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		id = req.ID
+	}
+
+	certJobsLock.Lock()
+	job, ok := certJobs[id]
+	if !ok {
+		certJobsLock.Unlock()
+		sendError(w, "Job not found: "+id, http.StatusNotFound)
+		return
+	}
+	if job.Status != "queued" && job.Status != "running" {
+		status := job.Status
+		certJobsLock.Unlock()
+		sendError(w, "Job is already "+status, http.StatusConflict)
+		return
+	}
+	job.cancel()
+	certJobsLock.Unlock()
+
+	sendJSON(w, map[string]interface{}{"status": "ok"})
+}
+
+// Stream a job's log over Server-Sent Events: the lines so far, then new
+// ones as they're logged, then a final "status" event with the job
+func handleCertJobStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	certJobsLock.Lock()
+	job, exists := certJobs[id]
+	if !exists {
+		certJobsLock.Unlock()
+		sendError(w, "Job not found: "+id, http.StatusNotFound)
+		return
+	}
+	backlog := append([]CertJobLine{}, job.Log...)
+	var ch chan CertJobLine
+	if job.subscribers != nil {
+		ch = make(chan CertJobLine, 256)
+		job.subscribers[ch] = true
+	}
+	certJobsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	for _, line := range backlog {
+		data, _ := json.Marshal(line)
+		writeSSE(w, "line", string(data))
+	}
+	flusher.Flush()
+
+	// Finished jobs have nothing more to send
+	if ch != nil {
+		defer func() {
+			certJobsLock.Lock()
+			delete(job.subscribers, ch)
+			certJobsLock.Unlock()
+		}()
+
+		heartbeat := time.NewTicker(tailHeartbeat)
+		defer heartbeat.Stop()
+
+	stream:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-ch:
+				if !ok {
+					break stream
+				}
+				data, _ := json.Marshal(line)
+				writeSSE(w, "line", string(data))
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+
+	data, _ := json.Marshal(certJobSnapshot(id, false))
+	writeSSE(w, "status", string(data))
+	flusher.Flush()
+}
+
+// Start an issuance job in the background
+func startCertJob(kind string, req ObtainCertRequest) *CertJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &CertJob{
+		ID:          newCertJobID(),
+		Kind:        kind,
+		Domains:     req.Domains,
+		Challenge:   req.Challenge,
+		Provider:    req.Provider,
+		Profile:     req.CredentialProfile,
+		Staging:     req.Staging,
+		Status:      "queued",
+		CreatedAt:   time.Now().Format(time.RFC3339),
+		Log:         []CertJobLine{},
+		cancel:      cancel,
+		subscribers: map[chan CertJobLine]bool{},
+		done:        make(chan struct{}),
+	}
+
+	certJobsLock.Lock()
+	certJobs[job.ID] = job
+	certJobsLock.Unlock()
+	saveCertJob(job)
+
+	go runCertJob(ctx, job, req)
+	return job
+}
+
+func runCertJob(ctx context.Context, job *CertJob, req ObtainCertRequest) {
+	logf := job.logf
+
+	logf("Certificate obtain request - Domains: %v, Challenge: %s, Provider: %s, Profile: %s, Staging: %v, Force: %v",
+		req.Domains, req.Challenge, req.Provider, req.CredentialProfile, req.Staging, req.Force)
+
+	select {
+	case certJobSlot <- struct{}{}:
+		defer func() { <-certJobSlot }()
+	default:
+		logf("Waiting for the running job to finish")
+		select {
+		case certJobSlot <- struct{}{}:
+			defer func() { <-certJobSlot }()
+		case <-ctx.Done():
+			job.finish("", "", ctx.Err())
+			return
+		}
+	}
+
+	certJobsLock.Lock()
+	job.Status = "running"
+	job.StartedAt = time.Now().Format(time.RFC3339)
+	certJobsLock.Unlock()
+	saveCertJob(job)
+
+	// 10 minutes for DNS-01 (propagation), 2 minutes otherwise
+	timeout := 2 * time.Minute
+	if req.Challenge == "dns-01" {
+		timeout = 10 * time.Minute
+	}
+	issueCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	certFile, keyFile, err := issueCertificate(issueCtx, req, logf)
+	// Errors wrap the context's only as text; tell cancel and timeout apart here
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	} else if err != nil && issueCtx.Err() != nil {
+		err = fmt.Errorf("certificate obtain timeout after %v", timeout)
+	}
+	if err == nil {
+		recordManagedCert(certFile, "acme", req, 0)
+	}
+	job.finish(certFile, keyFile, err)
+}
+
+// Append a line to the job's log, fan it out and persist the job if the
+// last save is older than certJobSaveInterval
+func (job *CertJob) logf(format string, args ...interface{}) {
+	line := CertJobLine{
+		Time:    time.Now().Format(time.RFC3339),
+		Message: fmt.Sprintf(format, args...),
+	}
+	log.Printf("[cert job %s] %s", job.ID, line.Message)
+
+	certJobsLock.Lock()
+	if len(job.Log) < maxCertJobLogSize {
+		job.Log = append(job.Log, line)
+	}
+	for ch := range job.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	due := time.Since(job.savedAt) >= certJobSaveInterval
+	certJobsLock.Unlock()
+	if due {
+		saveCertJob(job)
+	}
+}
+
+// Record the outcome and close the job's streams
+func (job *CertJob) finish(certFile, keyFile string, err error) {
+	switch {
+	case err == nil:
+		job.logf("Certificate obtained for %v: %s, %s", job.Domains, certFile, keyFile)
+	case errors.Is(err, context.Canceled):
+		job.logf("Cancelled")
+	default:
+		job.logf("ERROR: Certificate obtain failed: %v", err)
+	}
+
+	certJobsLock.Lock()
+	job.FinishedAt = time.Now().Format(time.RFC3339)
+	switch {
+	case err == nil:
+		job.Status = "succeeded"
+		job.CertFile = certFile
+		job.KeyFile = keyFile
+	case errors.Is(err, context.Canceled):
+		job.Status = "cancelled"
+	default:
+		job.Status = "failed"
+		job.Error = err.Error()
+	}
+	for ch := range job.subscribers {
+		close(ch)
+	}
+	job.subscribers = nil
+	job.cancel()
+	close(job.done)
+	certJobsLock.Unlock()
+
+	saveCertJob(job)
+	pruneCertJobs()
+}
+
+// Copy of a job, with or without its log
+func certJobSnapshot(id string, withLog bool) *CertJob {
+	certJobsLock.Lock()
+	defer certJobsLock.Unlock()
+
+	job, ok := certJobs[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *job
+	snapshot.Log = nil
+	if withLog {
+		snapshot.Log = append([]CertJobLine{}, job.Log...)
+	}
+	return &snapshot
+}
+
+// Jobs newest first
+func listCertJobs(withLog bool) []*CertJob {
+	certJobsLock.Lock()
+	ids := []string{}
+	for id := range certJobs {
+		ids = append(ids, id)
+	}
+	certJobsLock.Unlock()
+
+	jobs := []*CertJob{}
+	for _, id := range ids {
+		if job := certJobSnapshot(id, withLog); job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	return jobs
+}
+
+// Time-ordered, so sorting by ID sorts by creation
+func newCertJobID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405.000000") + "-" + hex.EncodeToString(b)
+}
+
+// The certificate obtain log, rebuilt from the job history: the last
+// ?lines= lines across jobs (or of ?job=), oldest first
+func handleCertObtainLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseLogQuery(r, 500)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobs := listCertJobs(true)
+	if id := r.URL.Query().Get("job"); id != "" {
+		filtered := []*CertJob{}
+		for _, job := range jobs {
+			if job.ID == id {
+				filtered = append(filtered, job)
+			}
+		}
+		jobs = filtered
+	}
+
+	// Newest jobs first; collect backwards until the limit, then reverse
+	type jobLine struct {
+		job  string
+		line CertJobLine
+	}
+	lines := []jobLine{}
+	for _, job := range jobs {
+		for i := len(job.Log) - 1; i >= 0 && len(lines) < query.limit; i-- {
+			lines = append(lines, jobLine{job.ID, job.Log[i]})
+		}
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+
+	if format := r.URL.Query().Get("export"); format != "" {
+		if format != "csv" && format != "ndjson" {
+			sendError(w, "format must be csv or ndjson", http.StatusBadRequest)
+			return
+		}
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cert-obtain-%s.%s"`, time.Now().Format("20060102-150405"), format))
+
+		writer := newExportWriter(w, format, []string{"job", "time", "message"})
+		for _, l := range lines {
+			writer.write([]interface{}{l.job, l.line.Time, l.line.Message})
+		}
+		writer.flush()
+		return
+	}
+
+	var text strings.Builder
+	for _, l := range lines {
+		fmt.Fprintf(&text, "%s: [%s] %s\n", l.line.Time, l.job, l.line.Message)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(text.String()))
+}
+
+// Job history persistence, one file per job
+func saveCertJob(job *CertJob) {
+	certJobsSaveLock.Lock()
+	defer certJobsSaveLock.Unlock()
+
+	certJobsLock.Lock()
+	data, err := json.MarshalIndent(job, "", "  ")
+	job.savedAt = time.Now()
+	certJobsLock.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(certJobsDir, 0755); err != nil {
+		log.Printf("Warning: Failed to save certificate job: %v", err)
+		return
+	}
+	// A torn file would be skipped by loadCertJobs and the job lost
+	if err := writeFileAtomic(filepath.Join(certJobsDir, job.ID+".json"), data, 0644); err != nil {
+		log.Printf("Warning: Failed to save certificate job: %v", err)
+	}
+}
+
+// Keep the newest maxCertJobs finished jobs
+func pruneCertJobs() {
+	jobs := listCertJobs(false)
+	if len(jobs) <= maxCertJobs {
+		return
+	}
+
+	certJobsLock.Lock()
+	defer certJobsLock.Unlock()
+	for _, job := range jobs[maxCertJobs:] {
+		if job.Status == "queued" || job.Status == "running" {
+			continue
+		}
+		delete(certJobs, job.ID)
+		os.Remove(filepath.Join(certJobsDir, job.ID+".json"))
+	}
+}
+
+func loadCertJobs() error {
+	matches, err := filepath.Glob(filepath.Join(certJobsDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	interrupted := []*CertJob{}
+	certJobsLock.Lock()
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		job := &CertJob{}
+		if err := json.Unmarshal(data, job); err != nil || job.ID == "" {
+			continue
+		}
+		// The process that ran it is gone
+		if job.Status == "queued" || job.Status == "running" {
+			job.Status = "failed"
+			job.Error = "interrupted by restart"
+			if job.FinishedAt == "" {
+				job.FinishedAt = time.Now().Format(time.RFC3339)
+			}
+			interrupted = append(interrupted, job)
+		}
+		certJobs[job.ID] = job
+	}
+	certJobsLock.Unlock()
+
+	for _, job := range interrupted {
+		saveCertJob(job)
+	}
+	return nil
+}
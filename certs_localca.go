@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalCertRequest asks the local CA for a server certificate
+type LocalCertRequest struct {
+	Name         string   `json:"name"`         // ssl/<name>.crt; defaults to the first domain
+	Domains      []string `json:"domains"`      // DNS names (wildcards allowed) and IP addresses
+	ValidityDays int      `json:"validityDays"` // Defaults to 365
+	KeyType      string   `json:"keyType"`      // ec256, ec384, rsa2048, rsa3072 or rsa4096
+	Force        bool     `json:"force"`        // Replace a certificate that didn't come from the local CA
+}
+
+type LocalCAStatus struct {
+	Exists       bool             `json:"exists"`
+	Root         *CertificateInfo `json:"root,omitempty"`
+	Intermediate *CertificateInfo `json:"intermediate,omitempty"`
+	Issued       []string         `json:"issued"` // Managed certificates from the local CA
+}
+
+var (
+	localCADir = filepath.Join("/app/data", "local-ca")
+
+	// Serializes CA creation, intermediate rotation and issuance
+	localCALock sync.Mutex
+)
+
+const (
+	localCARootValidity         = 10 * 365 * 24 * time.Hour
+	localCAIntermediateValidity = 5 * 365 * 24 * time.Hour
+	defaultLocalCertValidity    = 365
+)
+
+// Get the CA (GET), or create it (POST {commonName, organization, force})
+func handleLocalCA(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendJSON(w, localCAStatus())
+	case http.MethodPost:
+		var req struct {
+			CommonName   string `json:"commonName"`
+			Organization string `json:"organization"`
+			Force        bool   `json:"force"` // Replace an existing CA; its certificates stop being trusted
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.CommonName == "" {
+			req.CommonName = "server-manager Local CA"
+		}
+
+		if _, err := os.Stat(filepath.Join(localCADir, "root.crt")); err == nil && !req.Force {
+			sendError(w, "Local CA already exists; use force to replace it", http.StatusConflict)
+			return
+		}
+		if err := createLocalCA(req.CommonName, req.Organization); err != nil {
+			sendError(w, "Failed to create local CA: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, map[string]interface{}{"status": "ok", "ca": localCAStatus()})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Download the root certificate for clients to trust (PEM, or ?format=der)
+func handleLocalCARoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(localCADir, "root.crt"))
+	if err != nil {
+		sendError(w, "Local CA has not been created", http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="server-manager-root-ca.crt"`)
+		w.Write(data)
+	case "der":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			sendError(w, "Root certificate is not PEM", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", `attachment; filename="server-manager-root-ca.cer"`)
+		w.Write(block.Bytes)
+	default:
+		sendError(w, "format must be pem or der", http.StatusBadRequest)
+	}
+}
+
+// Issue a server certificate from the local CA into ssl/; it's renewed by
+// the renewal scheduler from then on
+func handleLocalCAIssue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LocalCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Domains) == 0 {
+		sendError(w, "At least one domain or IP address is required", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		req.Name = strings.TrimPrefix(req.Domains[0], "*.")
+	}
+	if req.ValidityDays == 0 {
+		req.ValidityDays = defaultLocalCertValidity
+	}
+	if !certFileNameRegex.MatchString(req.Name) {
+		sendError(w, "Invalid certificate name: "+req.Name, http.StatusBadRequest)
+		return
+	}
+
+	// Don't overwrite a certificate from elsewhere by accident
+	certPath := filepath.Join(configDir, "ssl", req.Name+".crt")
+	if _, err := os.Stat(certPath); err == nil && !req.Force {
+		managedCertsLock.Lock()
+		cert, ok := managedCerts[req.Name]
+		fromLocalCA := ok && cert.Issuer == "local-ca"
+		managedCertsLock.Unlock()
+		if !fromLocalCA {
+			sendError(w, "Certificate already exists: "+req.Name+"; use force to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	certFile, keyFile, err := issueLocalCertificate(req)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recordManagedCert(certFile, "local-ca", ObtainCertRequest{Domains: req.Domains, KeyType: req.KeyType}, req.ValidityDays)
+	log.Printf("Issued %s from the local CA for %v", certFile, req.Domains)
+
+	sendJSON(w, map[string]interface{}{
+		"success":     true,
+		"name":        req.Name,
+		"certFile":    certFile,
+		"keyFile":     keyFile,
+		"certificate": parseCertificate(certFile),
+	})
+}
+
+func localCAStatus() LocalCAStatus {
+	status := LocalCAStatus{Issued: []string{}}
+	status.Root = parseCertificate(filepath.Join(localCADir, "root.crt"))
+	status.Intermediate = parseCertificate(filepath.Join(localCADir, "intermediate.crt"))
+	status.Exists = status.Root != nil && status.Intermediate != nil
+
+	managedCertsLock.Lock()
+	for _, cert := range managedCerts {
+		if cert.Issuer == "local-ca" {
+			status.Issued = append(status.Issued, cert.Name)
+		}
+	}
+	managedCertsLock.Unlock()
+	sort.Strings(status.Issued)
+	return status
+}
+
+// Create a new root and an intermediate signed by it. Leaf certificates are
+// only ever signed by the intermediate; the root key just signs its
+// replacements.
+func createLocalCA(commonName, organization string) error {
+	localCALock.Lock()
+	defer localCALock.Unlock()
+
+	if err := os.MkdirAll(localCADir, 0700); err != nil {
+		return err
+	}
+
+	rootKey, err := generateCertKey("ec384")
+	if err != nil {
+		return err
+	}
+	subject := pkix.Name{CommonName: commonName + " Root"}
+	if organization != "" {
+		subject.Organization = []string{organization}
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(localCARootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, rootKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if err := writeLocalCAFile("root", root, rootKey); err != nil {
+		return err
+	}
+
+	subject.CommonName = commonName + " Intermediate"
+	return createLocalIntermediate(root, rootKey, subject)
+}
+
+// Sign a new intermediate with the root; callers hold localCALock
+func createLocalIntermediate(root *x509.Certificate, rootKey crypto.Signer, subject pkix.Name) error {
+	key, err := generateCertKey("ec384")
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	notAfter := time.Now().Add(localCAIntermediateValidity)
+	if notAfter.After(root.NotAfter) {
+		notAfter = root.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	return writeLocalCAFile("intermediate", cert, key)
+}
+
+// Sign a server certificate with the intermediate and install it, with the
+// intermediate, into ssl/
+func issueLocalCertificate(req LocalCertRequest) (string, string, error) {
+	for _, domain := range req.Domains {
+		if net.ParseIP(domain) == nil && !certNameRegex.MatchString(domain) {
+			return "", "", fmt.Errorf("invalid domain: %s", domain)
+		}
+	}
+	if req.ValidityDays == 0 {
+		req.ValidityDays = defaultLocalCertValidity
+	}
+	if req.ValidityDays < 1 {
+		return "", "", errors.New("validityDays must be at least 1")
+	}
+	if req.KeyType == "" {
+		req.KeyType = "ec256"
+	}
+	if !containsString(certKeyTypes, req.KeyType) {
+		return "", "", fmt.Errorf("invalid key type: %s (expected %s)", req.KeyType, strings.Join(certKeyTypes, ", "))
+	}
+	if req.Name == "" {
+		req.Name = strings.TrimPrefix(req.Domains[0], "*.")
+	}
+
+	localCALock.Lock()
+	defer localCALock.Unlock()
+
+	intermediate, intermediateKey, err := readLocalCAFile("intermediate")
+	if err != nil {
+		return "", "", fmt.Errorf("local CA has not been created: %v", err)
+	}
+	notAfter := time.Now().Add(time.Duration(req.ValidityDays) * 24 * time.Hour)
+
+	// An intermediate that expires first is replaced, if a new one would last
+	if notAfter.After(intermediate.NotAfter) {
+		root, rootKey, err := readLocalCAFile("root")
+		if err != nil {
+			return "", "", err
+		}
+		limit := time.Now().Add(localCAIntermediateValidity)
+		if limit.After(root.NotAfter) {
+			limit = root.NotAfter
+		}
+		if notAfter.After(limit) {
+			return "", "", fmt.Errorf("validity exceeds what the local CA can issue (until %s)", limit.UTC().Format(time.RFC3339))
+		}
+		log.Printf("Local CA intermediate expires %s; replacing it", intermediate.NotAfter.UTC().Format(time.RFC3339))
+		if err := createLocalIntermediate(root, rootKey, intermediate.Subject); err != nil {
+			return "", "", err
+		}
+		if intermediate, intermediateKey, err = readLocalCAFile("intermediate"); err != nil {
+			return "", "", err
+		}
+	}
+
+	key, err := generateCertKey(req.KeyType)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: req.Domains[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, domain := range req.Domains {
+		if ip := net.ParseIP(domain); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, domain)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, intermediate, key.Public(), intermediateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	sslDir := filepath.Join(configDir, "ssl")
+	if err := os.MkdirAll(sslDir, 0755); err != nil {
+		return "", "", err
+	}
+	certPath := filepath.Join(sslDir, req.Name+".crt")
+	keyPath := filepath.Join(sslDir, req.Name+".key")
+	if err := writeCertificatePair(certPath, chain.Bytes(), keyPath, keyPEM); err != nil {
+		return "", "", fmt.Errorf("writing %v", err)
+	}
+	return certPath, keyPath, nil
+}
+
+// The local root, for verifying chains; nil until the CA is created
+func localCARoot() *x509.Certificate {
+	data, err := os.ReadFile(filepath.Join(localCADir, "root.crt"))
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return root
+}
+
+// <name>.crt and <name>.key (600) in the CA directory
+func writeLocalCAFile(name string, cert *x509.Certificate, key crypto.Signer) error {
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(localCADir, name+".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return writeFileAtomic(filepath.Join(localCADir, name+".crt"), certPEM, 0644)
+}
+
+func readLocalCAFile(name string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(filepath.Join(localCADir, name+".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s.crt is not PEM", name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(localCADir, name+".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.key is not a signing key", name)
+	}
+	return cert, signer, nil
+}
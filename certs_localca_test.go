@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs every local CA signing path: the root, an intermediate replacement
+// and leaf certificates of both key families
+func TestLocalCAIssueCertificate(t *testing.T) {
+	savedCADir, savedConfigDir := localCADir, configDir
+	t.Cleanup(func() {
+		localCADir, configDir = savedCADir, savedConfigDir
+	})
+	localCADir = filepath.Join(t.TempDir(), "local-ca")
+	configDir = t.TempDir()
+
+	if err := createLocalCA("Test CA", "Server Manager"); err != nil {
+		t.Fatalf("createLocalCA: %v", err)
+	}
+	root, rootKey, err := readLocalCAFile("root")
+	if err != nil {
+		t.Fatalf("reading root: %v", err)
+	}
+	intermediate, _, err := readLocalCAFile("intermediate")
+	if err != nil {
+		t.Fatalf("reading intermediate: %v", err)
+	}
+	if err := createLocalIntermediate(root, rootKey, intermediate.Subject); err != nil {
+		t.Fatalf("createLocalIntermediate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(localCARoot())
+
+	tests := []LocalCertRequest{
+		{Domains: []string{"app.internal", "*.app.internal"}, KeyType: "ec256"},
+		{Name: "printer", Domains: []string{"printer.lan", "192.168.1.20"}, KeyType: "rsa2048", ValidityDays: 30},
+	}
+	for _, req := range tests {
+		t.Run(req.KeyType, func(t *testing.T) {
+			certPath, keyPath, err := issueLocalCertificate(req)
+			if err != nil {
+				t.Fatalf("issueLocalCertificate: %v", err)
+			}
+
+			pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				t.Fatalf("certificate and key don't match: %v", err)
+			}
+			if len(pair.Certificate) != 2 {
+				t.Fatalf("chain has %d certificates, want the leaf and the intermediate", len(pair.Certificate))
+			}
+			leaf, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			issuer, err := x509.ParseCertificate(pair.Certificate[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			intermediates := x509.NewCertPool()
+			intermediates.AddCert(issuer)
+
+			for _, name := range req.Domains {
+				name = strings.Replace(name, "*", "www", 1)
+				_, err := leaf.Verify(x509.VerifyOptions{
+					DNSName:       name,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err != nil {
+					t.Errorf("verifying %s: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CertRenewalSettings struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"` // Hours between checks
+	Days     int  `json:"days"`     // Renew certificates with fewer days left, unless overridden per certificate
+	Reload   bool `json:"reload"`   // Reload nginx after a renewal
+}
+
+// ManagedCert is how a certificate in ssl/ was issued, replayed to renew it
+type ManagedCert struct {
+	Name        string            `json:"name"`   // ssl/<name>.crt
+	Issuer      string            `json:"issuer"` // acme or local-ca
+	Request     ObtainCertRequest `json:"request"`
+	Validity    int               `json:"validityDays,omitempty"` // local-ca certificate lifetime
+	Days        int               `json:"days,omitempty"`         // Overrides the default threshold
+	Disabled    bool              `json:"disabled,omitempty"`
+	IssuedAt    string            `json:"issuedAt"`
+	LastRenewed string            `json:"lastRenewed,omitempty"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+// CertRenewalStatus is a certificate as the scheduler sees it; it never
+// carries the request's credentials
+type CertRenewalStatus struct {
+	Name        string   `json:"name"`
+	CertFile    string   `json:"certFile"`
+	Managed     bool     `json:"managed"`
+	Issuer      string   `json:"issuer,omitempty"`
+	Domains     []string `json:"domains"`
+	Challenge   string   `json:"challenge,omitempty"`
+	Provider    string   `json:"provider,omitempty"`
+	Profile     string   `json:"credentialProfile,omitempty"`
+	NotAfter    string   `json:"notAfter"`
+	DaysLeft    int      `json:"daysLeft"`
+	Days        int      `json:"days"`                   // Effective threshold
+	DaysSet     int      `json:"daysOverride,omitempty"` // Per-certificate threshold, if any
+	Disabled    bool     `json:"disabled"`
+	Due         bool     `json:"due"`
+	LastRenewed string   `json:"lastRenewed,omitempty"`
+	LastError   string   `json:"lastError,omitempty"`
+	Warning     string   `json:"warning,omitempty"` // Due but nothing will renew it
+}
+
+type CertRenewalRun struct {
+	ID          string              `json:"id"`
+	Trigger     string              `json:"trigger"` // schedule or manual
+	Status      string              `json:"status"`  // running, succeeded or failed
+	StartedAt   string              `json:"startedAt"`
+	FinishedAt  string              `json:"finishedAt,omitempty"`
+	Checked     int                 `json:"checked"`
+	Renewed     int                 `json:"renewed"`
+	Failed      int                 `json:"failed"`
+	Results     []CertRenewalResult `json:"results"`
+	Reloaded    bool                `json:"reloaded"`
+	ReloadError string              `json:"reloadError,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+type CertRenewalResult struct {
+	Name     string `json:"name"`
+	DaysLeft int    `json:"daysLeft"`
+	Action   string `json:"action"` // valid, renewed, failed or skipped
+	JobID    string `json:"jobId,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+var (
+	certRenewalSettings = CertRenewalSettings{
+		Enabled:  true,
+		Interval: 12,
+		Days:     defaultCertRenewalDays(),
+		Reload:   true,
+	}
+	certRenewalLock sync.RWMutex
+	certRenewalFile = filepath.Join("/app/data", "cert-renewal.json")
+
+	managedCerts     = map[string]*ManagedCert{}
+	managedCertsLock sync.Mutex
+	managedCertsFile = filepath.Join("/app/data", "managed-certs.json")
+
+	certRenewalRuns     = []*CertRenewalRun{}
+	certRenewalActive   *CertRenewalRun
+	certRenewalRunsLock sync.Mutex
+	certRenewalRunsFile = filepath.Join("/app/data", "cert-renewal-runs.json")
+)
+
+const maxCertRenewalRuns = 100
+
+// CERT_RENEWAL_DAYS seeds the default threshold, as it did for renew-certs.sh
+func defaultCertRenewalDays() int {
+	if days, err := strconv.Atoi(os.Getenv("CERT_RENEWAL_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return 30
+}
+
+// Get or update renewal settings, with the last and next run
+func handleCertRenewal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		certRenewalLock.RLock()
+		settings := certRenewalSettings
+		certRenewalLock.RUnlock()
+
+		resp := map[string]interface{}{
+			"settings": settings,
+			"running":  false,
+		}
+		certRenewalRunsLock.Lock()
+		if len(certRenewalRuns) > 0 {
+			resp["lastRun"] = certRenewalRunSnapshot(certRenewalRuns[len(certRenewalRuns)-1])
+		}
+		resp["running"] = certRenewalActive != nil
+		certRenewalRunsLock.Unlock()
+		if settings.Enabled {
+			resp["nextRun"] = nextCertRenewalRun(settings).Format(time.RFC3339)
+		}
+		sendJSON(w, resp)
+	case http.MethodPost:
+		var settings CertRenewalSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Days < 1 {
+			sendError(w, "days must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if settings.Interval <= 0 {
+			settings.Interval = 12
+		}
+
+		certRenewalLock.Lock()
+		certRenewalSettings = settings
+		certRenewalLock.Unlock()
+
+		if err := saveCertRenewalSettings(); err != nil {
+			log.Printf("Warning: Failed to save certificate renewal settings: %v", err)
+		}
+
+		sendJSON(w, map[string]interface{}{"status": "ok", "settings": settings})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Run a renewal check now: every certificate, or just ?name= / {"name"};
+// force renews regardless of the threshold
+func handleCertRenewalRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name"`
+		Force bool   `json:"force"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		req.Name = name
+	}
+	if req.Name != "" {
+		managedCertsLock.Lock()
+		_, ok := managedCerts[req.Name]
+		managedCertsLock.Unlock()
+		if !ok {
+			sendError(w, "Not a managed certificate: "+req.Name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	run, started := startCertRenewalRun("manual", req.Name, req.Force)
+	if !started {
+		sendError(w, "A renewal run is already in progress: "+run.ID, http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Location", "/api/certificates/renewal/runs?id="+run.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"runId":   run.ID,
+		"run":     run,
+	})
+}
+
+// Run history newest first (GET), or one run (GET ?id=)
+func handleCertRenewalRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			sendError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	id := r.URL.Query().Get("id")
+
+	certRenewalRunsLock.Lock()
+	runs := []*CertRenewalRun{}
+	for i := len(certRenewalRuns) - 1; i >= 0; i-- {
+		runs = append(runs, certRenewalRunSnapshot(certRenewalRuns[i]))
+	}
+	certRenewalRunsLock.Unlock()
+
+	if id != "" {
+		for _, run := range runs {
+			if run.ID == id {
+				sendJSON(w, run)
+				return
+			}
+		}
+		sendError(w, "Run not found: "+id, http.StatusNotFound)
+		return
+	}
+
+	total := len(runs)
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	sendJSON(w, map[string]interface{}{
+		"runs":  runs,
+		"total": total,
+	})
+}
+
+// List every certificate with its renewal state (GET), or set a managed
+// certificate's threshold and whether it's renewed (POST)
+func handleCertRenewalCerts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendJSON(w, certRenewalStatuses())
+	case http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Days     int    `json:"days"` // 0 uses the default
+			Disabled bool   `json:"disabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Days < 0 {
+			sendError(w, "days must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		managedCertsLock.Lock()
+		cert, ok := managedCerts[req.Name]
+		if ok {
+			cert.Days = req.Days
+			cert.Disabled = req.Disabled
+		}
+		managedCertsLock.Unlock()
+		if !ok {
+			sendError(w, "Not a managed certificate: "+req.Name, http.StatusNotFound)
+			return
+		}
+
+		if err := saveManagedCerts(); err != nil {
+			log.Printf("Warning: Failed to save managed certificates: %v", err)
+		}
+		sendJSON(w, map[string]interface{}{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Check on the interval, picking up where the last run left off after a restart
+func runCertRenewal() {
+	for {
+		certRenewalLock.RLock()
+		settings := certRenewalSettings
+		certRenewalLock.RUnlock()
+
+		next := nextCertRenewalRun(settings)
+		if settings.Enabled && !time.Now().Before(next) {
+			startCertRenewalRun("schedule", "", false)
+		}
+
+		time.Sleep(time.Minute)
+	}
+}
+
+// An interval after the last run started, or right away if there's none
+func nextCertRenewalRun(settings CertRenewalSettings) time.Time {
+	certRenewalRunsLock.Lock()
+	defer certRenewalRunsLock.Unlock()
+
+	if len(certRenewalRuns) == 0 {
+		return time.Now()
+	}
+	last, err := time.Parse(time.RFC3339, certRenewalRuns[len(certRenewalRuns)-1].StartedAt)
+	if err != nil {
+		return time.Now()
+	}
+	interval := settings.Interval
+	if interval <= 0 {
+		interval = 12
+	}
+	return last.Add(time.Duration(interval) * time.Hour)
+}
+
+// Start a run in the background, unless one is in progress (which is
+// returned instead)
+func startCertRenewalRun(trigger, only string, force bool) (*CertRenewalRun, bool) {
+	certRenewalRunsLock.Lock()
+	if certRenewalActive != nil {
+		run := certRenewalRunSnapshot(certRenewalActive)
+		certRenewalRunsLock.Unlock()
+		return run, false
+	}
+	run := &CertRenewalRun{
+		ID:        time.Now().UTC().Format("20060102T150405.000000"),
+		Trigger:   trigger,
+		Status:    "running",
+		StartedAt: time.Now().Format(time.RFC3339),
+		Results:   []CertRenewalResult{},
+	}
+	certRenewalActive = run
+	certRenewalRuns = append(certRenewalRuns, run)
+	if len(certRenewalRuns) > maxCertRenewalRuns {
+		certRenewalRuns = certRenewalRuns[len(certRenewalRuns)-maxCertRenewalRuns:]
+	}
+	snapshot := certRenewalRunSnapshot(run)
+	certRenewalRunsLock.Unlock()
+
+	saveCertRenewalRuns()
+	go performCertRenewalRun(run, only, force)
+	return snapshot, true
+}
+
+// Renew what's due one certificate at a time, then reload nginx once
+func performCertRenewalRun(run *CertRenewalRun, only string, force bool) {
+	certRenewalLock.RLock()
+	settings := certRenewalSettings
+	certRenewalLock.RUnlock()
+
+	log.Printf("Certificate renewal check started (%s)", run.Trigger)
+
+	record := func(result CertRenewalResult) {
+		certRenewalRunsLock.Lock()
+		run.Results = append(run.Results, result)
+		run.Checked++
+		switch result.Action {
+		case "renewed":
+			run.Renewed++
+		case "failed":
+			run.Failed++
+		}
+		certRenewalRunsLock.Unlock()
+		saveCertRenewalRuns()
+	}
+
+	for _, status := range certRenewalStatuses() {
+		if only != "" && status.Name != only {
+			continue
+		}
+		result := CertRenewalResult{Name: status.Name, DaysLeft: status.DaysLeft}
+		switch {
+		case !status.Managed && status.Due:
+			// Nothing renews it, so it would expire without anyone noticing
+			result.Action = "failed"
+			result.Reason = "not issued by server-manager: " + status.Warning
+			log.Printf("Certificate renewal: %s %s", status.Name, status.Warning)
+		case !status.Managed:
+			result.Action = "skipped"
+			result.Reason = "not issued by server-manager"
+		case status.Disabled:
+			result.Action = "skipped"
+			result.Reason = "renewal disabled"
+		case !status.Due && !force:
+			result.Action = "valid"
+		default:
+			jobID, err := renewManagedCert(status.Name)
+			result.JobID = jobID
+			if err != nil {
+				result.Action = "failed"
+				result.Reason = err.Error()
+				log.Printf("Certificate renewal failed for %s: %v", status.Name, err)
+			} else {
+				result.Action = "renewed"
+				log.Printf("Certificate renewed: %s", status.Name)
+			}
+		}
+		record(result)
+	}
+
+	certRenewalRunsLock.Lock()
+	renewed := run.Renewed
+	certRenewalRunsLock.Unlock()
+
+	var reloadErr error
+	reloaded := false
+	if renewed > 0 && settings.Reload {
+		if output, err := execNginxTest(); err != nil {
+			reloadErr = fmt.Errorf("nginx config test failed, not reloading: %s", strings.TrimSpace(output))
+		} else if output, err := signalNginx("reload"); err != nil {
+			reloadErr = fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+		} else {
+			reloaded = true
+		}
+		if reloadErr != nil {
+			log.Printf("Certificate renewal: %v", reloadErr)
+		}
+	}
+
+	certRenewalRunsLock.Lock()
+	run.FinishedAt = time.Now().Format(time.RFC3339)
+	run.Reloaded = reloaded
+	if reloadErr != nil {
+		run.ReloadError = reloadErr.Error()
+	}
+	run.Status = "succeeded"
+	if run.Failed > 0 || reloadErr != nil {
+		run.Status = "failed"
+	}
+	certRenewalActive = nil
+	log.Printf("Certificate renewal check finished: %d checked, %d renewed, %d failed", run.Checked, run.Renewed, run.Failed)
+	certRenewalRunsLock.Unlock()
+
+	saveCertRenewalRuns()
+}
+
+// Reissue a managed certificate through its issuer and wait for the result
+func renewManagedCert(name string) (string, error) {
+	managedCertsLock.Lock()
+	cert, ok := managedCerts[name]
+	var managed ManagedCert
+	if ok {
+		managed = *cert
+	}
+	managedCertsLock.Unlock()
+	if !ok {
+		return "", fmt.Errorf("not a managed certificate: %s", name)
+	}
+
+	var jobID string
+	var err error
+	switch managed.Issuer {
+	case "acme":
+		req := managed.Request
+		req.Force = true
+		job := startCertJob("renew", req)
+		jobID = job.ID
+		<-job.done
+		if snapshot := certJobSnapshot(job.ID, false); snapshot != nil && snapshot.Status != "succeeded" {
+			err = fmt.Errorf("job %s %s: %s", job.ID, snapshot.Status, snapshot.Error)
+		}
+	case "local-ca":
+		_, _, err = issueLocalCertificate(LocalCertRequest{
+			Name:         managed.Name,
+			Domains:      managed.Request.Domains,
+			ValidityDays: managed.Validity,
+			KeyType:      managed.Request.KeyType,
+		})
+	default:
+		err = fmt.Errorf("unknown issuer: %s", managed.Issuer)
+	}
+
+	managedCertsLock.Lock()
+	if cert, ok := managedCerts[name]; ok {
+		if err == nil {
+			cert.LastRenewed = time.Now().Format(time.RFC3339)
+			cert.LastError = ""
+		} else {
+			cert.LastError = err.Error()
+		}
+	}
+	managedCertsLock.Unlock()
+	if saveErr := saveManagedCerts(); saveErr != nil {
+		log.Printf("Warning: Failed to save managed certificates: %v", saveErr)
+	}
+
+	return jobID, err
+}
+
+// Remember how a certificate was issued so it can be renewed the same way
+func recordManagedCert(certFile, issuer string, req ObtainCertRequest, validity int) {
+	name := strings.TrimSuffix(filepath.Base(certFile), filepath.Ext(certFile))
+	req.Force = false
+	lastError := ""
+	if err := moveCredentialsToProfile(name, &req); err != nil {
+		// Never fall back to keeping them in plain text
+		log.Printf("Warning: Failed to save credentials for %s: %v", name, err)
+		req.Credentials = nil
+		lastError = "credentials not saved, renewals need a credential profile: " + err.Error()
+	}
+
+	managedCertsLock.Lock()
+	cert, ok := managedCerts[name]
+	if !ok {
+		cert = &ManagedCert{Name: name}
+		managedCerts[name] = cert
+	}
+	cert.Issuer = issuer
+	cert.Request = req
+	cert.Validity = validity
+	cert.IssuedAt = time.Now().Format(time.RFC3339)
+	cert.LastError = lastError
+	managedCertsLock.Unlock()
+
+	if err := saveManagedCerts(); err != nil {
+		log.Printf("Warning: Failed to save managed certificates: %v", err)
+	}
+}
+
+// Stop renewing a certificate, e.g. once it's been replaced by an import.
+// Reports whether it was managed.
+func forgetManagedCert(name string) bool {
+	managedCertsLock.Lock()
+	_, ok := managedCerts[name]
+	delete(managedCerts, name)
+	managedCertsLock.Unlock()
+
+	if ok {
+		if err := saveManagedCerts(); err != nil {
+			log.Printf("Warning: Failed to save managed certificates: %v", err)
+		}
+	}
+	return ok
+}
+
+// Credentials posted with a request are kept encrypted in a "cert-<name>"
+// profile, which renewals then use
+func moveCredentialsToProfile(name string, req *ObtainCertRequest) error {
+	if len(req.Credentials) == 0 {
+		return nil
+	}
+	if req.Challenge != "dns-01" {
+		req.Credentials = nil
+		return nil
+	}
+
+	provider, creds, err := resolveDNSCredentials(*req)
+	if err != nil {
+		return err
+	}
+	profile := "cert-" + name
+	if _, err := storeCredentialProfile(profile, strings.ToLower(provider), creds); err != nil {
+		return err
+	}
+	req.CredentialProfile = profile
+	req.Credentials = nil
+	return nil
+}
+
+// Every certificate in ssl/, managed or not, soonest expiry first
+func certRenewalStatuses() []CertRenewalStatus {
+	certRenewalLock.RLock()
+	defaultDays := certRenewalSettings.Days
+	certRenewalLock.RUnlock()
+
+	managedCertsLock.Lock()
+	defer managedCertsLock.Unlock()
+
+	statuses := []CertRenewalStatus{}
+	for _, info := range listCertificates() {
+		name := strings.TrimSuffix(filepath.Base(info.Path), filepath.Ext(info.Path))
+		status := CertRenewalStatus{
+			Name:     name,
+			CertFile: info.Path,
+			Domains:  append(append([]string{}, info.DNSNames...), info.IPAddresses...),
+			NotAfter: info.NotAfter,
+			DaysLeft: info.DaysLeft,
+			Days:     defaultDays,
+		}
+		if cert, ok := managedCerts[name]; ok {
+			status.Managed = true
+			status.Issuer = cert.Issuer
+			status.Challenge = cert.Request.Challenge
+			status.Provider = cert.Request.Provider
+			status.Profile = cert.Request.CredentialProfile
+			status.DaysSet = cert.Days
+			status.Disabled = cert.Disabled
+			status.LastRenewed = cert.LastRenewed
+			status.LastError = cert.LastError
+			if cert.Days > 0 {
+				status.Days = cert.Days
+			} else if cert.Validity > 0 && status.Days >= cert.Validity {
+				// Short-lived local certificates would be due as soon as issued
+				status.Days = (cert.Validity + 2) / 3
+			}
+		}
+		status.Due = status.DaysLeft < status.Days
+		if status.Due && !status.Managed {
+			// e.g. issued by acme.sh before an upgrade whose state wasn't imported
+			status.Warning = fmt.Sprintf("expires in %d days and is not renewed automatically; obtain it again or import it", status.DaysLeft)
+			if status.DaysLeft < 0 {
+				status.Warning = "expired and is not renewed automatically; obtain it again or import it"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DaysLeft < statuses[j].DaysLeft })
+	return statuses
+}
+
+// Copy of a run; callers hold certRenewalRunsLock
+func certRenewalRunSnapshot(run *CertRenewalRun) *CertRenewalRun {
+	snapshot := *run
+	snapshot.Results = append([]CertRenewalResult{}, run.Results...)
+	return &snapshot
+}
+
+// Certificate renewal persistence
+func saveCertRenewalSettings() error {
+	certRenewalLock.RLock()
+	defer certRenewalLock.RUnlock()
+
+	data, err := json.MarshalIndent(certRenewalSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(certRenewalFile, data, 0644)
+}
+
+func loadCertRenewalSettings() error {
+	data, err := os.ReadFile(certRenewalFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	certRenewalLock.Lock()
+	defer certRenewalLock.Unlock()
+
+	return json.Unmarshal(data, &certRenewalSettings)
+}
+
+func saveManagedCerts() error {
+	managedCertsLock.Lock()
+	data, err := json.MarshalIndent(managedCerts, "", "  ")
+	managedCertsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(managedCertsFile, data, 0600)
+}
+
+func loadManagedCerts() error {
+	data, err := os.ReadFile(managedCertsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	managedCertsLock.Lock()
+	if err := json.Unmarshal(data, &managedCerts); err != nil {
+		managedCertsLock.Unlock()
+		return err
+	}
+	// Older records kept the posted credentials in plain text
+	migrated := false
+	for _, cert := range managedCerts {
+		if len(cert.Request.Credentials) == 0 {
+			continue
+		}
+		if err := moveCredentialsToProfile(cert.Name, &cert.Request); err != nil {
+			log.Printf("Warning: Failed to move credentials for %s to a profile: %v", cert.Name, err)
+			cert.Request.Credentials = nil
+			cert.LastError = "credentials dropped, renewals need a credential profile: " + err.Error()
+		}
+		migrated = true
+	}
+	managedCertsLock.Unlock()
+
+	if migrated {
+		return saveManagedCerts()
+	}
+	return nil
+}
+
+func saveCertRenewalRuns() {
+	certRenewalRunsLock.Lock()
+	data, err := json.MarshalIndent(certRenewalRuns, "", "  ")
+	certRenewalRunsLock.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err := os.WriteFile(certRenewalRunsFile, data, 0644); err != nil {
+		log.Printf("Warning: Failed to save certificate renewal runs: %v", err)
+	}
+}
+
+func loadCertRenewalRuns() error {
+	data, err := os.ReadFile(certRenewalRunsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	certRenewalRunsLock.Lock()
+	defer certRenewalRunsLock.Unlock()
+
+	if err := json.Unmarshal(data, &certRenewalRuns); err != nil {
+		return err
+	}
+	// The process that ran it is gone
+	for _, run := range certRenewalRuns {
+		if run.Status == "running" {
+			run.Status = "failed"
+			run.Error = "interrupted by restart"
+		}
+	}
+	return nil
+}
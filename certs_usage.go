@@ -0,0 +1,161 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// CertUsage is an ssl_certificate or ssl_certificate_key directive, with the
+// vhosts it applies to
+type CertUsage struct {
+	Directive string   `json:"directive"` // ssl_certificate or ssl_certificate_key
+	Path      string   `json:"path"`      // Resolved file the directive points at
+	Context   string   `json:"context"`   // http, server, stream or mail
+	Vhosts    []string `json:"vhosts"`
+	File      string   `json:"file"` // Where the directive was found
+	Line      int      `json:"line"`
+}
+
+// Collect every ssl_certificate and ssl_certificate_key in the config.
+// Servers without their own inherit the ones from the enclosing http
+// (or stream/mail) block. Paths with variables can't be resolved and are
+// left out.
+func discoverCertUsages() ([]CertUsage, error) {
+	directives, err := parseNginxConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	type certDirective struct {
+		directive *Directive
+		block     *Directive // Enclosing http, stream or mail block
+		server    *Directive
+	}
+	found := []certDirective{}
+	servers := map[*Directive][]*Directive{}
+	owned := map[*Directive]map[string]bool{}
+
+	walkDirectives(directives, func(d *Directive, parents []*Directive) {
+		var block, server *Directive
+		for _, parent := range parents {
+			switch parent.Name {
+			case "http", "stream", "mail":
+				if block == nil {
+					block = parent
+				}
+			case "server":
+				if block != nil && server == nil {
+					server = parent
+				}
+			}
+		}
+		if block == nil {
+			return
+		}
+
+		if d.Name == "server" && server == nil {
+			servers[block] = append(servers[block], d)
+		}
+		if d.Name != "ssl_certificate" && d.Name != "ssl_certificate_key" || len(d.Args) == 0 {
+			return
+		}
+		found = append(found, certDirective{directive: d, block: block, server: server})
+		if server != nil {
+			if owned[server] == nil {
+				owned[server] = map[string]bool{}
+			}
+			owned[server][d.Name] = true
+		}
+	})
+
+	usages := []CertUsage{}
+	for _, cd := range found {
+		path, ok := certDirectivePath(cd.directive)
+		if !ok {
+			continue
+		}
+		usage := CertUsage{
+			Directive: cd.directive.Name,
+			Path:      path,
+			Context:   cd.block.Name,
+			Vhosts:    []string{},
+			File:      cd.directive.File,
+			Line:      cd.directive.Line,
+		}
+		if cd.server != nil {
+			usage.Context = "server"
+			usage.Vhosts = serverNames(cd.server)
+		} else {
+			for _, server := range servers[cd.block] {
+				if owned[server][cd.directive.Name] {
+					continue
+				}
+				for _, name := range serverNames(server) {
+					if !containsString(usage.Vhosts, name) {
+						usage.Vhosts = append(usage.Vhosts, name)
+					}
+				}
+			}
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// Resolve a directive's file like nginx does, relative to the config prefix.
+// Variables and inline data: certificates have no fixed file.
+func certDirectivePath(d *Directive) (string, bool) {
+	path := d.Args[0]
+	if strings.Contains(path, "$") || strings.HasPrefix(path, "data:") || strings.HasPrefix(path, "engine:") {
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(findMainConfig()), path)
+	}
+	return canonicalCertPath(path), true
+}
+
+// Compare absolute paths through symlinks, e.g. a config pointing at
+// /etc/nginx/ssl while the manager was started with a relative config
+// directory
+func canonicalCertPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// The usages referencing any of the files
+func certUsagesOf(usages []CertUsage, files ...string) []CertUsage {
+	paths := []string{}
+	for _, file := range files {
+		if file != "" {
+			paths = append(paths, canonicalCertPath(file))
+		}
+	}
+
+	matched := []CertUsage{}
+	for _, usage := range usages {
+		if containsString(paths, usage.Path) {
+			matched = append(matched, usage)
+		}
+	}
+	return matched
+}
+
+// Fill in which vhosts use each certificate
+func attachCertUsages(certs []CertificateInfo, usages []CertUsage) {
+	for i := range certs {
+		certs[i].UsedBy = certUsagesOf(usages, certs[i].CertFile, certs[i].KeyFile)
+		for _, usage := range certs[i].UsedBy {
+			for _, name := range usage.Vhosts {
+				if !containsString(certs[i].Vhosts, name) {
+					certs[i].Vhosts = append(certs[i].Vhosts, name)
+				}
+			}
+		}
+	}
+}
@@ -19,7 +19,7 @@ fi
 
 # Start backend in background
 echo "🔧 Starting Go backend on :8080..."
-go run main.go -config ./test-config -port 8080 &
+go run . -config ./test-config -port 8080 &
 BACKEND_PID=$!
 
 # Wait a moment for backend to start
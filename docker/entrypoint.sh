@@ -18,14 +18,6 @@ touch /var/log/nginx/error.log
 chown -R nginx:nginx /var/log/nginx
 chmod -R 755 /var/log/nginx
 
-# Create certificate renewal log
-touch /var/log/cert-renewal.log
-chmod 644 /var/log/cert-renewal.log
-
-# Create certificate obtain log
-touch /var/log/cert-obtain.log
-chmod 644 /var/log/cert-obtain.log
-
 # Ensure cron is ready
 touch /var/log/cron.log
 
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type GeoIPSettings struct {
+	Enabled   bool     `json:"enabled"`
+	Databases []string `json:"databases"` // MMDB files, e.g. GeoLite2-City.mmdb and GeoLite2-ASN.mmdb
+}
+
+// GeoInfo is what the loaded databases know about an IP
+type GeoInfo struct {
+	CountryCode string  `json:"countryCode,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	Continent   string  `json:"continent,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+	ASN         uint64  `json:"asn,omitempty"`
+	ASOrg       string  `json:"asOrg,omitempty"`
+}
+
+var (
+	geoIPSettings = GeoIPSettings{Databases: []string{}}
+	geoIPReaders  = []*mmdbReader{}
+	geoIPLock     sync.RWMutex
+	geoIPFile     = filepath.Join("/app/data", "geoip.json")
+
+	geoIPCache     = map[string]*GeoInfo{}
+	geoIPCacheLock sync.Mutex
+)
+
+const maxGeoIPCache = 50000
+
+// Get or update the GeoIP databases
+func handleGeoIPSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		geoIPLock.RLock()
+		defer geoIPLock.RUnlock()
+		sendJSON(w, map[string]interface{}{
+			"settings":  geoIPSettings,
+			"databases": geoIPMetadata(),
+		})
+	case http.MethodPost:
+		var settings GeoIPSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Databases == nil {
+			settings.Databases = []string{}
+		}
+
+		if err := applyGeoIPSettings(settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveGeoIPSettings(); err != nil {
+			log.Printf("Warning: Failed to save GeoIP settings: %v", err)
+		}
+
+		geoIPLock.RLock()
+		defer geoIPLock.RUnlock()
+		sendJSON(w, map[string]interface{}{
+			"status":    "ok",
+			"settings":  geoIPSettings,
+			"databases": geoIPMetadata(),
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Look up one IP (GET ?ip=) or a batch (POST {"ips": [...]}), e.g. for ban lists
+func handleGeoIPLookup(w http.ResponseWriter, r *http.Request) {
+	var ips []string
+	switch r.Method {
+	case http.MethodGet:
+		ips = []string{r.URL.Query().Get("ip")}
+	case http.MethodPost:
+		var req struct {
+			IPs []string `json:"ips"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ips = req.IPs
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !geoIPEnabled() {
+		sendError(w, "GeoIP is not enabled", http.StatusNotFound)
+		return
+	}
+
+	results := map[string]*GeoInfo{}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			sendError(w, "Invalid IP: "+ip, http.StatusBadRequest)
+			return
+		}
+		results[ip] = lookupGeoIP(ip)
+	}
+
+	if r.Method == http.MethodGet {
+		sendJSON(w, results[ips[0]])
+		return
+	}
+	sendJSON(w, results)
+}
+
+// Open the configured databases and swap them in
+func applyGeoIPSettings(settings GeoIPSettings) error {
+	readers := []*mmdbReader{}
+	if settings.Enabled {
+		for _, path := range settings.Databases {
+			reader, err := openMMDB(path)
+			if err != nil {
+				for _, opened := range readers {
+					opened.Close()
+				}
+				return err
+			}
+			readers = append(readers, reader)
+		}
+	}
+
+	geoIPLock.Lock()
+	previous := geoIPReaders
+	geoIPSettings = settings
+	geoIPReaders = readers
+	geoIPLock.Unlock()
+
+	// Lookups hold the read lock, so nothing uses the old mappings anymore
+	for _, reader := range previous {
+		reader.Close()
+	}
+
+	geoIPCacheLock.Lock()
+	geoIPCache = map[string]*GeoInfo{}
+	geoIPCacheLock.Unlock()
+	return nil
+}
+
+func geoIPMetadata() []MMDBMetadata {
+	metadata := []MMDBMetadata{}
+	for _, reader := range geoIPReaders {
+		metadata = append(metadata, reader.metadata)
+	}
+	return metadata
+}
+
+func geoIPEnabled() bool {
+	geoIPLock.RLock()
+	defer geoIPLock.RUnlock()
+	return len(geoIPReaders) > 0
+}
+
+// Look up an IP in every loaded database, merging what each one knows.
+// Returns nil when GeoIP is disabled or nothing matched.
+func lookupGeoIP(address string) *GeoInfo {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+
+	geoIPCacheLock.Lock()
+	info, cached := geoIPCache[address]
+	geoIPCacheLock.Unlock()
+	if cached {
+		return info
+	}
+
+	geoIPLock.RLock()
+	if len(geoIPReaders) == 0 {
+		geoIPLock.RUnlock()
+		return nil
+	}
+	found := false
+	info = &GeoInfo{}
+	for _, reader := range geoIPReaders {
+		record, err := reader.lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+		found = true
+		mergeGeoRecord(info, record)
+	}
+	geoIPLock.RUnlock()
+
+	if !found {
+		info = nil
+	}
+
+	geoIPCacheLock.Lock()
+	if len(geoIPCache) >= maxGeoIPCache {
+		geoIPCache = map[string]*GeoInfo{}
+	}
+	geoIPCache[address] = info
+	geoIPCacheLock.Unlock()
+
+	return info
+}
+
+// Copy the fields of a GeoIP2/GeoLite2 City, Country or ASN record
+func mergeGeoRecord(info *GeoInfo, record interface{}) {
+	set := func(target *string, value interface{}) {
+		if s := mmdbString(value); s != "" && *target == "" {
+			*target = s
+		}
+	}
+
+	country := mmdbGet(record, "country")
+	if country == nil {
+		country = mmdbGet(record, "registered_country")
+	}
+	set(&info.CountryCode, mmdbGet(country, "iso_code"))
+	set(&info.Country, mmdbGet(country, "names", "en"))
+	set(&info.Continent, mmdbGet(record, "continent", "code"))
+	set(&info.City, mmdbGet(record, "city", "names", "en"))
+	if subdivisions, ok := mmdbGet(record, "subdivisions").([]interface{}); ok && len(subdivisions) > 0 {
+		set(&info.Region, mmdbGet(subdivisions[0], "names", "en"))
+	}
+	if lat, ok := mmdbGet(record, "location", "latitude").(float64); ok && info.Latitude == 0 {
+		info.Latitude = lat
+	}
+	if lon, ok := mmdbGet(record, "location", "longitude").(float64); ok && info.Longitude == 0 {
+		info.Longitude = lon
+	}
+	if asn := mmdbUint(mmdbGet(record, "autonomous_system_number")); asn != 0 && info.ASN == 0 {
+		info.ASN = asn
+	}
+	set(&info.ASOrg, mmdbGet(record, "autonomous_system_organization"))
+}
+
+// GeoIP settings persistence
+func saveGeoIPSettings() error {
+	geoIPLock.RLock()
+	defer geoIPLock.RUnlock()
+
+	data, err := json.MarshalIndent(geoIPSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(geoIPFile, data, 0644)
+}
+
+func loadGeoIPSettings() error {
+	data, err := os.ReadFile(geoIPFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var settings GeoIPSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	if err := applyGeoIPSettings(settings); err != nil {
+		return fmt.Errorf("opening GeoIP databases: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"syscall"
+)
+
+// mmdbReader reads MaxMind DB files (GeoLite2/GeoIP2 and compatible).
+// The file is memory-mapped and searched in place; nothing is fetched
+// over the network.
+type mmdbReader struct {
+	path     string
+	data     []byte
+	metadata MMDBMetadata
+
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	section    mmdbDecoder // Data section
+}
+
+type MMDBMetadata struct {
+	Path         string            `json:"path"`
+	DatabaseType string            `json:"databaseType"`
+	IPVersion    uint              `json:"ipVersion"`
+	NodeCount    uint              `json:"nodeCount"`
+	RecordSize   uint              `json:"recordSize"`
+	BuildEpoch   uint64            `json:"buildEpoch"`
+	Languages    []string          `json:"languages"`
+	Description  map[string]string `json:"description"`
+}
+
+// Data section types
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+const (
+	mmdbMetadataSearch = 128 * 1024
+	mmdbMaxDepth       = 32
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdbReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || info.Size() > math.MaxInt32 {
+		return nil, fmt.Errorf("%s: unexpected file size %d", path, info.Size())
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %v", path, err)
+	}
+
+	reader := &mmdbReader{path: path, data: data}
+	if err := reader.init(); err != nil {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return reader, nil
+}
+
+func (r *mmdbReader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(r.data)
+	r.data = nil
+	return err
+}
+
+// Locate and decode the metadata, then derive the tree layout from it
+func (r *mmdbReader) init() error {
+	searchStart := 0
+	if len(r.data) > mmdbMetadataSearch {
+		searchStart = len(r.data) - mmdbMetadataSearch
+	}
+	idx := bytes.LastIndex(r.data[searchStart:], mmdbMetadataMarker)
+	if idx < 0 {
+		return fmt.Errorf("not a MaxMind DB file (metadata marker not found)")
+	}
+	markerStart := searchStart + idx
+	metaStart := markerStart + len(mmdbMetadataMarker)
+
+	value, _, err := mmdbDecoder{buf: r.data[metaStart:]}.decode(0, 0)
+	if err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("metadata is not a map")
+	}
+
+	r.metadata = MMDBMetadata{
+		Path:         r.path,
+		DatabaseType: mmdbString(meta["database_type"]),
+		IPVersion:    uint(mmdbUint(meta["ip_version"])),
+		NodeCount:    uint(mmdbUint(meta["node_count"])),
+		RecordSize:   uint(mmdbUint(meta["record_size"])),
+		BuildEpoch:   mmdbUint(meta["build_epoch"]),
+		Languages:    []string{},
+		Description:  map[string]string{},
+	}
+	if languages, ok := meta["languages"].([]interface{}); ok {
+		for _, lang := range languages {
+			r.metadata.Languages = append(r.metadata.Languages, mmdbString(lang))
+		}
+	}
+	if description, ok := meta["description"].(map[string]interface{}); ok {
+		for lang, text := range description {
+			r.metadata.Description[lang] = mmdbString(text)
+		}
+	}
+
+	r.nodeCount = r.metadata.NodeCount
+	r.recordSize = r.metadata.RecordSize
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.metadata.IPVersion != 4 && r.metadata.IPVersion != 6 {
+		return fmt.Errorf("unsupported IP version %d", r.metadata.IPVersion)
+	}
+
+	// Search tree, 16 zero bytes, then the data section up to the metadata marker
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(markerStart) {
+		return fmt.Errorf("search tree larger than file")
+	}
+	r.section = mmdbDecoder{buf: r.data[treeSize+16 : markerStart]}
+
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return nil
+}
+
+// Read the left (bit 0) or right (bit 1) record of a node
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	b := r.data[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		if bit == 1 {
+			b = b[3:]
+		}
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 1 {
+			return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+		}
+		return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	default:
+		if bit == 1 {
+			b = b[4:]
+		}
+		return uint(binary.BigEndian.Uint32(b))
+	}
+}
+
+// Look up the record for an IP. Returns nil when the IP isn't in the database.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	if r.data == nil {
+		return nil, fmt.Errorf("database closed")
+	}
+
+	var bits []byte
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.metadata.IPVersion == 4 {
+		return nil, nil
+	} else {
+		bits = ip.To16()
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+
+	if node <= r.nodeCount {
+		// Equal to the node count means "no data"; below it the address ran out of bits
+		return nil, nil
+	}
+
+	offset := node - r.nodeCount - 16
+	value, _, err := r.section.decode(offset, 0)
+	return value, err
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d mmdbDecoder) bytesAt(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, fmt.Errorf("unexpected end of data at offset %d", offset)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// Decode the value at offset, returning it and the offset just after it
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbTypePointer {
+		pointer, next, err := d.decodePointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	if typ == mmdbTypeExtended {
+		b, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytesAt(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	return d.decodeValue(typ, size, offset, depth)
+}
+
+func (d mmdbDecoder) decodePointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	b, err := d.bytesAt(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var pointer uint
+	switch ss {
+	case 0:
+		pointer = vvv<<8 | uint(b[0])
+	case 1:
+		pointer = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		pointer = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		pointer = uint(binary.BigEndian.Uint32(b))
+	}
+	return pointer, offset + ss + 1, nil
+}
+
+func (d mmdbDecoder) decodeValue(typ, size, offset uint, depth int) (interface{}, uint, error) {
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at offset %d is not a string", offset)
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		list := make([]interface{}, 0, min(size, 1024))
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, value)
+			offset = next
+		}
+		return list, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.bytesAt(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := offset + size
+
+	switch typ {
+	case mmdbTypeString:
+		return string(b), next, nil
+	case mmdbTypeBytes:
+		return append([]byte(nil), b...), next, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	case mmdbTypeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("invalid uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b).String(), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d at offset %d", typ, offset)
+	}
+}
+
+// Follow a path of map keys through a decoded record
+func mmdbGet(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func mmdbString(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+func mmdbUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int64:
+		if v > 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AccessRecord struct {
+	Time         string            `json:"time,omitempty"`
+	RemoteAddr   string            `json:"remoteAddr,omitempty"`
+	Host         string            `json:"host,omitempty"`
+	Method       string            `json:"method,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	Protocol     string            `json:"protocol,omitempty"`
+	Status       int               `json:"status,omitempty"`
+	Bytes        int64             `json:"bytes"`
+	Referer      string            `json:"referer,omitempty"`
+	UserAgent    string            `json:"userAgent,omitempty"`
+	RequestTime  float64           `json:"requestTime"`
+	UpstreamTime float64           `json:"upstreamTime"`
+	Fields       map[string]string `json:"fields"` // Every variable of the log_format
+	Geo          *GeoInfo          `json:"geo,omitempty"`
+
+	time time.Time
+}
+
+// logFormat is a compiled nginx log_format
+type logFormat struct {
+	Name     string   `json:"name"`
+	Escape   string   `json:"escape"`
+	Template string   `json:"template"`
+	Vars     []string `json:"vars"`
+
+	regex    *regexp.Regexp
+	jsonKeys map[string]string // JSON key -> variable, for JSON formats
+}
+
+// nginx's built-in format, always available
+const combinedLogFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+var (
+	logVarRegex     = regexp.MustCompile(`\$(\{\w+\}|\w+)`)
+	jsonKeyVarRegex = regexp.MustCompile(`"([^"]+)"\s*:\s*"?\$\{?(\w+)\}?"?`)
+	hexEscapeRegex  = regexp.MustCompile(`\\x([0-9A-Fa-f]{2})`)
+)
+
+// Serve access log lines with structured records attached
+func serveAccessRecords(w http.ResponseWriter, r *http.Request, logPath string) {
+	query, err := parseLogQuery(r, 100)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := accessLogFormat(logPath)
+	page, err := readLogPage(logPath, query)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range page.Lines {
+		if record, ok := format.parse(page.Lines[i].Text); ok {
+			record.Geo = lookupGeoIP(record.RemoteAddr)
+			page.Lines[i].Record = record
+		}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"format": format,
+		"lines":  page.Lines,
+		"older":  page.Older,
+		"newer":  page.Newer,
+		"files":  page.Files,
+	})
+}
+
+// List the log_format definitions from the parsed config
+func handleLogFormats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	formats := []*logFormat{}
+	for _, format := range loadLogFormats() {
+		formats = append(formats, format)
+	}
+
+	sendJSON(w, formats)
+}
+
+// Collect log_format definitions from the config, plus the built-in combined
+func loadLogFormats() map[string]*logFormat {
+	formats := map[string]*logFormat{}
+	if combined, err := compileLogFormat("combined", "default", combinedLogFormat); err == nil {
+		formats["combined"] = combined
+	}
+
+	directives, err := parseNginxConfig()
+	if err != nil {
+		return formats
+	}
+
+	walkDirectives(directives, func(d *Directive, parents []*Directive) {
+		if d.Name != "log_format" || len(d.Args) < 2 {
+			return
+		}
+		name := d.Args[0]
+		args := d.Args[1:]
+		escape := "default"
+		if strings.HasPrefix(args[0], "escape=") {
+			escape = strings.TrimPrefix(args[0], "escape=")
+			args = args[1:]
+		}
+		if format, err := compileLogFormat(name, escape, strings.Join(args, "")); err == nil {
+			formats[name] = format
+		}
+	})
+
+	return formats
+}
+
+// Find the format used by the access_log directive writing to logPath
+func accessLogFormat(logPath string) *logFormat {
+	formats := loadLogFormats()
+	for _, source := range discoverLogSources() {
+		if source.Type == "access" && source.Path == logPath {
+			if format, ok := formats[source.Format]; ok {
+				return format
+			}
+		}
+	}
+	return formats["combined"]
+}
+
+// Compile a log_format template into a line parser
+func compileLogFormat(name, escape, template string) (*logFormat, error) {
+	format := &logFormat{Name: name, Escape: escape, Template: template, Vars: []string{}}
+
+	// JSON formats are decoded as JSON and mapped back by key
+	if strings.HasPrefix(strings.TrimSpace(template), "{") {
+		format.jsonKeys = map[string]string{}
+		for _, m := range jsonKeyVarRegex.FindAllStringSubmatch(template, -1) {
+			format.jsonKeys[m[1]] = m[2]
+			format.Vars = append(format.Vars, m[2])
+		}
+		if len(format.jsonKeys) > 0 {
+			return format, nil
+		}
+		format.jsonKeys = nil
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	locs := logVarRegex.FindAllStringSubmatchIndex(template, -1)
+	for i, loc := range locs {
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		variable := strings.Trim(template[loc[2]:loc[3]], "{}")
+		format.Vars = append(format.Vars, variable)
+		// Variables directly followed by another variable can't be split reliably;
+		// the last one takes the rest of the line
+		if i == len(locs)-1 && loc[1] == len(template) {
+			pattern.WriteString("(.*)")
+		} else {
+			pattern.WriteString("(.*?)")
+		}
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("log_format %s: %v", name, err)
+	}
+	format.regex = re
+	return format, nil
+}
+
+// Parse one log line into a structured record
+func (f *logFormat) parse(line string) (*AccessRecord, bool) {
+	fields := map[string]string{}
+
+	if f.jsonKeys != nil {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			return nil, false
+		}
+		for key, variable := range f.jsonKeys {
+			switch v := obj[key].(type) {
+			case string:
+				fields[variable] = v
+			case float64:
+				fields[variable] = strconv.FormatFloat(v, 'f', -1, 64)
+			case nil:
+			default:
+				fields[variable] = fmt.Sprint(v)
+			}
+		}
+	} else {
+		m := f.regex.FindStringSubmatch(line)
+		if m == nil {
+			return nil, false
+		}
+		for i, variable := range f.Vars {
+			value := m[i+1]
+			if f.Escape == "default" {
+				value = unescapeLogValue(value)
+			}
+			fields[variable] = value
+		}
+	}
+
+	return buildAccessRecord(fields), true
+}
+
+// Decode nginx's \xHH escaping
+func unescapeLogValue(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	return hexEscapeRegex.ReplaceAllStringFunc(value, func(s string) string {
+		b, err := strconv.ParseUint(s[2:], 16, 8)
+		if err != nil {
+			return s
+		}
+		return string([]byte{byte(b)})
+	})
+}
+
+// Map nginx variables onto the common record fields
+func buildAccessRecord(fields map[string]string) *AccessRecord {
+	record := &AccessRecord{Fields: fields}
+	get := func(names ...string) string {
+		for _, name := range names {
+			if v, ok := fields[name]; ok && v != "" && v != "-" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	if v := get("time_iso8601"); v != "" {
+		record.time, _ = time.Parse(time.RFC3339, v)
+	} else if v := get("time_local"); v != "" {
+		record.time, _ = time.Parse("02/Jan/2006:15:04:05 -0700", v)
+	} else if v := get("msec"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			record.time = time.UnixMilli(int64(secs * 1000))
+		}
+	}
+	if !record.time.IsZero() {
+		record.Time = record.time.Format(time.RFC3339)
+	}
+
+	record.RemoteAddr = get("remote_addr", "realip_remote_addr")
+	record.Host = get("host", "http_host", "server_name")
+
+	if request := get("request"); request != "" {
+		parts := strings.SplitN(request, " ", 3)
+		record.Method = parts[0]
+		if len(parts) > 1 {
+			record.Path = parts[1]
+		}
+		if len(parts) > 2 {
+			record.Protocol = parts[2]
+		}
+	}
+	if v := get("request_method"); v != "" {
+		record.Method = v
+	}
+	if v := get("request_uri", "uri"); v != "" {
+		record.Path = v
+	}
+	if v := get("server_protocol"); v != "" {
+		record.Protocol = v
+	}
+
+	record.Status, _ = strconv.Atoi(get("status"))
+	record.Bytes, _ = strconv.ParseInt(get("body_bytes_sent", "bytes_sent"), 10, 64)
+	record.Referer = get("http_referer")
+	record.UserAgent = get("http_user_agent")
+	record.RequestTime, _ = strconv.ParseFloat(get("request_time"), 64)
+	record.UpstreamTime = sumUpstreamTimes(get("upstream_response_time"))
+
+	return record
+}
+
+// upstream_response_time lists one value per upstream tried: "0.010, 0.020 : 0.005"
+func sumUpstreamTimes(value string) float64 {
+	total := 0.0
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+		if v, err := strconv.ParseFloat(part, 64); err == nil {
+			total += v
+		}
+	}
+	return total
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficBucket aggregates one minute of traffic for one vhost
+type trafficBucket struct {
+	requests   int64
+	bytes      int64
+	status     map[int]int64
+	paths      map[string]int64
+	ips        map[string]int64
+	userAgents map[string]int64
+	referers   map[string]int64
+	countries  map[string]int64 // ISO country code, when GeoIP is enabled
+	latency    []int64          // Histogram over latencyBounds
+}
+
+// trafficAggregator incrementally folds an access log into per-minute buckets
+type trafficAggregator struct {
+	logPath     string
+	buckets     map[string]map[int64]*trafficBucket // host -> unix minute -> bucket
+	inode       uint64
+	offset      int64
+	lastRefresh time.Time
+	lock        sync.Mutex
+}
+
+type TopEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+type TrafficPoint struct {
+	Time     string `json:"time"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type TrafficSummary struct {
+	Requests      int64              `json:"requests"`
+	Bytes         int64              `json:"bytes"`
+	Status        map[string]int64   `json:"status"`
+	StatusClass   map[string]int64   `json:"statusClass"`
+	Series        []TrafficPoint     `json:"series"`
+	TopPaths      []TopEntry         `json:"topPaths"`
+	TopIPs        []TopEntry         `json:"topIps"`
+	TopUserAgents []TopEntry         `json:"topUserAgents"`
+	TopReferers   []TopEntry         `json:"topReferers"`
+	TopCountries  []TopEntry         `json:"topCountries"`
+	Latency       map[string]float64 `json:"latency"` // p50/p95/p99 request_time in seconds
+}
+
+type TrafficAnalytics struct {
+	From   string                     `json:"from"`
+	To     string                     `json:"to"`
+	Bucket string                     `json:"bucket"`
+	Total  TrafficSummary             `json:"total"`
+	Hosts  map[string]*TrafficSummary `json:"hosts"`
+}
+
+var (
+	trafficAggregators     = map[string]*trafficAggregator{}
+	trafficAggregatorsLock sync.Mutex
+
+	// Latency histogram bucket upper bounds in seconds, roughly 20% apart
+	latencyBounds = func() []float64 {
+		bounds := []float64{}
+		for v := 0.001; v < 120; v *= 1.2 {
+			bounds = append(bounds, v)
+		}
+		return append(bounds, math.Inf(1))
+	}()
+)
+
+const (
+	trafficRetention   = 24 * time.Hour
+	trafficRefreshRate = 5 * time.Second
+	maxKeysPerBucket   = 200 // Bounds memory for high-cardinality keys
+	otherKey           = "(other)"
+)
+
+// Get traffic analytics for the access log
+func handleLogAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	window := time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			sendError(w, "Invalid window: "+v, http.StatusBadRequest)
+			return
+		}
+		window = min(d, trafficRetention)
+	}
+
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = "minute"
+		if window > 6*time.Hour {
+			bucket = "hour"
+		}
+	}
+	if bucket != "minute" && bucket != "hour" {
+		sendError(w, "bucket must be minute or hour", http.StatusBadRequest)
+		return
+	}
+
+	top := 10
+	if v := q.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			sendError(w, "Invalid top: "+v, http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	logPath, err := selectLogPath(r, "access_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	agg := getTrafficAggregator(logPath)
+	if err := agg.refresh(); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	to := time.Now()
+	sendJSON(w, agg.summarize(to.Add(-window), to, bucket, top, q.Get("host")))
+}
+
+func getTrafficAggregator(logPath string) *trafficAggregator {
+	trafficAggregatorsLock.Lock()
+	defer trafficAggregatorsLock.Unlock()
+
+	agg, exists := trafficAggregators[logPath]
+	if !exists {
+		agg = &trafficAggregator{logPath: logPath, buckets: map[string]map[int64]*trafficBucket{}}
+		trafficAggregators[logPath] = agg
+	}
+	return agg
+}
+
+// Fold in lines appended since the last refresh. The first refresh
+// backfills the retention window from the rotated files.
+func (a *trafficAggregator) refresh() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if time.Since(a.lastRefresh) < trafficRefreshRate {
+		return nil
+	}
+
+	format := accessLogFormat(a.logPath)
+	if format == nil {
+		return fmt.Errorf("no log format available for %s", a.logPath)
+	}
+
+	segments := rotatedLogSegments(a.logPath)
+	if len(segments) == 0 {
+		return fmt.Errorf("open %s: no such file or directory", a.logPath)
+	}
+	live := segments[0]
+	if live.path != a.logPath {
+		// Live file rotated away and not recreated yet
+		return nil
+	}
+
+	since := time.Now().Add(-trafficRetention)
+	switch {
+	case a.lastRefresh.IsZero():
+		// Fix the end before scanning; lines appended meanwhile are read next time
+		end, err := completeLinesEnd(live.path)
+		if err != nil {
+			return err
+		}
+		err = walkLogBackward(segments, 0, end, since, func(line LogLine, t time.Time) bool {
+			if !t.IsZero() && t.Before(since) {
+				return false
+			}
+			if rec, ok := format.parse(line.Text); ok {
+				a.add(rec)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		a.offset = end
+	case live.inode != a.inode:
+		// Rotated: finish the previous file wherever it went, then read the new one
+		for i, seg := range segments {
+			if seg.inode == a.inode && !seg.gz {
+				a.readForward(segments[i], a.offset, format)
+				break
+			}
+		}
+		a.offset = a.readForward(live, 0, format)
+	default:
+		if info, err := os.Stat(live.path); err == nil && info.Size() < a.offset {
+			// Truncated in place
+			a.offset = 0
+		}
+		a.offset = a.readForward(live, a.offset, format)
+	}
+
+	a.inode = live.inode
+	a.lastRefresh = time.Now()
+	a.prune(since)
+	return nil
+}
+
+// Fold in complete lines from offset on and return the offset after the
+// last one, so a line nginx is still writing is picked up whole next time
+func (a *trafficAggregator) readForward(seg logSegment, offset int64, format *logFormat) int64 {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return offset
+		}
+		offset += int64(len(line))
+		if rec, ok := format.parse(strings.TrimRight(line, "\r\n")); ok {
+			a.add(rec)
+		}
+	}
+}
+
+// Offset just past the last newline in a file
+func completeLinesEnd(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	for end > 0 {
+		size := int64(reverseChunkSize)
+		if end < size {
+			size = end
+		}
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, end-size); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if idx := bytes.LastIndexByte(chunk, '\n'); idx >= 0 {
+			return end - size + int64(idx) + 1, nil
+		}
+		end -= size
+	}
+	return 0, nil
+}
+
+func (a *trafficAggregator) add(rec *AccessRecord) {
+	if rec.time.IsZero() {
+		return
+	}
+
+	host := rec.Host
+	if host == "" {
+		host = "-"
+	}
+	minute := rec.time.Unix() / 60
+
+	hostBuckets, exists := a.buckets[host]
+	if !exists {
+		hostBuckets = map[int64]*trafficBucket{}
+		a.buckets[host] = hostBuckets
+	}
+	b, exists := hostBuckets[minute]
+	if !exists {
+		b = &trafficBucket{
+			status:     map[int]int64{},
+			paths:      map[string]int64{},
+			ips:        map[string]int64{},
+			userAgents: map[string]int64{},
+			referers:   map[string]int64{},
+			countries:  map[string]int64{},
+			latency:    make([]int64, len(latencyBounds)),
+		}
+		hostBuckets[minute] = b
+	}
+
+	b.requests++
+	b.bytes += rec.Bytes
+	b.status[rec.Status]++
+	countKey(b.paths, rec.Path)
+	countKey(b.ips, rec.RemoteAddr)
+	countKey(b.userAgents, rec.UserAgent)
+	countKey(b.referers, rec.Referer)
+	if geo := lookupGeoIP(rec.RemoteAddr); geo != nil {
+		countKey(b.countries, geo.CountryCode)
+	}
+	if _, timed := rec.Fields["request_time"]; timed {
+		b.latency[sort.SearchFloat64s(latencyBounds, rec.RequestTime)]++
+	}
+}
+
+func countKey(m map[string]int64, key string) {
+	if key == "" {
+		return
+	}
+	if _, exists := m[key]; !exists && len(m) >= maxKeysPerBucket {
+		key = otherKey
+	}
+	m[key]++
+}
+
+func (a *trafficAggregator) prune(before time.Time) {
+	cutoff := before.Unix() / 60
+	for host, hostBuckets := range a.buckets {
+		for minute := range hostBuckets {
+			if minute < cutoff {
+				delete(hostBuckets, minute)
+			}
+		}
+		if len(hostBuckets) == 0 {
+			delete(a.buckets, host)
+		}
+	}
+}
+
+// Build summaries for every vhost and for all traffic in [from, to]
+func (a *trafficAggregator) summarize(from, to time.Time, bucket string, top int, onlyHost string) *TrafficAnalytics {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	result := &TrafficAnalytics{
+		From:   from.Format(time.RFC3339),
+		To:     to.Format(time.RFC3339),
+		Bucket: bucket,
+		Hosts:  map[string]*TrafficSummary{},
+	}
+
+	step := int64(1)
+	if bucket == "hour" {
+		step = 60
+	}
+	start, end := from.Unix()/60, to.Unix()/60
+
+	total := newSummaryBuilder()
+	for host, hostBuckets := range a.buckets {
+		if onlyHost != "" && host != onlyHost {
+			continue
+		}
+		builder := newSummaryBuilder()
+		for minute, b := range hostBuckets {
+			if minute < start || minute > end {
+				continue
+			}
+			slot := minute - minute%step
+			builder.add(slot, b)
+			total.add(slot, b)
+		}
+		if builder.summary.Requests > 0 {
+			result.Hosts[host] = builder.build(start-start%step, end, step, top)
+		}
+	}
+	result.Total = *total.build(start-start%step, end, step, top)
+
+	return result
+}
+
+type summaryBuilder struct {
+	summary    TrafficSummary
+	series     map[int64]*TrafficPoint
+	paths      map[string]int64
+	ips        map[string]int64
+	userAgents map[string]int64
+	referers   map[string]int64
+	countries  map[string]int64
+	latency    []int64
+}
+
+func newSummaryBuilder() *summaryBuilder {
+	return &summaryBuilder{
+		summary: TrafficSummary{
+			Status:      map[string]int64{},
+			StatusClass: map[string]int64{},
+		},
+		series:     map[int64]*TrafficPoint{},
+		paths:      map[string]int64{},
+		ips:        map[string]int64{},
+		userAgents: map[string]int64{},
+		referers:   map[string]int64{},
+		countries:  map[string]int64{},
+		latency:    make([]int64, len(latencyBounds)),
+	}
+}
+
+func (s *summaryBuilder) add(slot int64, b *trafficBucket) {
+	s.summary.Requests += b.requests
+	s.summary.Bytes += b.bytes
+	for status, n := range b.status {
+		s.summary.Status[strconv.Itoa(status)] += n
+		s.summary.StatusClass[fmt.Sprintf("%dxx", status/100)] += n
+	}
+
+	point, exists := s.series[slot]
+	if !exists {
+		point = &TrafficPoint{Time: time.Unix(slot*60, 0).UTC().Format(time.RFC3339)}
+		s.series[slot] = point
+	}
+	point.Requests += b.requests
+	point.Bytes += b.bytes
+
+	mergeCounts(s.paths, b.paths)
+	mergeCounts(s.ips, b.ips)
+	mergeCounts(s.userAgents, b.userAgents)
+	mergeCounts(s.referers, b.referers)
+	mergeCounts(s.countries, b.countries)
+	for i, n := range b.latency {
+		s.latency[i] += n
+	}
+}
+
+func (s *summaryBuilder) build(start, end, step int64, top int) *TrafficSummary {
+	summary := s.summary
+
+	// Dense series so charts don't have to fill gaps
+	summary.Series = []TrafficPoint{}
+	for slot := start; slot <= end; slot += step {
+		if point, exists := s.series[slot]; exists {
+			summary.Series = append(summary.Series, *point)
+		} else {
+			summary.Series = append(summary.Series, TrafficPoint{Time: time.Unix(slot*60, 0).UTC().Format(time.RFC3339)})
+		}
+	}
+
+	summary.TopPaths = topEntries(s.paths, top)
+	summary.TopIPs = topEntries(s.ips, top)
+	summary.TopUserAgents = topEntries(s.userAgents, top)
+	summary.TopReferers = topEntries(s.referers, top)
+	summary.TopCountries = topEntries(s.countries, top)
+	summary.Latency = map[string]float64{
+		"p50": histogramPercentile(s.latency, 0.50),
+		"p95": histogramPercentile(s.latency, 0.95),
+		"p99": histogramPercentile(s.latency, 0.99),
+	}
+	return &summary
+}
+
+func mergeCounts(dst, src map[string]int64) {
+	for key, n := range src {
+		dst[key] += n
+	}
+}
+
+func topEntries(counts map[string]int64, n int) []TopEntry {
+	entries := make([]TopEntry, 0, len(counts))
+	for key, count := range counts {
+		entries = append(entries, TopEntry{Key: key, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Upper bound of the histogram bucket holding the given percentile
+func histogramPercentile(hist []int64, p float64) float64 {
+	var total int64
+	for _, n := range hist {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := int64(math.Ceil(float64(total) * p))
+	var seen int64
+	for i, n := range hist {
+		seen += n
+		if seen >= target {
+			if math.IsInf(latencyBounds[i], 1) {
+				return latencyBounds[i-1]
+			}
+			return math.Round(latencyBounds[i]*1000) / 1000
+		}
+	}
+	return 0
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AnomalySettings struct {
+	Enabled       bool    `json:"enabled"`
+	Interval      int     `json:"interval"`      // Seconds between checks
+	Window        int     `json:"window"`        // Minutes evaluated against the baseline
+	Baseline      int     `json:"baseline"`      // Minutes of history before the window
+	Threshold     float64 `json:"threshold"`     // Standard deviations from the baseline
+	LatencyFactor float64 `json:"latencyFactor"` // p95 multiple of the baseline p95
+	MinRequests   int64   `json:"minRequests"`   // Requests needed in the baseline (and the window, for ratios) to judge a vhost
+	Cooldown      int     `json:"cooldown"`      // Minutes before the same anomaly is reported again
+}
+
+type AnomalyEvent struct {
+	ID           int64   `json:"id"`
+	Time         string  `json:"time"`
+	Log          string  `json:"log"`
+	Vhost        string  `json:"vhost"`
+	Metric       string  `json:"metric"` // rate, rateDrop, 4xx, 5xx or p95
+	Value        float64 `json:"value"`
+	Baseline     float64 `json:"baseline"`
+	Deviation    float64 `json:"deviation"` // Standard deviations, or the factor for p95
+	Severity     string  `json:"severity"`  // warning or critical
+	Message      string  `json:"message"`
+	RecentReload string  `json:"recentReload,omitempty"` // nginx reloaded shortly before
+}
+
+// windowStats sums a vhost's buckets over a time range
+type windowStats struct {
+	minutes  []int64 // Requests per minute
+	requests int64
+	status4x int64
+	status5x int64
+	latency  []int64
+}
+
+var (
+	anomalySettings = AnomalySettings{
+		Enabled:       false, // Keeps 24h of every access log in memory
+		Interval:      60,
+		Window:        5,
+		Baseline:      60,
+		Threshold:     4,
+		LatencyFactor: 2,
+		MinRequests:   20,
+		Cooldown:      15,
+	}
+	anomalySettingsLock sync.RWMutex
+	anomalySettingsFile = filepath.Join("/app/data", "anomaly.json")
+
+	anomalyEvents      = []AnomalyEvent{}
+	anomalyLastEventID int64
+	anomalyLastSeen    = map[string]time.Time{} // log|vhost|metric -> last event
+	anomalySubscribers = map[chan AnomalyEvent]bool{}
+	anomalyEventsLock  sync.Mutex
+	anomalyEventsFile  = filepath.Join("/app/data", "anomaly-events.json")
+)
+
+const maxAnomalyEvents = 1000
+
+// List recent anomaly events, newest first
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			sendError(w, "since must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			sendError(w, "Invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	anomalyEventsLock.Lock()
+	defer anomalyEventsLock.Unlock()
+
+	events := []AnomalyEvent{}
+	for i := len(anomalyEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		event := anomalyEvents[i]
+		if vhost := q.Get("vhost"); vhost != "" && event.Vhost != vhost {
+			continue
+		}
+		if metric := q.Get("metric"); metric != "" && event.Metric != metric {
+			continue
+		}
+		if !since.IsZero() {
+			if t, err := time.Parse(time.RFC3339, event.Time); err == nil && t.Before(since) {
+				break
+			}
+		}
+		events = append(events, event)
+	}
+
+	sendJSON(w, events)
+}
+
+// Stream new anomaly events over Server-Sent Events
+func handleAnomalyStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := subscribeAnomalies()
+	defer unsubscribeAnomalies(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			data, _ := json.Marshal(event)
+			writeSSE(w, "anomaly", string(data))
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// Get or update anomaly detection settings
+func handleAnomalySettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		anomalySettingsLock.RLock()
+		defer anomalySettingsLock.RUnlock()
+		sendJSON(w, anomalySettings)
+	case http.MethodPost:
+		var settings AnomalySettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Interval <= 0 {
+			settings.Interval = 60
+		}
+		if settings.Window <= 0 || settings.Baseline <= 0 {
+			sendError(w, "window and baseline must be positive", http.StatusBadRequest)
+			return
+		}
+		if time.Duration(settings.Window+settings.Baseline)*time.Minute > trafficRetention {
+			sendError(w, fmt.Sprintf("window + baseline cannot exceed %d minutes", int(trafficRetention.Minutes())), http.StatusBadRequest)
+			return
+		}
+		if settings.Threshold <= 0 || settings.LatencyFactor <= 1 {
+			sendError(w, "threshold must be positive and latencyFactor above 1", http.StatusBadRequest)
+			return
+		}
+
+		anomalySettingsLock.Lock()
+		anomalySettings = settings
+		anomalySettingsLock.Unlock()
+
+		if err := saveAnomalySettings(); err != nil {
+			log.Printf("Warning: Failed to save anomaly settings: %v", err)
+		}
+
+		sendJSON(w, map[string]interface{}{"status": "ok", "settings": settings})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func runAnomalyDetector() {
+	for {
+		anomalySettingsLock.RLock()
+		settings := anomalySettings
+		anomalySettingsLock.RUnlock()
+
+		if settings.Enabled {
+			for _, source := range discoverLogSources() {
+				if source.Type != "access" || !source.Exists {
+					continue
+				}
+				agg := getTrafficAggregator(source.Path)
+				if err := agg.refresh(); err != nil {
+					continue
+				}
+				for _, event := range detectAnomalies(agg, settings, time.Now()) {
+					recordAnomaly(event, settings)
+				}
+			}
+		}
+
+		interval := settings.Interval
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// Compare the last window of complete minutes with the baseline before it
+func detectAnomalies(agg *trafficAggregator, settings AnomalySettings, now time.Time) []AnomalyEvent {
+	end := now.Truncate(time.Minute)
+	windowStart := end.Add(-time.Duration(settings.Window) * time.Minute)
+	baselineStart := windowStart.Add(-time.Duration(settings.Baseline) * time.Minute)
+
+	current := agg.hostStats(windowStart, end)
+	baseline := agg.hostStats(baselineStart, windowStart)
+
+	events := []AnomalyEvent{}
+	add := func(host, metric string, value, base, deviation float64, message string) {
+		severity := "warning"
+		if (metric == "p95" && deviation >= settings.LatencyFactor*2) || (metric != "p95" && deviation >= settings.Threshold*2) {
+			severity = "critical"
+		}
+		events = append(events, AnomalyEvent{
+			Log:       agg.logPath,
+			Vhost:     host,
+			Metric:    metric,
+			Value:     math.Round(value*1000) / 1000,
+			Baseline:  math.Round(base*1000) / 1000,
+			Deviation: math.Round(deviation*100) / 100,
+			Severity:  severity,
+			Message:   message,
+		})
+	}
+
+	for host, base := range baseline {
+		cur := current[host]
+		if cur == nil {
+			cur = &windowStats{latency: make([]int64, len(latencyBounds))}
+		}
+		if base.requests < settings.MinRequests {
+			continue
+		}
+
+		// Request rate, per minute, both directions
+		mean, std := meanStd(base.minutes)
+		rate := float64(cur.requests) / float64(settings.Window)
+		sigma := math.Max(math.Max(std, math.Sqrt(mean))/math.Sqrt(float64(settings.Window)), 0.1)
+		z := (rate - mean) / sigma
+		if z >= settings.Threshold && cur.requests >= settings.MinRequests {
+			add(host, "rate", rate, mean, z, fmt.Sprintf("%s: %.1f req/min vs baseline %.1f", host, rate, mean))
+		} else if -z >= settings.Threshold && mean*float64(settings.Window) >= float64(settings.MinRequests) {
+			add(host, "rateDrop", rate, mean, -z, fmt.Sprintf("%s: traffic dropped to %.1f req/min from %.1f", host, rate, mean))
+		}
+
+		if cur.requests < settings.MinRequests {
+			continue
+		}
+
+		// Error ratios, only increases, and by at least 5 percentage points so
+		// near-zero baselines don't alert on a handful of errors
+		for _, metric := range []struct {
+			name      string
+			cur, base int64
+		}{{"4xx", cur.status4x, base.status4x}, {"5xx", cur.status5x, base.status5x}} {
+			p0 := float64(metric.base) / float64(base.requests)
+			p := float64(metric.cur) / float64(cur.requests)
+			sigma := math.Sqrt(math.Max(p0*(1-p0), 0.01) / float64(cur.requests))
+			z := (p - p0) / sigma
+			if z >= settings.Threshold && p-p0 >= 0.05 {
+				add(host, metric.name, p, p0, z, fmt.Sprintf("%s: %s ratio %.1f%% vs baseline %.1f%%", host, metric.name, p*100, p0*100))
+			}
+		}
+
+		// Latency, only when the log has request_time
+		baseP95 := histogramPercentile(base.latency, 0.95)
+		curP95 := histogramPercentile(cur.latency, 0.95)
+		if baseP95 > 0 && curP95 >= baseP95*settings.LatencyFactor && curP95-baseP95 >= 0.05 {
+			add(host, "p95", curP95, baseP95, curP95/baseP95, fmt.Sprintf("%s: p95 latency %.3fs vs baseline %.3fs", host, curP95, baseP95))
+		}
+	}
+
+	// A reload just before the window is the usual suspect
+	lastNginxReloadLock.Lock()
+	lastReload := lastNginxReload
+	lastNginxReloadLock.Unlock()
+	if !lastReload.IsZero() && lastReload.After(windowStart.Add(-time.Duration(settings.Window)*time.Minute)) {
+		for i := range events {
+			events[i].RecentReload = lastReload.Format(time.RFC3339)
+			events[i].Message += fmt.Sprintf(" (nginx reloaded at %s)", lastReload.Format("15:04:05"))
+		}
+	}
+
+	return events
+}
+
+// Per-vhost totals for [from, to), with one entry per minute for rates
+func (a *trafficAggregator) hostStats(from, to time.Time) map[string]*windowStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	start, end := from.Unix()/60, to.Unix()/60
+	stats := map[string]*windowStats{}
+	for host, hostBuckets := range a.buckets {
+		s := &windowStats{minutes: make([]int64, end-start), latency: make([]int64, len(latencyBounds))}
+		for minute, b := range hostBuckets {
+			if minute < start || minute >= end {
+				continue
+			}
+			s.minutes[minute-start] += b.requests
+			s.requests += b.requests
+			for status, n := range b.status {
+				switch status / 100 {
+				case 4:
+					s.status4x += n
+				case 5:
+					s.status5x += n
+				}
+			}
+			for i, n := range b.latency {
+				s.latency[i] += n
+			}
+		}
+		if s.requests > 0 {
+			stats[host] = s
+		}
+	}
+	return stats
+}
+
+func meanStd(values []int64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	mean := sum / float64(len(values))
+	var sq float64
+	for _, v := range values {
+		sq += (float64(v) - mean) * (float64(v) - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(values)))
+}
+
+// Store an event unless the same anomaly was reported within the cooldown,
+// and hand it to stream subscribers
+func recordAnomaly(event AnomalyEvent, settings AnomalySettings) {
+	anomalyEventsLock.Lock()
+	defer anomalyEventsLock.Unlock()
+
+	key := event.Log + "|" + event.Vhost + "|" + event.Metric
+	now := time.Now()
+	if last, seen := anomalyLastSeen[key]; seen && now.Sub(last) < time.Duration(settings.Cooldown)*time.Minute {
+		return
+	}
+	anomalyLastSeen[key] = now
+
+	anomalyLastEventID++
+	event.ID = anomalyLastEventID
+	event.Time = now.Format(time.RFC3339)
+	anomalyEvents = append(anomalyEvents, event)
+	if len(anomalyEvents) > maxAnomalyEvents {
+		anomalyEvents = anomalyEvents[len(anomalyEvents)-maxAnomalyEvents:]
+	}
+
+	log.Printf("Anomaly [%s] %s", event.Severity, event.Message)
+	for ch := range anomalySubscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+
+	if data, err := json.MarshalIndent(anomalyEvents, "", "  "); err == nil {
+		if err := os.WriteFile(anomalyEventsFile, data, 0644); err != nil {
+			log.Printf("Warning: Failed to save anomaly events: %v", err)
+		}
+	}
+}
+
+func subscribeAnomalies() chan AnomalyEvent {
+	anomalyEventsLock.Lock()
+	defer anomalyEventsLock.Unlock()
+
+	ch := make(chan AnomalyEvent, 16)
+	anomalySubscribers[ch] = true
+	return ch
+}
+
+func unsubscribeAnomalies(ch chan AnomalyEvent) {
+	anomalyEventsLock.Lock()
+	defer anomalyEventsLock.Unlock()
+
+	delete(anomalySubscribers, ch)
+}
+
+// Anomaly settings and event persistence
+func saveAnomalySettings() error {
+	anomalySettingsLock.RLock()
+	defer anomalySettingsLock.RUnlock()
+
+	data, err := json.MarshalIndent(anomalySettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(anomalySettingsFile, data, 0644)
+}
+
+func loadAnomalySettings() error {
+	if data, err := os.ReadFile(anomalyEventsFile); err == nil {
+		anomalyEventsLock.Lock()
+		if json.Unmarshal(data, &anomalyEvents) == nil && len(anomalyEvents) > 0 {
+			sort.SliceStable(anomalyEvents, func(i, j int) bool { return anomalyEvents[i].ID < anomalyEvents[j].ID })
+			anomalyLastEventID = anomalyEvents[len(anomalyEvents)-1].ID
+		}
+		anomalyEventsLock.Unlock()
+	}
+
+	data, err := os.ReadFile(anomalySettingsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	anomalySettingsLock.Lock()
+	defer anomalySettingsLock.Unlock()
+
+	return json.Unmarshal(data, &anomalySettings)
+}
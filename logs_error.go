@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ErrorRecord struct {
+	Time       string            `json:"time,omitempty"`
+	Level      string            `json:"level"`
+	PID        int               `json:"pid"`
+	TID        int               `json:"tid"`
+	Connection int64             `json:"connection,omitempty"`
+	Message    string            `json:"message"`
+	Client     string            `json:"client,omitempty"`
+	Server     string            `json:"server,omitempty"`
+	Request    string            `json:"request,omitempty"`
+	Upstream   string            `json:"upstream,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Context    map[string]string `json:"context,omitempty"` // Any other "key: value" pairs (referrer, subrequest, ...)
+	Geo        *GeoInfo          `json:"geo,omitempty"`     // Of the client
+
+	time time.Time
+}
+
+// errorFilter selects parsed error log records
+type errorFilter struct {
+	minLevel int
+	text     string
+	client   string
+	server   string
+	upstream string
+}
+
+type ErrorQueryResult struct {
+	Records []LogLine `json:"records"`
+	Older   string    `json:"older,omitempty"`
+	Total   int       `json:"total,omitempty"`
+	Scanned int       `json:"scanned"`
+}
+
+// ErrorGroup is a message seen repeatedly in the error log
+type ErrorGroup struct {
+	Level     string       `json:"level"`
+	Message   string       `json:"message"`
+	Count     int          `json:"count"`
+	FirstSeen string       `json:"firstSeen,omitempty"`
+	LastSeen  string       `json:"lastSeen,omitempty"`
+	Servers   []string     `json:"servers"`
+	Upstreams []string     `json:"upstreams"`
+	Clients   int          `json:"clients"` // Distinct clients
+	Latest    *ErrorRecord `json:"latest"`
+
+	first   time.Time
+	last    time.Time
+	clients map[string]bool
+}
+
+// Severity order used by error_log
+var errorLevels = []string{"debug", "info", "notice", "warn", "error", "crit", "alert", "emerg"}
+
+const maxGroupValues = 20
+
+var (
+	// 2024/01/02 15:04:05 [error] 1234#5678: *99 message, client: ..., server: ...
+	errorLineRegex = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (\d+)#(\d+): (?:\*(\d+) )?(.*)$`)
+	// Context nginx appends to the message: ", client: 1.2.3.4, request: "GET / HTTP/1.1""
+	errorContextRegex = regexp.MustCompile(`, (client|server|request|subrequest|upstream|host|referrer): ("(?:[^"\\]|\\.)*"|[^,]*)`)
+)
+
+// Serve error log lines with parsed records attached
+func serveErrorRecords(w http.ResponseWriter, r *http.Request, logPath string) {
+	query, err := parseLogQuery(r, 100)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := readLogPage(logPath, query)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range page.Lines {
+		if record, ok := parseErrorLine(page.Lines[i].Text); ok {
+			record.Geo = lookupGeoIP(record.Client)
+			page.Lines[i].Error = record
+		}
+	}
+
+	sendJSON(w, page)
+}
+
+// Query parsed error log records, newest first
+func handleErrorLogQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("export") != "" {
+		exportLog(w, r, "error")
+		return
+	}
+
+	query, err := parseLogQuery(r, 100)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.after != "" {
+		sendError(w, "Log queries page backwards; use before", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseErrorFilter(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logPath, err := selectLogPath(r, "error_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	count := r.URL.Query().Get("count") == "true"
+	result := &ErrorQueryResult{Records: []LogLine{}}
+	err = scanErrorRecords(logPath, query, func(line LogLine, rec *ErrorRecord) bool {
+		result.Scanned++
+		if !filter.matches(rec) {
+			return true
+		}
+
+		result.Total++
+		if len(result.Records) < query.limit {
+			rec.Geo = lookupGeoIP(rec.Client)
+			line.Error = rec
+			result.Records = append(result.Records, line)
+			return true
+		}
+
+		// Page is full: keep going only to count the remaining matches
+		if result.Older == "" {
+			result.Older = result.Records[len(result.Records)-1].Cursor
+		}
+		return count
+	})
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !count {
+		result.Total = 0
+	}
+	sendJSON(w, result)
+}
+
+// Group identical error messages over a time window
+func handleErrorLogGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	query, err := parseLogQuery(r, 50)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	window := 24 * time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			sendError(w, "Invalid window: "+v, http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if query.from.IsZero() {
+		query.from = time.Now().Add(-window)
+	}
+	// Groups cover the whole window; the line limit applies to the groups
+	limit := query.limit
+	query.before = ""
+
+	filter, err := parseErrorFilter(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logPath, err := selectLogPath(r, "error_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	groups := map[string]*ErrorGroup{}
+	scanned := 0
+	err = scanErrorRecords(logPath, query, func(line LogLine, rec *ErrorRecord) bool {
+		scanned++
+		if !filter.matches(rec) {
+			return true
+		}
+
+		key := rec.Level + "|" + rec.Message
+		group, exists := groups[key]
+		if !exists {
+			// Records arrive newest first
+			group = &ErrorGroup{
+				Level:     rec.Level,
+				Message:   rec.Message,
+				Servers:   []string{},
+				Upstreams: []string{},
+				Latest:    rec,
+				last:      rec.time,
+				clients:   map[string]bool{},
+			}
+			groups[key] = group
+		}
+
+		group.Count++
+		group.first = rec.time
+		if rec.Server != "" && len(group.Servers) < maxGroupValues && !containsString(group.Servers, rec.Server) {
+			group.Servers = append(group.Servers, rec.Server)
+		}
+		if rec.Upstream != "" && len(group.Upstreams) < maxGroupValues && !containsString(group.Upstreams, rec.Upstream) {
+			group.Upstreams = append(group.Upstreams, rec.Upstream)
+		}
+		if rec.Client != "" {
+			group.clients[rec.Client] = true
+		}
+		return true
+	})
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := []*ErrorGroup{}
+	for _, group := range groups {
+		group.Clients = len(group.clients)
+		if !group.first.IsZero() {
+			group.FirstSeen = group.first.Format(time.RFC3339)
+		}
+		if !group.last.IsZero() {
+			group.LastSeen = group.last.Format(time.RFC3339)
+		}
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].last.After(result[j].last)
+	})
+	total := len(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"groups":  result,
+		"total":   total,
+		"scanned": scanned,
+		"from":    query.from.Format(time.RFC3339),
+	})
+}
+
+func parseErrorFilter(r *http.Request) (*errorFilter, error) {
+	q := r.URL.Query()
+	filter := &errorFilter{
+		text:     strings.ToLower(q.Get("q")),
+		client:   q.Get("client"),
+		server:   strings.ToLower(q.Get("server")),
+		upstream: q.Get("upstream"),
+	}
+
+	if level := q.Get("level"); level != "" {
+		filter.minLevel = errorLevelRank(strings.ToLower(level))
+		if filter.minLevel < 0 {
+			return nil, fmt.Errorf("invalid level: %s (expected one of %s)", level, strings.Join(errorLevels, ", "))
+		}
+	}
+
+	return filter, nil
+}
+
+func (f *errorFilter) matches(rec *ErrorRecord) bool {
+	if errorLevelRank(rec.Level) < f.minLevel {
+		return false
+	}
+	if f.text != "" && !strings.Contains(strings.ToLower(rec.Message), f.text) {
+		return false
+	}
+	if f.client != "" && rec.Client != f.client {
+		return false
+	}
+	if f.server != "" && strings.ToLower(rec.Server) != f.server {
+		return false
+	}
+	if f.upstream != "" && !strings.Contains(rec.Upstream, f.upstream) {
+		return false
+	}
+	return true
+}
+
+func errorLevelRank(level string) int {
+	for i, l := range errorLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Walk parsed error records newest to oldest within the query's window.
+// Lines that aren't in nginx's error log format are skipped.
+func scanErrorRecords(logPath string, query logQuery, fn func(LogLine, *ErrorRecord) bool) error {
+	segments := rotatedLogSegments(logPath)
+	if len(segments) == 0 {
+		return fmt.Errorf("open %s: no such file or directory", logPath)
+	}
+
+	seg, offset := 0, int64(-1)
+	if query.before != "" {
+		var err error
+		seg, offset, err = resolveLogCursor(segments, query.before)
+		if err != nil {
+			return err
+		}
+	}
+
+	return walkLogBackward(segments, seg, offset, query.from, func(line LogLine, t time.Time) bool {
+		rec, ok := parseErrorLine(line.Text)
+		if !ok {
+			return true
+		}
+		if !query.from.IsZero() && rec.time.Before(query.from) {
+			return false
+		}
+		if !query.to.IsZero() && rec.time.After(query.to) {
+			return true
+		}
+		return fn(line, rec)
+	})
+}
+
+// Parse one error log line into its fields
+func parseErrorLine(line string) (*ErrorRecord, bool) {
+	m := errorLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+
+	rec := &ErrorRecord{Level: m[2]}
+	rec.time, _ = time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+	if !rec.time.IsZero() {
+		rec.Time = rec.time.Format(time.RFC3339)
+	}
+	rec.PID, _ = strconv.Atoi(m[3])
+	rec.TID, _ = strconv.Atoi(m[4])
+	if m[5] != "" {
+		rec.Connection, _ = strconv.ParseInt(m[5], 10, 64)
+	}
+
+	// The context starts at the first ", client: " (or ", server: " for
+	// messages without a client); everything before it is the message
+	message := m[6]
+	start := -1
+	for _, key := range []string{", client: ", ", server: "} {
+		if i := strings.Index(message, key); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		rec.Message = message
+		return rec, true
+	}
+
+	rec.Message = message[:start]
+	for _, kv := range errorContextRegex.FindAllStringSubmatch(message[start:], -1) {
+		value := kv[2]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"`)
+		}
+
+		switch kv[1] {
+		case "client":
+			rec.Client = value
+		case "server":
+			rec.Server = value
+		case "request":
+			rec.Request = value
+		case "upstream":
+			rec.Upstream = value
+		case "host":
+			rec.Host = value
+		default:
+			if rec.Context == nil {
+				rec.Context = map[string]string{}
+			}
+			rec.Context[kv[1]] = value
+		}
+	}
+
+	return rec, true
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumn extracts one column from a log line and its parsed record
+type exportColumn func(line LogLine, access *AccessRecord, errRec *ErrorRecord) interface{}
+
+var (
+	accessExportColumns = map[string]exportColumn{
+		"time":         func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Time },
+		"remoteAddr":   func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.RemoteAddr },
+		"host":         func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Host },
+		"method":       func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Method },
+		"path":         func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Path },
+		"protocol":     func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Protocol },
+		"status":       func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Status },
+		"bytes":        func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Bytes },
+		"referer":      func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Referer },
+		"userAgent":    func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.UserAgent },
+		"requestTime":  func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.RequestTime },
+		"upstreamTime": func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.UpstreamTime },
+		"country":      func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return geoColumn(a.Geo, "country") },
+		"city":         func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return geoColumn(a.Geo, "city") },
+		"asn":          func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return geoColumn(a.Geo, "asn") },
+		"asOrg":        func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return geoColumn(a.Geo, "asOrg") },
+	}
+	errorExportColumns = map[string]exportColumn{
+		"time":       func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Time },
+		"level":      func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Level },
+		"pid":        func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.PID },
+		"tid":        func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.TID },
+		"connection": func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Connection },
+		"message":    func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Message },
+		"client":     func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Client },
+		"server":     func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Server },
+		"request":    func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Request },
+		"upstream":   func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Upstream },
+		"host":       func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return e.Host },
+		"country":    func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return geoColumn(e.Geo, "country") },
+	}
+	// Columns every log type has
+	lineExportColumns = map[string]exportColumn{
+		"time": func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return l.Time },
+		"file": func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return l.File },
+		"raw":  func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return l.Text },
+	}
+
+	defaultExportColumns = map[string][]string{
+		"access": {"time", "remoteAddr", "host", "method", "path", "status", "bytes", "requestTime", "referer", "userAgent"},
+		"error":  {"time", "level", "message", "client", "server", "request", "upstream"},
+	}
+)
+
+const exportFlushEvery = 500
+
+// Stream a filtered log slice as CSV or NDJSON (?type=access|error)
+func handleLogExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logType := r.URL.Query().Get("type")
+	if logType == "" {
+		logType = "access"
+	}
+	exportLog(w, r, logType)
+}
+
+func exportLog(w http.ResponseWriter, r *http.Request, logType string) {
+	q := r.URL.Query()
+
+	format := q.Get("export")
+	if format == "" {
+		format = q.Get("format")
+	}
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		sendError(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	query, err := parseLogQuery(r, maxLogLines)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			sendError(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	descending := q.Get("order") == "desc"
+	if order := q.Get("order"); order != "" && order != "asc" && order != "desc" {
+		sendError(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+
+	// Pick the file, the parser and the filter for the log type
+	var logPath string
+	var available map[string]exportColumn
+	var parse func(LogLine) (*AccessRecord, *ErrorRecord, bool)
+
+	switch logType {
+	case "access":
+		filter, err := parseAccessFilter(r)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if logPath, err = selectLogPath(r, "access_log"); err != nil {
+			sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logFormat := accessLogFormat(logPath)
+		if logFormat == nil {
+			sendError(w, "no log format available for "+logPath, http.StatusInternalServerError)
+			return
+		}
+		available = accessExportColumns
+		parse = func(line LogLine) (*AccessRecord, *ErrorRecord, bool) {
+			rec, ok := logFormat.parse(line.Text)
+			if !ok || !filter.matches(rec) {
+				return nil, nil, false
+			}
+			rec.Geo = lookupGeoIP(rec.RemoteAddr)
+			return rec, nil, true
+		}
+	case "error":
+		filter, err := parseErrorFilter(r)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if logPath, err = selectLogPath(r, "error_log"); err != nil {
+			sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		available = errorExportColumns
+		parse = func(line LogLine) (*AccessRecord, *ErrorRecord, bool) {
+			rec, ok := parseErrorLine(line.Text)
+			if !ok || !filter.matches(rec) {
+				return nil, nil, false
+			}
+			rec.Geo = lookupGeoIP(rec.Client)
+			return nil, rec, true
+		}
+	default:
+		sendError(w, "type must be access or error", http.StatusBadRequest)
+		return
+	}
+
+	columns := append([]string{}, defaultExportColumns[logType]...)
+	if v := q.Get("columns"); v != "" {
+		columns = strings.Split(v, ",")
+	}
+	getters := []exportColumn{}
+	for i, name := range columns {
+		name = strings.TrimSpace(name)
+		columns[i] = name
+		getter, ok := available[name]
+		if !ok {
+			getter, ok = lineExportColumns[name]
+		}
+		// access_log variables by name, e.g. field.upstream_addr
+		if !ok && logType == "access" && strings.HasPrefix(name, "field.") {
+			variable := strings.TrimPrefix(name, "field.")
+			getter, ok = func(l LogLine, a *AccessRecord, e *ErrorRecord) interface{} { return a.Fields[variable] }, true
+		}
+		if !ok {
+			sendError(w, fmt.Sprintf("unknown column %q for %s logs", name, logType), http.StatusBadRequest)
+			return
+		}
+		getters = append(getters, getter)
+	}
+
+	segments := rotatedLogSegments(logPath)
+	if len(segments) == 0 {
+		sendError(w, fmt.Sprintf("open %s: no such file or directory", logPath), http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", logType, time.Now().Format("20060102-150405"), format)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Trailer", "X-Export-Error")
+
+	writer := newExportWriter(w, format, columns)
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+
+	visit := func(line LogLine, t time.Time) bool {
+		if r.Context().Err() != nil {
+			return false
+		}
+
+		access, errRec, ok := parse(line)
+		if !ok {
+			return true
+		}
+		// Parsed timestamps are more precise than the ones sniffed from the line
+		if access != nil && !access.time.IsZero() {
+			t = access.time
+		} else if errRec != nil && !errRec.time.IsZero() {
+			t = errRec.time
+		}
+		if !t.IsZero() {
+			if !query.from.IsZero() && t.Before(query.from) {
+				// Walking backwards everything further is older still
+				return !descending
+			}
+			if !query.to.IsZero() && t.After(query.to) {
+				return descending
+			}
+		}
+
+		values := make([]interface{}, len(getters))
+		for i, getter := range getters {
+			values[i] = getter(line, access, errRec)
+		}
+		if err := writer.write(values); err != nil {
+			return false
+		}
+
+		rows++
+		if rows%exportFlushEvery == 0 && flusher != nil {
+			writer.flush()
+			flusher.Flush()
+		}
+		return limit == 0 || rows < limit
+	}
+
+	var walkErr error
+	if descending {
+		walkErr = walkLogBackward(segments, 0, -1, query.from, visit)
+	} else {
+		walkErr = walkLogChronological(segments, query.from, visit)
+	}
+
+	writer.flush()
+	if walkErr != nil {
+		// Headers are already sent; the error goes in a trailer
+		w.Header().Set("X-Export-Error", walkErr.Error())
+		log.Printf("Warning: Export of %s stopped after %d rows: %v", logPath, rows, walkErr)
+	}
+}
+
+// Walk the rotated set oldest to newest from the start, skipping files
+// last written before since
+func walkLogChronological(segments []logSegment, since time.Time, fn func(LogLine, time.Time) bool) error {
+	for i := len(segments) - 1; i >= 0; i-- {
+		if !since.IsZero() && segments[i].modTime.Before(since) {
+			continue
+		}
+
+		cont := true
+		err := scanLinesForward(segments[i], 0, func(text string, offset int64) bool {
+			t := extractLogTime(text)
+			line := LogLine{Text: text, Cursor: encodeLogCursor(segments[i], offset), File: segments[i].path}
+			if !t.IsZero() {
+				line.Time = t.Format(time.RFC3339)
+			}
+			cont = fn(line, t)
+			return cont
+		})
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+	return nil
+}
+
+// exportWriter writes rows as CSV (with a header) or as JSON objects, one per line
+type exportWriter struct {
+	w       io.Writer
+	columns []string
+	csv     *csv.Writer
+}
+
+func newExportWriter(w io.Writer, format string, columns []string) *exportWriter {
+	writer := &exportWriter{w: w, columns: columns}
+	if format == "csv" {
+		writer.csv = csv.NewWriter(w)
+		writer.csv.Write(columns)
+	}
+	return writer
+}
+
+func (e *exportWriter) write(values []interface{}) error {
+	if e.csv != nil {
+		record := make([]string, len(values))
+		for i, v := range values {
+			if v != nil {
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		return e.csv.Write(record)
+	}
+
+	// Built by hand so keys keep the requested column order
+	row := []byte{'{'}
+	for i, v := range values {
+		if i > 0 {
+			row = append(row, ',')
+		}
+		key, _ := json.Marshal(e.columns[i])
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		row = append(append(append(row, key...), ':'), value...)
+	}
+	row = append(row, '}', '\n')
+	_, err := e.w.Write(row)
+	return err
+}
+
+func (e *exportWriter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+}
+
+func geoColumn(geo *GeoInfo, field string) interface{} {
+	if geo == nil {
+		return nil
+	}
+	switch field {
+	case "country":
+		return geo.CountryCode
+	case "city":
+		return geo.City
+	case "asn":
+		if geo.ASN == 0 {
+			return nil
+		}
+		return geo.ASN
+	case "asOrg":
+		return geo.ASOrg
+	}
+	return nil
+}
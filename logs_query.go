@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessFilter selects structured access log records
+type accessFilter struct {
+	statusClass    int // 2 for 2xx, 5 for 5xx, ...
+	status         int
+	ip             net.IP
+	cidr           *net.IPNet
+	host           string
+	path           *regexp.Regexp
+	method         string
+	userAgent      string
+	minRequestTime float64
+}
+
+type LogQueryResult struct {
+	Records []LogLine `json:"records"`
+	Older   string    `json:"older,omitempty"` // Cursor for the next (older) page
+	Total   int       `json:"total,omitempty"` // Number of matches in the window, with count=true
+	Scanned int       `json:"scanned"`
+}
+
+// Query structured access log records
+func handleLogQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("export") != "" {
+		exportLog(w, r, "access")
+		return
+	}
+
+	query, err := parseLogQuery(r, 100)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.after != "" {
+		sendError(w, "Log queries page backwards; use before", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseAccessFilter(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logPath, err := selectLogPath(r, "access_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	result, err := queryAccessLog(logPath, accessLogFormat(logPath), query, filter, r.URL.Query().Get("count") == "true")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, result)
+}
+
+func parseAccessFilter(r *http.Request) (*accessFilter, error) {
+	q := r.URL.Query()
+	filter := &accessFilter{
+		host:      strings.ToLower(q.Get("host")),
+		method:    strings.ToUpper(q.Get("method")),
+		userAgent: strings.ToLower(q.Get("ua")),
+	}
+
+	if class := q.Get("statusClass"); class != "" {
+		// Accept "5", "5xx" or "500"
+		n, err := strconv.Atoi(strings.TrimRight(strings.ToLower(class), "x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid statusClass: %s", class)
+		}
+		for n >= 10 {
+			n /= 10
+		}
+		if n < 1 || n > 5 {
+			return nil, fmt.Errorf("invalid statusClass: %s", class)
+		}
+		filter.statusClass = n
+	}
+
+	if status := q.Get("status"); status != "" {
+		n, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status: %s", status)
+		}
+		filter.status = n
+	}
+
+	if ip := q.Get("ip"); ip != "" {
+		if strings.Contains(ip, "/") {
+			_, cidr, err := net.ParseCIDR(ip)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR: %s", ip)
+			}
+			filter.cidr = cidr
+		} else if filter.ip = net.ParseIP(ip); filter.ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", ip)
+		}
+	}
+
+	if path := q.Get("path"); path != "" {
+		re, err := regexp.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %v", err)
+		}
+		filter.path = re
+	}
+
+	if minTime := q.Get("minRequestTime"); minTime != "" {
+		v, err := strconv.ParseFloat(minTime, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minRequestTime: %s", minTime)
+		}
+		filter.minRequestTime = v
+	}
+
+	return filter, nil
+}
+
+func (f *accessFilter) matches(rec *AccessRecord) bool {
+	if f.statusClass != 0 && rec.Status/100 != f.statusClass {
+		return false
+	}
+	if f.status != 0 && rec.Status != f.status {
+		return false
+	}
+	if f.ip != nil || f.cidr != nil {
+		ip := net.ParseIP(rec.RemoteAddr)
+		if ip == nil {
+			return false
+		}
+		if f.ip != nil && !f.ip.Equal(ip) {
+			return false
+		}
+		if f.cidr != nil && !f.cidr.Contains(ip) {
+			return false
+		}
+	}
+	if f.host != "" && strings.ToLower(rec.Host) != f.host {
+		return false
+	}
+	if f.path != nil && !f.path.MatchString(rec.Path) {
+		return false
+	}
+	if f.method != "" && rec.Method != f.method {
+		return false
+	}
+	if f.userAgent != "" && !strings.Contains(strings.ToLower(rec.UserAgent), f.userAgent) {
+		return false
+	}
+	if f.minRequestTime > 0 && rec.RequestTime < f.minRequestTime {
+		return false
+	}
+	return true
+}
+
+// Scan the rotated access log set newest first, collecting matching records
+func queryAccessLog(logPath string, format *logFormat, query logQuery, filter *accessFilter, count bool) (*LogQueryResult, error) {
+	result := &LogQueryResult{Records: []LogLine{}}
+
+	err := scanAccessRecords(logPath, format, query, func(line LogLine, rec *AccessRecord) bool {
+		result.Scanned++
+		if !filter.matches(rec) {
+			return true
+		}
+
+		result.Total++
+		if len(result.Records) < query.limit {
+			rec.Geo = lookupGeoIP(rec.RemoteAddr)
+			line.Record = rec
+			result.Records = append(result.Records, line)
+			return true
+		}
+
+		// Page is full: keep going only to count the remaining matches
+		if result.Older == "" {
+			result.Older = result.Records[len(result.Records)-1].Cursor
+		}
+		return count
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !count {
+		result.Total = 0
+	}
+	return result, nil
+}
+
+// Walk parsed records newest to oldest within the query's window.
+// Lines that don't match the log format are skipped.
+func scanAccessRecords(logPath string, format *logFormat, query logQuery, fn func(LogLine, *AccessRecord) bool) error {
+	if format == nil {
+		return fmt.Errorf("no log format available for %s", logPath)
+	}
+
+	segments := rotatedLogSegments(logPath)
+	if len(segments) == 0 {
+		return fmt.Errorf("open %s: no such file or directory", logPath)
+	}
+
+	seg, offset := 0, int64(-1)
+	if query.before != "" {
+		var err error
+		seg, offset, err = resolveLogCursor(segments, query.before)
+		if err != nil {
+			return err
+		}
+	}
+
+	return walkLogBackward(segments, seg, offset, query.from, func(line LogLine, t time.Time) bool {
+		rec, ok := format.parse(line.Text)
+		if !ok {
+			return true
+		}
+		if !rec.time.IsZero() {
+			t = rec.time
+		}
+		if !t.IsZero() {
+			if !query.from.IsZero() && t.Before(query.from) {
+				return false
+			}
+			if !query.to.IsZero() && t.After(query.to) {
+				return true
+			}
+		}
+		return fn(line, rec)
+	})
+}
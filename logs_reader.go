@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type LogLine struct {
+	Text   string        `json:"text"`
+	Cursor string        `json:"cursor"`
+	File   string        `json:"file"`
+	Time   string        `json:"time,omitempty"`
+	Record *AccessRecord `json:"record,omitempty"`
+	Error  *ErrorRecord  `json:"error,omitempty"`
+}
+
+type LogPage struct {
+	Lines []LogLine `json:"lines"`
+	Older string    `json:"older,omitempty"` // Cursor for the previous page, empty at the start of the set
+	Newer string    `json:"newer,omitempty"` // Cursor for the next page
+	Files []string  `json:"files"`           // Rotated set, newest first
+}
+
+// logSegment is one file of a rotated set (access.log, access.log.1, access.log.2.gz, ...)
+type logSegment struct {
+	path    string
+	gz      bool
+	inode   uint64
+	modTime time.Time
+}
+
+type logQuery struct {
+	limit  int
+	before string
+	after  string
+	from   time.Time
+	to     time.Time
+}
+
+const (
+	maxLogLines      = 10000
+	reverseChunkSize = 64 * 1024
+)
+
+var (
+	// [10/Oct/2000:13:55:36 -0700]
+	accessTimeRegex = regexp.MustCompile(`\[(\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`)
+	// 2024/01/02 15:04:05
+	errorTimeRegex = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})`)
+	// 2024-01-02T15:04:05Z (cert-obtain log) or ISO 8601 in JSON logs
+	isoTimeRegex = regexp.MustCompile(`(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2}))`)
+)
+
+// Serve a log file: plain tail by default, a JSON page with cursors when
+// paging or time filtering is requested, or an SSE stream with follow=true
+func serveLog(w http.ResponseWriter, r *http.Request, logPath string, defaultLines int) {
+	q := r.URL.Query()
+
+	query, err := parseLogQuery(r, defaultLines)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("follow") == "true" {
+		page, err := readLogPage(logPath, logQuery{limit: query.limit})
+		backlog := []string{}
+		if err == nil {
+			for _, line := range page.Lines {
+				backlog = append(backlog, line.Text)
+			}
+		}
+		streamLog(w, r, logPath, backlog)
+		return
+	}
+
+	if q.Get("format") == "json" || query.before != "" || query.after != "" || !query.from.IsZero() || !query.to.IsZero() {
+		page, err := readLogPage(logPath, query)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, page)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(readLastLines(logPath, query.limit)))
+}
+
+func parseLogQuery(r *http.Request, defaultLines int) (logQuery, error) {
+	q := r.URL.Query()
+	query := logQuery{
+		limit:  defaultLines,
+		before: q.Get("before"),
+		after:  q.Get("after"),
+	}
+
+	if lines := q.Get("lines"); lines != "" {
+		n, err := strconv.Atoi(lines)
+		if err != nil || n <= 0 {
+			return query, fmt.Errorf("lines must be a positive integer")
+		}
+		query.limit = n
+	}
+	if query.limit > maxLogLines {
+		query.limit = maxLogLines
+	}
+
+	if query.before != "" && query.after != "" {
+		return query, fmt.Errorf("before and after cannot be combined")
+	}
+
+	for _, field := range []struct {
+		name   string
+		target *time.Time
+	}{{"from", &query.from}, {"to", &query.to}} {
+		if value := q.Get(field.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC3339 timestamp", field.name)
+			}
+			*field.target = t
+		}
+	}
+
+	return query, nil
+}
+
+// Read last N lines of a file
+func readLastLines(filePath string, n int) string {
+	page, err := readLogPage(filePath, logQuery{limit: n})
+	if err != nil {
+		return fmt.Sprintf("Error reading log: %v", err)
+	}
+
+	var buf strings.Builder
+	for _, line := range page.Lines {
+		buf.WriteString(line.Text)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Read one page of the rotated log set
+func readLogPage(logPath string, query logQuery) (*LogPage, error) {
+	segments := rotatedLogSegments(logPath)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("open %s: no such file or directory", logPath)
+	}
+
+	page := &LogPage{Lines: []LogLine{}, Files: []string{}}
+	for _, seg := range segments {
+		page.Files = append(page.Files, seg.path)
+	}
+
+	inRange := func(t time.Time) (tooOld, tooNew bool) {
+		if t.IsZero() {
+			return false, false
+		}
+		return !query.from.IsZero() && t.Before(query.from), !query.to.IsZero() && t.After(query.to)
+	}
+
+	if query.after != "" {
+		seg, offset, err := resolveLogCursor(segments, query.after)
+		if err != nil {
+			return nil, err
+		}
+		more := false
+		err = walkLogForward(segments, seg, offset, func(line LogLine, t time.Time) bool {
+			tooOld, tooNew := inRange(t)
+			if tooNew {
+				return false
+			}
+			if tooOld {
+				return true
+			}
+			if len(page.Lines) == query.limit {
+				more = true
+				return false
+			}
+			page.Lines = append(page.Lines, line)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Lines) > 0 {
+			page.Older = page.Lines[0].Cursor
+			if more {
+				page.Newer = page.Lines[len(page.Lines)-1].Cursor
+			}
+		}
+		return page, nil
+	}
+
+	seg, offset := 0, int64(-1)
+	if query.before != "" {
+		var err error
+		seg, offset, err = resolveLogCursor(segments, query.before)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	more := false
+	err := walkLogBackward(segments, seg, offset, query.from, func(line LogLine, t time.Time) bool {
+		tooOld, tooNew := inRange(t)
+		if tooOld {
+			return false
+		}
+		if tooNew {
+			return true
+		}
+		if len(page.Lines) == query.limit {
+			more = true
+			return false
+		}
+		page.Lines = append(page.Lines, line)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Collected newest first; return in file order
+	for i, j := 0, len(page.Lines)-1; i < j; i, j = i+1, j-1 {
+		page.Lines[i], page.Lines[j] = page.Lines[j], page.Lines[i]
+	}
+	if len(page.Lines) > 0 {
+		if more {
+			page.Older = page.Lines[0].Cursor
+		}
+		page.Newer = page.Lines[len(page.Lines)-1].Cursor
+	}
+	return page, nil
+}
+
+// List the live file and its rotations, newest first
+func rotatedLogSegments(logPath string) []logSegment {
+	segments := []logSegment{}
+	if seg, ok := statLogSegment(logPath); ok {
+		segments = append(segments, seg)
+	}
+
+	rotated := []logSegment{}
+	for _, pattern := range []string{logPath + ".*", logPath + "-*"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if seg, ok := statLogSegment(match); ok {
+				rotated = append(rotated, seg)
+			}
+		}
+	}
+
+	// Numeric suffixes sort by rotation count, dated suffixes by time
+	sort.SliceStable(rotated, func(i, j int) bool {
+		ni, iok := rotationIndex(logPath, rotated[i].path)
+		nj, jok := rotationIndex(logPath, rotated[j].path)
+		if iok && jok {
+			return ni < nj
+		}
+		return rotated[i].modTime.After(rotated[j].modTime)
+	})
+
+	return append(segments, rotated...)
+}
+
+func statLogSegment(path string) (logSegment, bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return logSegment{}, false
+	}
+	seg := logSegment{path: path, gz: strings.HasSuffix(path, ".gz"), modTime: info.ModTime()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		seg.inode = uint64(st.Ino)
+	}
+	return seg, true
+}
+
+// access.log.3.gz -> 3
+func rotationIndex(logPath, path string) (int, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(path, logPath+"."), ".gz")
+	n, err := strconv.Atoi(suffix)
+	return n, err == nil
+}
+
+// Cursors encode the segment name, its inode and the line's byte offset
+// (within the decompressed stream for .gz files)
+func encodeLogCursor(seg logSegment, offset int64) string {
+	raw := fmt.Sprintf("%s|%d|%d", filepath.Base(seg.path), seg.inode, offset)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func resolveLogCursor(segments []logSegment, cursor string) (int, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	inode, _ := strconv.ParseUint(parts[1], 10, 64)
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+
+	// Follow the file through a rename by logrotate before falling back to its name
+	for i, seg := range segments {
+		if inode != 0 && seg.inode == inode && !seg.gz {
+			return i, offset, nil
+		}
+	}
+	for i, seg := range segments {
+		if filepath.Base(seg.path) == parts[0] {
+			return i, offset, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("cursor refers to a log file that no longer exists")
+}
+
+// Walk lines newest to oldest, starting before offset in segments[seg]
+// (offset -1 means end of file). Segments last written before stopBefore
+// are not opened at all.
+func walkLogBackward(segments []logSegment, seg int, offset int64, stopBefore time.Time, fn func(LogLine, time.Time) bool) error {
+	for i := seg; i < len(segments); i++ {
+		if i != seg {
+			offset = -1
+			if !stopBefore.IsZero() && segments[i].modTime.Before(stopBefore) {
+				return nil
+			}
+		}
+
+		cont := true
+		visit := func(text string, lineOffset int64) bool {
+			t := extractLogTime(text)
+			line := LogLine{Text: text, Cursor: encodeLogCursor(segments[i], lineOffset), File: segments[i].path}
+			if !t.IsZero() {
+				line.Time = t.Format(time.RFC3339)
+			}
+			cont = fn(line, t)
+			return cont
+		}
+
+		var err error
+		if segments[i].gz {
+			err = scanGzipLinesBackward(segments[i].path, offset, visit)
+		} else {
+			err = scanLinesBackward(segments[i].path, offset, visit)
+		}
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Walk lines oldest to newest, starting after the line at offset in segments[seg]
+func walkLogForward(segments []logSegment, seg int, offset int64, fn func(LogLine, time.Time) bool) error {
+	skipFirst := true
+	for i := seg; i >= 0; i-- {
+		if i != seg {
+			offset = 0
+			skipFirst = false
+		}
+
+		cont := true
+		visit := func(text string, lineOffset int64) bool {
+			if skipFirst {
+				skipFirst = false
+				return true
+			}
+			t := extractLogTime(text)
+			line := LogLine{Text: text, Cursor: encodeLogCursor(segments[i], lineOffset), File: segments[i].path}
+			if !t.IsZero() {
+				line.Time = t.Format(time.RFC3339)
+			}
+			cont = fn(line, t)
+			return cont
+		}
+
+		if err := scanLinesForward(segments[i], offset, visit); err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Read a plain file backwards in chunks, calling fn for each complete line
+// that starts before end (end -1 means EOF)
+func scanLinesBackward(path string, end int64, fn func(string, int64) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if end < 0 || end > info.Size() {
+		end = info.Size()
+	}
+
+	pos := end
+	var tail []byte // Bytes after the last newline seen so far
+	for pos > 0 {
+		size := int64(reverseChunkSize)
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return err
+		}
+		buf := append(chunk, tail...)
+
+		// Emit every line whose start is inside this buffer
+		for {
+			idx := bytes.LastIndexByte(buf[:len(buf)-trailingNewline(buf)], '\n')
+			if idx < 0 {
+				break
+			}
+			line := buf[idx+1:]
+			if !fn(strings.TrimRight(string(line), "\r\n"), pos+int64(idx)+1) {
+				return nil
+			}
+			buf = buf[:idx+1]
+		}
+		tail = buf
+	}
+
+	if len(tail) > 0 {
+		fn(strings.TrimRight(string(tail), "\r\n"), 0)
+	}
+	return nil
+}
+
+func trailingNewline(buf []byte) int {
+	if len(buf) > 0 && buf[len(buf)-1] == '\n' {
+		return 1
+	}
+	return 0
+}
+
+// gzip streams can't be read backwards, so rotated archives are
+// decompressed into a temporary file first rather than into memory.
+// Offsets in it are the same as in the decompressed stream.
+func scanGzipLinesBackward(path string, end int64, fn func(string, int64) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	spool, err := os.CreateTemp("", "log-spool-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var src io.Reader = gz
+	if end >= 0 {
+		src = io.LimitReader(gz, end)
+	}
+	if _, err := io.Copy(spool, src); err != nil {
+		return fmt.Errorf("decompress %s: %v", path, err)
+	}
+	return scanLinesBackward(spool.Name(), -1, fn)
+}
+
+// Read lines from offset onwards, plain or gzip
+func scanLinesForward(seg logSegment, offset int64, fn func(string, int64) bool) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	pos := int64(0)
+	if seg.gz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, gz, offset); err != nil {
+				return nil
+			}
+			pos = offset
+		}
+	} else if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		pos = offset
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if !fn(strings.TrimRight(line, "\r\n"), pos) {
+				return nil
+			}
+			pos += int64(len(line))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Extract the timestamp of an access, error or cert-obtain log line
+func extractLogTime(line string) time.Time {
+	if m := accessTimeRegex.FindStringSubmatch(line); m != nil {
+		if t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[1]); err == nil {
+			return t
+		}
+	}
+	if m := errorTimeRegex.FindStringSubmatch(line); m != nil {
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local); err == nil {
+			return t
+		}
+	}
+	if m := isoTimeRegex.FindStringSubmatch(line); m != nil {
+		if t, err := time.Parse(time.RFC3339Nano, m[1]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type LogRotationSettings struct {
+	Enabled     bool     `json:"enabled"`
+	Paths       []string `json:"paths"`       // Files or globs to manage
+	MaxSizeMB   int      `json:"maxSizeMb"`   // Rotate once a file is larger (0 = no size limit)
+	MaxAgeHours int      `json:"maxAgeHours"` // Rotate once a file has been written to this long (0 = no age limit)
+	Keep        int      `json:"keep"`        // Rotated files to retain
+	Compress    bool     `json:"compress"`    // gzip rotated files, except the newest one
+	Interval    int      `json:"interval"`    // Check interval in minutes
+}
+
+type LogRotationStatus struct {
+	Path    string   `json:"path"`
+	Size    int64    `json:"size"`
+	Since   string   `json:"since,omitempty"` // Last rotation, or the first line of a never-rotated file
+	Rotated []string `json:"rotated"`
+	Error   string   `json:"error,omitempty"`
+}
+
+var (
+	logRotationSettings = LogRotationSettings{
+		Enabled:     true,
+		Paths:       []string{"/var/log/nginx/*.log"},
+		MaxSizeMB:   50,
+		MaxAgeHours: 24,
+		Keep:        7,
+		Compress:    true,
+		Interval:    5,
+	}
+	logRotationLock sync.RWMutex
+	logRotationFile = filepath.Join("/app/data", "log-rotation.json")
+
+	// When each file was last rotated (or first seen), persisted for age limits
+	logRotationState     = map[string]time.Time{}
+	logRotationErrors    = map[string]string{}
+	logRotationStateLock sync.Mutex
+	logRotationStateFile = filepath.Join("/app/data", "log-rotation-state.json")
+
+	// Serializes rotations so two runs can't shuffle the .1…N chain at once
+	logRotationRunLock sync.Mutex
+
+	// Present on distro installs, where logrotate already handles nginx's logs
+	distroLogrotateConf = "/etc/logrotate.d/nginx"
+
+	// How distros schedule logrotate; without one of these the conf above is
+	// never read (the Docker image only runs its own services conf)
+	distroLogrotateSchedules = []string{
+		"/etc/cron.daily/logrotate",
+		"/etc/periodic/daily/logrotate",
+		"/lib/systemd/system/logrotate.timer",
+		"/usr/lib/systemd/system/logrotate.timer",
+	}
+)
+
+// Get or update log rotation settings, with the state of each managed file
+func handleLogRotation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		logRotationLock.RLock()
+		settings := logRotationSettings
+		logRotationLock.RUnlock()
+
+		sendJSON(w, map[string]interface{}{
+			"settings": settings,
+			"files":    logRotationStatuses(settings),
+		})
+	case http.MethodPost:
+		var settings LogRotationSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Keep < 1 {
+			sendError(w, "keep must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if settings.Enabled && settings.MaxSizeMB <= 0 && settings.MaxAgeHours <= 0 {
+			sendError(w, "Set maxSizeMb and/or maxAgeHours", http.StatusBadRequest)
+			return
+		}
+		for _, pattern := range settings.Paths {
+			if !filepath.IsAbs(pattern) {
+				sendError(w, "Paths must be absolute: "+pattern, http.StatusBadRequest)
+				return
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				sendError(w, "Invalid pattern: "+pattern, http.StatusBadRequest)
+				return
+			}
+		}
+		if settings.Paths == nil {
+			settings.Paths = []string{}
+		}
+		if settings.Interval <= 0 {
+			settings.Interval = 5
+		}
+
+		logRotationLock.Lock()
+		logRotationSettings = settings
+		logRotationLock.Unlock()
+
+		if err := saveLogRotationSettings(); err != nil {
+			log.Printf("Warning: Failed to save log rotation settings: %v", err)
+		}
+
+		sendJSON(w, map[string]interface{}{"status": "ok", "settings": settings})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Rotate now, regardless of thresholds: every managed file, or just one
+func handleLogRotateNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	logRotationLock.RLock()
+	settings := logRotationSettings
+	logRotationLock.RUnlock()
+
+	files := managedLogFiles(settings)
+	if req.Path != "" {
+		if !containsString(files, req.Path) {
+			sendError(w, "Not a managed log file: "+req.Path, http.StatusBadRequest)
+			return
+		}
+		files = []string{req.Path}
+	}
+
+	rotated, errs := rotateLogFiles(settings, files, true)
+	sendJSON(w, map[string]interface{}{
+		"success": len(errs) == 0,
+		"rotated": rotated,
+		"errors":  errs,
+	})
+}
+
+func runLogRotation() {
+	for {
+		logRotationLock.RLock()
+		settings := logRotationSettings
+		logRotationLock.RUnlock()
+
+		if settings.Enabled {
+			rotateLogFiles(settings, managedLogFiles(settings), false)
+		}
+
+		interval := settings.Interval
+		if interval <= 0 {
+			interval = 5
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
+	}
+}
+
+// Expand the configured globs into the live log files they match
+func managedLogFiles(settings LogRotationSettings) []string {
+	files := []string{}
+	for _, pattern := range settings.Paths {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			// Rotated copies (access.log.1) never match *.log, but plain paths might
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() && !containsString(files, match) {
+				files = append(files, match)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Rotate files that are over a threshold (or all non-empty ones when forced),
+// then have nginx reopen its logs if any of them were nginx's
+func rotateLogFiles(settings LogRotationSettings, files []string, force bool) ([]string, map[string]string) {
+	logRotationRunLock.Lock()
+	defer logRotationRunLock.Unlock()
+
+	rotated := []string{}
+	errs := map[string]string{}
+
+	nginxLogs := map[string]bool{}
+	for _, source := range discoverLogSources() {
+		nginxLogs[source.Path] = true
+	}
+	reopen := false
+
+	for _, path := range files {
+		due, err := logRotationDue(settings, path)
+		if force && err == nil {
+			if info, statErr := os.Stat(path); statErr == nil && info.Size() > 0 {
+				due = true
+			}
+		}
+		if err == nil && due {
+			err = rotateLogFile(path, settings.Keep)
+			if err == nil {
+				rotated = append(rotated, path)
+				setLogRotationState(path, time.Now(), "")
+				if nginxLogs[path] {
+					reopen = true
+				}
+				continue
+			}
+		}
+		if err != nil {
+			errs[path] = err.Error()
+			setLogRotationState(path, time.Time{}, err.Error())
+		}
+	}
+
+	if reopen {
+		// nginx keeps writing to the renamed files until it reopens them (USR1)
+		if output, err := signalNginx("reopen"); err != nil {
+			log.Printf("Warning: Failed to reopen nginx logs: %v %s", err, output)
+			errs["nginx"] = fmt.Sprintf("reopen failed: %v", err)
+		}
+	}
+
+	// Compress only after nginx has moved on from .1 (like delaycompress)
+	if settings.Compress {
+		for _, path := range rotated {
+			if err := compressRotatedLogs(path, settings.Keep); err != nil {
+				errs[path] = err.Error()
+			}
+		}
+	}
+
+	if len(rotated) > 0 {
+		log.Printf("Rotated %d log file(s): %v", len(rotated), rotated)
+		if err := saveLogRotationState(); err != nil {
+			log.Printf("Warning: Failed to save log rotation state: %v", err)
+		}
+	}
+
+	return rotated, errs
+}
+
+func logRotationDue(settings LogRotationSettings, path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+
+	if settings.MaxSizeMB > 0 && info.Size() >= int64(settings.MaxSizeMB)*1024*1024 {
+		return true, nil
+	}
+	if settings.MaxAgeHours > 0 {
+		since := logFileSince(path)
+		if time.Since(since) >= time.Duration(settings.MaxAgeHours)*time.Hour {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// When the current file was started: the last rotation, else the time of
+// its first line, else now (remembered so the age keeps counting)
+func logFileSince(path string) time.Time {
+	logRotationStateLock.Lock()
+	since, known := logRotationState[path]
+	logRotationStateLock.Unlock()
+	if known {
+		return since
+	}
+
+	since = time.Now()
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		if scanner.Scan() {
+			if t := extractLogTime(scanner.Text()); !t.IsZero() {
+				since = t
+			}
+		}
+		file.Close()
+	}
+
+	setLogRotationState(path, since, "")
+	return since
+}
+
+func setLogRotationState(path string, since time.Time, errMessage string) {
+	logRotationStateLock.Lock()
+	defer logRotationStateLock.Unlock()
+
+	if !since.IsZero() {
+		logRotationState[path] = since
+	}
+	if errMessage != "" {
+		logRotationErrors[path] = errMessage
+	} else {
+		delete(logRotationErrors, path)
+	}
+}
+
+// Shift path.N to path.N+1, move path to path.1 and recreate path empty
+// with the same mode and owner. Files beyond keep are deleted.
+func rotateLogFile(path string, keep int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	for n := keep; n >= 1; n-- {
+		for _, ext := range []string{"", ".gz"} {
+			from := fmt.Sprintf("%s.%d%s", path, n, ext)
+			if _, err := os.Stat(from); err != nil {
+				continue
+			}
+			if n == keep {
+				if err := os.Remove(from); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := os.Rename(from, fmt.Sprintf("%s.%d%s", path, n+1, ext)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("recreate %s: %v", path, err)
+	}
+	file.Close()
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		os.Chown(path, int(st.Uid), int(st.Gid))
+	}
+
+	return pruneRotatedLogs(path, keep)
+}
+
+// Delete rotated files numbered above keep, e.g. after keep was lowered
+func pruneRotatedLogs(path string, keep int) error {
+	matches, _ := filepath.Glob(path + ".*")
+	for _, match := range matches {
+		if n, ok := rotationIndex(path, match); ok && n > keep {
+			if err := os.Remove(match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gzip every rotated file except path.1, keeping modification times so
+// time-range reads can still skip old files
+func compressRotatedLogs(path string, keep int) error {
+	for n := 2; n <= keep; n++ {
+		plain := fmt.Sprintf("%s.%d", path, n)
+		info, err := os.Stat(plain)
+		if err != nil {
+			continue
+		}
+
+		if err := gzipFile(plain, plain+".gz", info); err != nil {
+			os.Remove(plain + ".gz.tmp")
+			return err
+		}
+		if err := os.Remove(plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gzipFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	gz.Name = filepath.Base(src)
+	gz.ModTime = info.ModTime()
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		os.Chown(tmp, int(st.Uid), int(st.Gid))
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func logRotationStatuses(settings LogRotationSettings) []LogRotationStatus {
+	statuses := []LogRotationStatus{}
+	for _, path := range managedLogFiles(settings) {
+		status := LogRotationStatus{Path: path, Rotated: []string{}}
+		if info, err := os.Stat(path); err == nil {
+			status.Size = info.Size()
+		}
+		for _, seg := range rotatedLogSegments(path)[1:] {
+			status.Rotated = append(status.Rotated, seg.path)
+		}
+
+		logRotationStateLock.Lock()
+		if since, known := logRotationState[path]; known {
+			status.Since = since.Format(time.RFC3339)
+		}
+		status.Error = logRotationErrors[path]
+		logRotationStateLock.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Log rotation settings persistence
+func saveLogRotationSettings() error {
+	logRotationLock.RLock()
+	defer logRotationLock.RUnlock()
+
+	data, err := json.MarshalIndent(logRotationSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(logRotationFile, data, 0644)
+}
+
+func loadLogRotationSettings() error {
+	if data, err := os.ReadFile(logRotationStateFile); err == nil {
+		logRotationStateLock.Lock()
+		json.Unmarshal(data, &logRotationState)
+		logRotationStateLock.Unlock()
+	}
+
+	data, err := os.ReadFile(logRotationFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Don't rotate a second time behind the distro's logrotate
+			if distroLogrotateActive() {
+				log.Printf("Log rotation: %s is scheduled by the system, built-in rotation is off until enabled", distroLogrotateConf)
+				logRotationLock.Lock()
+				logRotationSettings.Enabled = false
+				logRotationLock.Unlock()
+			}
+			return nil
+		}
+		return err
+	}
+
+	logRotationLock.Lock()
+	defer logRotationLock.Unlock()
+
+	return json.Unmarshal(data, &logRotationSettings)
+}
+
+func saveLogRotationState() error {
+	logRotationStateLock.Lock()
+	defer logRotationStateLock.Unlock()
+
+	data, err := json.MarshalIndent(logRotationState, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(logRotationStateFile, data, 0644)
+}
+
+// Whether the distro's logrotate will rotate nginx's logs on its own
+func distroLogrotateActive() bool {
+	if _, err := os.Stat(distroLogrotateConf); err != nil {
+		return false
+	}
+	for _, path := range distroLogrotateSchedules {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
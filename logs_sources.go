@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LogSource is one log file written by nginx, with the vhosts logging to it
+type LogSource struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"` // access or error
+	Path    string   `json:"path"`
+	Format  string   `json:"format,omitempty"` // log_format name, for access logs
+	Level   string   `json:"level,omitempty"`  // Minimum level, for error logs
+	Context string   `json:"context"`          // main, http, server, location, stream or default
+	Vhosts  []string `json:"vhosts"`
+	File    string   `json:"file,omitempty"` // Where the directive was found
+	Line    int      `json:"line,omitempty"`
+	Exists  bool     `json:"exists"`
+	Size    int64    `json:"size"`
+}
+
+// Compiled-in defaults, used when nothing in the config overrides them
+var defaultLogPaths = map[string]string{
+	"access_log": "/var/log/nginx/access.log",
+	"error_log":  "/var/log/nginx/error.log",
+}
+
+// List every log file referenced by the config
+func handleLogSources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sources := discoverLogSources()
+	if logType := r.URL.Query().Get("type"); logType != "" {
+		filtered := []*LogSource{}
+		for _, source := range sources {
+			if source.Type == logType {
+				filtered = append(filtered, source)
+			}
+		}
+		sources = filtered
+	}
+
+	sendJSON(w, sources)
+}
+
+// Pick the log file for a request from its log or vhost parameter,
+// falling back to the main log of that type
+func selectLogPath(r *http.Request, directive string) (string, error) {
+	q := r.URL.Query()
+	id, vhost := q.Get("log"), strings.ToLower(q.Get("vhost"))
+	if id == "" && vhost == "" {
+		return findLogPath(directive), nil
+	}
+
+	logType := strings.TrimSuffix(directive, "_log")
+	var locationLog *LogSource
+	for _, source := range discoverLogSources() {
+		if source.Type != logType {
+			continue
+		}
+		if id != "" && source.ID == id {
+			return source.Path, nil
+		}
+		if id == "" {
+			for _, name := range source.Vhosts {
+				if strings.ToLower(name) != vhost {
+					continue
+				}
+				// Prefer the vhost's server-wide log over per-location ones
+				if source.Context != "location" {
+					return source.Path, nil
+				}
+				if locationLog == nil {
+					locationLog = source
+				}
+			}
+		}
+	}
+	if locationLog != nil {
+		return locationLog.Path, nil
+	}
+
+	if id != "" {
+		return "", fmt.Errorf("unknown %s log: %s", logType, id)
+	}
+	return "", fmt.Errorf("no %s log found for vhost %s", logType, vhost)
+}
+
+// Find the main log of a type: the one set at http or main level,
+// otherwise the first one found, otherwise nginx's default
+func findLogPath(directive string) string {
+	logType := strings.TrimSuffix(directive, "_log")
+	var first *LogSource
+	for _, source := range discoverLogSources() {
+		if source.Type != logType {
+			continue
+		}
+		if source.Context == "http" || source.Context == "main" || source.Context == "default" {
+			return source.Path
+		}
+		if first == nil {
+			first = source
+		}
+	}
+	if first != nil {
+		return first.Path
+	}
+	return defaultLogPaths[directive]
+}
+
+// A log directive found in the config, with the server block it belongs to
+type logDirective struct {
+	directive *Directive
+	context   string
+	server    *Directive
+}
+
+// Collect access_log and error_log directives from every context and map
+// each file to the vhosts writing to it. Servers without their own log
+// directive inherit the ones from the enclosing http (or main) context.
+func discoverLogSources() []*LogSource {
+	sources := []*LogSource{}
+	byKey := map[string]*LogSource{}
+
+	add := func(directive, path, detail, context string, d *Directive, vhosts []string) {
+		logType := strings.TrimSuffix(directive, "_log")
+		key := logType + "|" + path
+		source, exists := byKey[key]
+		if !exists {
+			sum := sha1.Sum([]byte(key))
+			source = &LogSource{
+				ID:      logType + "-" + hex.EncodeToString(sum[:])[:10],
+				Type:    logType,
+				Path:    path,
+				Context: context,
+				Vhosts:  []string{},
+			}
+			if logType == "access" {
+				source.Format = detail
+			} else {
+				source.Level = detail
+			}
+			if d != nil {
+				source.File = d.File
+				source.Line = d.Line
+			}
+			if info, err := os.Stat(path); err == nil {
+				source.Exists = true
+				source.Size = info.Size()
+			}
+			byKey[key] = source
+			sources = append(sources, source)
+		}
+		for _, name := range vhosts {
+			if !containsString(source.Vhosts, name) {
+				source.Vhosts = append(source.Vhosts, name)
+			}
+		}
+	}
+
+	found := []logDirective{}
+	servers := []*Directive{}
+
+	if directives, err := parseNginxConfig(); err == nil {
+		walkDirectives(directives, func(d *Directive, parents []*Directive) {
+			inHTTP := false
+			var server *Directive
+			for _, parent := range parents {
+				switch parent.Name {
+				case "http":
+					inHTTP = true
+				case "server":
+					if inHTTP && server == nil {
+						server = parent
+					}
+				}
+			}
+
+			if d.Name == "server" && inHTTP && server == nil {
+				servers = append(servers, d)
+			}
+			if d.Name != "access_log" && d.Name != "error_log" || len(d.Args) == 0 {
+				return
+			}
+
+			context := "main"
+			if len(parents) > 0 {
+				context = parents[len(parents)-1].Name
+			}
+			for _, parent := range parents {
+				if parent.Name == "stream" {
+					context = "stream"
+				}
+			}
+			found = append(found, logDirective{directive: d, context: context, server: server})
+		})
+	}
+
+	// Logs declared inside a server (or its locations) belong to it
+	owned := map[*Directive]map[string]bool{}
+	for _, ld := range found {
+		if ld.server == nil {
+			continue
+		}
+		// Only a server-level directive stops inheritance for the whole server
+		if ld.context == "server" {
+			if owned[ld.server] == nil {
+				owned[ld.server] = map[string]bool{}
+			}
+			owned[ld.server][ld.directive.Name] = true
+		}
+		if path, detail, ok := logTarget(ld.directive); ok {
+			add(ld.directive.Name, path, detail, ld.context, ld.directive, serverNames(ld.server))
+		}
+	}
+
+	// Everything else is inherited by servers that don't log on their own
+	for _, directive := range []string{"access_log", "error_log"} {
+		inherited := []string{}
+		for _, server := range servers {
+			if !owned[server][directive] {
+				inherited = append(inherited, serverNames(server)...)
+			}
+		}
+
+		// The nearest declaring context is the one inherited: http, or main for error_log
+		scope := "http"
+		if directive == "error_log" && countDirectives(found, directive, "http") == 0 {
+			scope = "main"
+		}
+
+		for _, ld := range found {
+			if ld.server != nil || ld.directive.Name != directive {
+				continue
+			}
+			path, detail, ok := logTarget(ld.directive)
+			if !ok {
+				continue
+			}
+			// Stream and overridden contexts are listed without vhosts
+			var vhosts []string
+			if ld.context == scope {
+				vhosts = inherited
+			}
+			add(directive, path, detail, ld.context, ld.directive, vhosts)
+		}
+
+		if countDirectives(found, directive, scope) == 0 {
+			detail := "combined"
+			if directive == "error_log" {
+				detail = "error"
+			}
+			add(directive, defaultLogPaths[directive], detail, "default", nil, inherited)
+		}
+	}
+
+	for _, source := range sources {
+		sort.Strings(source.Vhosts)
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		if sources[i].Type != sources[j].Type {
+			return sources[i].Type < sources[j].Type
+		}
+		return sources[i].Path < sources[j].Path
+	})
+
+	return sources
+}
+
+// Resolve a log directive's file and its format (access) or level (error).
+// Disabled and syslog targets have no file.
+func logTarget(d *Directive) (string, string, bool) {
+	path := d.Args[0]
+	if path == "off" || strings.HasPrefix(path, "syslog:") || strings.HasPrefix(path, "memory:") || path == "stderr" {
+		return "", "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(findMainConfig()), path)
+	}
+
+	detail := "combined"
+	if d.Name == "error_log" {
+		detail = "error"
+	}
+	if len(d.Args) > 1 && !strings.Contains(d.Args[1], "=") {
+		detail = d.Args[1]
+	}
+	return path, detail, true
+}
+
+// Names a server block answers to, or "_" for unnamed servers
+func serverNames(server *Directive) []string {
+	names := []string{}
+	walkDirectives(server.Block, func(d *Directive, parents []*Directive) {
+		if d.Name == "server_name" && len(parents) == 0 {
+			for _, name := range d.Args {
+				if name != "" && !containsString(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	})
+	if len(names) == 0 {
+		names = append(names, "_")
+	}
+	return names
+}
+
+func countDirectives(found []logDirective, directive, context string) int {
+	count := 0
+	for _, ld := range found {
+		if ld.server == nil && ld.directive.Name == directive && ld.context == context {
+			count++
+		}
+	}
+	return count
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logTailer follows a single file and fans new lines out to every
+// subscriber, so concurrent viewers share one reader per file
+type logTailer struct {
+	path        string
+	subscribers map[chan string]bool
+	lock        sync.Mutex
+	stop        chan struct{}
+}
+
+var (
+	logTailers     = map[string]*logTailer{}
+	logTailersLock sync.Mutex
+)
+
+const (
+	tailPollInterval   = 500 * time.Millisecond
+	tailHeartbeat      = 15 * time.Second
+	tailSubscriberSize = 256
+)
+
+// Stream a log file over Server-Sent Events
+func streamLog(w http.ResponseWriter, r *http.Request, logPath string, backlog []string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := subscribeLog(logPath)
+	defer unsubscribeLog(logPath, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx proxy buffering
+
+	for _, line := range backlog {
+		writeSSE(w, "line", line)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeSSE(w, "line", line)
+			// Drain whatever else is queued before flushing
+			for drained := false; !drained; {
+				select {
+				case line, ok := <-ch:
+					if !ok {
+						flusher.Flush()
+						return
+					}
+					writeSSE(w, "line", line)
+				default:
+					drained = true
+				}
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSE(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func subscribeLog(path string) chan string {
+	logTailersLock.Lock()
+	defer logTailersLock.Unlock()
+
+	tailer, exists := logTailers[path]
+	if !exists {
+		tailer = &logTailer{
+			path:        path,
+			subscribers: map[chan string]bool{},
+			stop:        make(chan struct{}),
+		}
+		logTailers[path] = tailer
+		go tailer.run()
+	}
+
+	ch := make(chan string, tailSubscriberSize)
+	tailer.lock.Lock()
+	tailer.subscribers[ch] = true
+	tailer.lock.Unlock()
+	return ch
+}
+
+func unsubscribeLog(path string, ch chan string) {
+	logTailersLock.Lock()
+	defer logTailersLock.Unlock()
+
+	tailer, exists := logTailers[path]
+	if !exists {
+		return
+	}
+
+	tailer.lock.Lock()
+	delete(tailer.subscribers, ch)
+	remaining := len(tailer.subscribers)
+	tailer.lock.Unlock()
+
+	// Last viewer gone: stop following the file
+	if remaining == 0 {
+		close(tailer.stop)
+		delete(logTailers, path)
+	}
+}
+
+func (t *logTailer) broadcast(line string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for ch := range t.subscribers {
+		// Slow viewers miss lines rather than stalling everyone else
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Poll the file for appended data, following truncation and rotation
+func (t *logTailer) run() {
+	var file *os.File
+	var reader *bufio.Reader
+	var offset int64
+	var partial string
+
+	open := func(fromEnd bool) {
+		f, err := os.Open(t.path)
+		if err != nil {
+			return
+		}
+		if fromEnd {
+			offset, _ = f.Seek(0, io.SeekEnd)
+		} else {
+			offset = 0
+		}
+		file = f
+		reader = bufio.NewReader(f)
+		partial = ""
+	}
+
+	readAvailable := func() {
+		for {
+			chunk, err := reader.ReadString('\n')
+			offset += int64(len(chunk))
+			if err != nil {
+				// Keep incomplete lines until the writer finishes them
+				partial += chunk
+				return
+			}
+			t.broadcast(strings.TrimRight(partial+chunk, "\r\n"))
+			partial = ""
+		}
+	}
+
+	open(true)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if file == nil {
+			// File did not exist yet; pick it up from the start once created
+			open(false)
+			if file == nil {
+				continue
+			}
+		}
+
+		readAvailable()
+
+		current, err := os.Stat(t.path)
+		opened, openErr := file.Stat()
+		switch {
+		case err != nil:
+			// Rotated away and not recreated yet; keep the old handle for now
+		case openErr != nil || !os.SameFile(current, opened):
+			// Renamed by logrotate: finish the old file, then switch over
+			readAvailable()
+			file.Close()
+			open(false)
+		case current.Size() < offset:
+			// Truncated in place (copytruncate)
+			file.Seek(0, io.SeekStart)
+			reader.Reset(file)
+			offset = 0
+			partial = ""
+		}
+	}
+}
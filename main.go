@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"embed"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,33 +38,26 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-type CertificateInfo struct {
-	Domain      string `json:"domain"`
-	Path        string `json:"path"`
-	CertFile    string `json:"certFile"`
-	KeyFile     string `json:"keyFile"`
-	NotBefore   string `json:"notBefore"`
-	NotAfter    string `json:"notAfter"`
-	DaysLeft    int    `json:"daysLeft"`
-	IsWildcard  bool   `json:"isWildcard"`
-}
-
 type ObtainCertRequest struct {
-	Domains     []string          `json:"domains"`
-	Email       string            `json:"email"`
-	Challenge   string            `json:"challenge"` // "http-01" or "dns-01"
-	Provider    string            `json:"provider"`  // "namesilo", "duckdns", "namecheap"
-	Credentials map[string]string `json:"credentials"`
-	Staging     bool              `json:"staging"` // Use Let's Encrypt staging server
-	Force       bool              `json:"force"`   // Force renewal even if cert exists
+	Domains           []string          `json:"domains"`
+	Email             string            `json:"email"`
+	Challenge         string            `json:"challenge"` // "http-01" or "dns-01"
+	Provider          string            `json:"provider"`  // "namesilo", "duckdns", "namecheap"
+	Credentials       map[string]string `json:"credentials"`
+	CredentialProfile string            `json:"credentialProfile"` // Named DNS credentials, instead of or on top of Credentials
+	Staging           bool              `json:"staging"`           // Use Let's Encrypt staging server
+	Force             bool              `json:"force"`             // Force renewal even if cert exists
+	Directory         string            `json:"directory"`         // ACME directory URL, overrides staging
+	KeyType           string            `json:"keyType"`           // ec256, ec384, rsa2048, rsa3072 or rsa4096
 }
 
 // Dashboard types
 type SystemStats struct {
-	CPU     CPUStats     `json:"cpu"`
-	Memory  MemoryStats  `json:"memory"`
-	Disk    DiskStats    `json:"disk"`
-	Network NetworkStats `json:"network"`
+	CPU     CPUStats      `json:"cpu"`
+	Memory  MemoryStats   `json:"memory"`
+	Disk    DiskStats     `json:"disk"`
+	Network NetworkStats  `json:"network"`
+	Nginx   *NginxMetrics `json:"nginx,omitempty"`
 }
 
 type CPUStats struct {
@@ -154,6 +146,51 @@ func main() {
 	if err := loadAppIcons(); err != nil {
 		log.Printf("Warning: Failed to load app icons: %v", err)
 	}
+	if err := loadStubStatusSettings(); err != nil {
+		log.Printf("Warning: Failed to load stub_status settings: %v", err)
+	}
+	if err := loadGeoIPSettings(); err != nil {
+		log.Printf("Warning: Failed to load GeoIP settings: %v", err)
+	}
+	if err := loadLogRotationSettings(); err != nil {
+		log.Printf("Warning: Failed to load log rotation settings: %v", err)
+	}
+	if err := loadAnomalySettings(); err != nil {
+		log.Printf("Warning: Failed to load anomaly settings: %v", err)
+	}
+	if err := loadACMESettings(); err != nil {
+		log.Printf("Warning: Failed to load ACME settings: %v", err)
+	}
+	if err := loadCertJobs(); err != nil {
+		log.Printf("Warning: Failed to load certificate jobs: %v", err)
+	}
+	if err := loadCredentialProfiles(); err != nil {
+		log.Printf("Warning: Failed to load credential profiles: %v", err)
+	}
+	if err := loadCertRenewalSettings(); err != nil {
+		log.Printf("Warning: Failed to load certificate renewal settings: %v", err)
+	}
+	if err := loadManagedCerts(); err != nil {
+		log.Printf("Warning: Failed to load managed certificates: %v", err)
+	}
+	if err := importAcmeShCerts(); err != nil {
+		log.Printf("Warning: Failed to import acme.sh certificates: %v", err)
+	}
+	if err := loadCertRenewalRuns(); err != nil {
+		log.Printf("Warning: Failed to load certificate renewal runs: %v", err)
+	}
+	if err := loadSafeReloadSettings(); err != nil {
+		log.Printf("Warning: Failed to load reload probes: %v", err)
+	}
+	if err := initConfigSnapshot(); err != nil {
+		log.Printf("Warning: Failed to snapshot config: %v", err)
+	}
+
+	// Background collectors
+	go runStubStatusCollector()
+	go runLogRotation()
+	go runAnomalyDetector()
+	go runCertRenewal()
 
 	// Setup routes
 	http.HandleFunc("/api/files", handleFiles)
@@ -166,12 +203,53 @@ func main() {
 	http.HandleFunc("/api/file/symlink", handleSymlinkCreate)
 	http.HandleFunc("/api/nginx/test", handleNginxTest)
 	http.HandleFunc("/api/nginx/reload", handleNginxReload)
+	http.HandleFunc("/api/nginx/reload/probes", handleReloadProbes)
+	http.HandleFunc("/api/nginx/effective", handleNginxEffectiveConfig)
+	http.HandleFunc("/api/nginx/status", handleNginxStatus)
+	http.HandleFunc("/api/nginx/info", handleNginxInfo)
+	http.HandleFunc("/api/nginx/metrics", handleNginxMetrics)
+	http.HandleFunc("/api/nginx/metrics/settings", handleNginxMetricsSettings)
+	http.HandleFunc("/api/nginx/start", handleNginxStart)
+	http.HandleFunc("/api/nginx/stop", handleNginxStop)
+	http.HandleFunc("/api/nginx/quit", handleNginxQuit)
+	http.HandleFunc("/api/nginx/reopen", handleNginxReopen)
+	http.HandleFunc("/api/nginx/upgrade", handleNginxUpgrade)
 	http.HandleFunc("/api/logs/access", handleAccessLog)
 	http.HandleFunc("/api/logs/error", handleErrorLog)
+	http.HandleFunc("/api/logs/error/query", handleErrorLogQuery)
+	http.HandleFunc("/api/logs/error/groups", handleErrorLogGroups)
 	http.HandleFunc("/api/logs/cert-obtain", handleCertObtainLog)
+	http.HandleFunc("/api/logs/sources", handleLogSources)
+	http.HandleFunc("/api/logs/formats", handleLogFormats)
+	http.HandleFunc("/api/logs/query", handleLogQuery)
+	http.HandleFunc("/api/logs/analytics", handleLogAnalytics)
+	http.HandleFunc("/api/logs/export", handleLogExport)
+	http.HandleFunc("/api/logs/anomalies", handleAnomalies)
+	http.HandleFunc("/api/logs/anomalies/settings", handleAnomalySettings)
+	http.HandleFunc("/api/logs/anomalies/stream", handleAnomalyStream)
+	http.HandleFunc("/api/logs/rotation", handleLogRotation)
+	http.HandleFunc("/api/logs/rotation/run", handleLogRotateNow)
+	http.HandleFunc("/api/geoip/settings", handleGeoIPSettings)
+	http.HandleFunc("/api/geoip/lookup", handleGeoIPLookup)
 	http.HandleFunc("/api/certificates", handleCertificates)
 	http.HandleFunc("/api/certificates/obtain", handleObtainCertificate)
 	http.HandleFunc("/api/certificates/delete", handleDeleteCertificate)
+	http.HandleFunc("/api/certificates/import", handleImportCertificate)
+	http.HandleFunc("/api/local-ca", handleLocalCA)
+	http.HandleFunc("/api/local-ca/root", handleLocalCARoot)
+	http.HandleFunc("/api/local-ca/issue", handleLocalCAIssue)
+	http.HandleFunc("/api/certificates/jobs", handleCertJobs)
+	http.HandleFunc("/api/certificates/jobs/cancel", handleCertJobCancel)
+	http.HandleFunc("/api/certificates/jobs/stream", handleCertJobStream)
+	http.HandleFunc("/api/certificates/renewal", handleCertRenewal)
+	http.HandleFunc("/api/certificates/renewal/run", handleCertRenewalRun)
+	http.HandleFunc("/api/certificates/renewal/runs", handleCertRenewalRuns)
+	http.HandleFunc("/api/certificates/renewal/certs", handleCertRenewalCerts)
+	http.HandleFunc("/api/acme/settings", handleACMESettings)
+	http.HandleFunc("/api/acme/accounts", handleACMEAccounts)
+	http.HandleFunc("/api/acme/dns-providers", handleDNSProviders)
+	http.HandleFunc("/api/acme/credentials", handleCredentialProfiles)
+	http.HandleFunc(acmeChallengePath, handleACMEHTTPChallenge)
 
 	// Dashboard API routes
 	http.HandleFunc("/api/system/stats", handleSystemStats)
@@ -531,12 +609,38 @@ func handleNginxTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := exec.Command("nginx", "-t")
-	output, err := cmd.CombinedOutput()
+	// Optional unsaved buffers to validate without touching the live config
+	var req NginxTestRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(req.Files) > 0 {
+		output, success, warnings, err := testConfigWithOverrides(req.Files)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, map[string]interface{}{
+			"output":   output,
+			"success":  success,
+			"errors":   parseNginxMessages(output),
+			"warnings": warnings,
+			"dryRun":   true,
+		})
+		return
+	}
+
+	output, err := execNginxTest()
 
 	result := map[string]interface{}{
-		"output": string(output),
+		"output": output,
 		"success": err == nil,
+		"errors":  parseNginxMessages(output),
+		"warnings": lintNginxConfig(findMainConfig()),
 	}
 
 	sendJSON(w, result)
@@ -549,11 +653,27 @@ func handleNginxReload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := exec.Command("nginx", "-s", "reload")
-	output, err := cmd.CombinedOutput()
+	// Optional safe mode: probe health afterwards and roll back on failure
+	var req struct {
+		Safe   bool          `json:"safe"`
+		Probes []HealthProbe `json:"probes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendError(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Safe {
+		sendJSON(w, safeReload(req.Probes))
+		return
+	}
+
+	output, err := signalNginx("reload")
 
 	result := map[string]interface{}{
-		"output": string(output),
+		"output": output,
 		"success": err == nil,
 	}
 
@@ -567,16 +687,18 @@ func handleAccessLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lines := r.URL.Query().Get("lines")
-	if lines == "" {
-		lines = "100"
+	logPath, err := selectLogPath(r, "access_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
 	}
 
-	logPath := findLogPath("access_log")
-	content := readLastLines(logPath, lines)
+	if r.URL.Query().Get("parse") == "true" {
+		serveAccessRecords(w, r, logPath)
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(content))
+	serveLog(w, r, logPath, 100)
 }
 
 // Get error log
@@ -586,35 +708,18 @@ func handleErrorLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lines := r.URL.Query().Get("lines")
-	if lines == "" {
-		lines = "100"
-	}
-
-	logPath := findLogPath("error_log")
-	content := readLastLines(logPath, lines)
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(content))
-}
-
-// Get certificate obtain log
-func handleCertObtainLog(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	logPath, err := selectLogPath(r, "error_log")
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	lines := r.URL.Query().Get("lines")
-	if lines == "" {
-		lines = "500"
+	if r.URL.Query().Get("parse") == "true" {
+		serveErrorRecords(w, r, logPath)
+		return
 	}
 
-	logPath := "/var/log/cert-obtain.log"
-	content := readLastLines(logPath, lines)
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(content))
+	serveLog(w, r, logPath, 100)
 }
 
 // Delete certificate
@@ -627,6 +732,7 @@ func handleDeleteCertificate(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		CertFile string `json:"certFile"`
 		KeyFile  string `json:"keyFile"`
+		Force    bool   `json:"force"` // Delete even if vhosts still use it
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -646,6 +752,28 @@ func handleDeleteCertificate(w http.ResponseWriter, r *http.Request) {
 		sendError(w, "Certificate file must be in ssl directory", http.StatusForbidden)
 		return
 	}
+	if req.KeyFile != "" && !strings.HasPrefix(filepath.Clean(req.KeyFile), sslDir) {
+		sendError(w, "Key file must be in ssl directory", http.StatusForbidden)
+		return
+	}
+
+	// nginx won't reload once a file it references is gone
+	if !req.Force {
+		usages, err := discoverCertUsages()
+		if err != nil {
+			sendError(w, "Cannot check which vhosts use the certificate: "+err.Error()+"; use force to delete anyway", http.StatusConflict)
+			return
+		}
+		if inUse := certUsagesOf(usages, certPath, req.KeyFile); len(inUse) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":  "Certificate is in use; remove it from the config first or use force",
+				"usedBy": inUse,
+			})
+			return
+		}
+	}
 
 	// Delete certificate file
 	if err := os.Remove(req.CertFile); err != nil {
@@ -657,92 +785,20 @@ func handleDeleteCertificate(w http.ResponseWriter, r *http.Request) {
 
 	// Delete key file if provided
 	if req.KeyFile != "" {
-		keyPath := filepath.Clean(req.KeyFile)
-		if !strings.HasPrefix(keyPath, sslDir) {
-			sendError(w, "Key file must be in ssl directory", http.StatusForbidden)
-			return
-		}
 		if err := os.Remove(req.KeyFile); err != nil && !os.IsNotExist(err) {
 			log.Printf("Warning: Failed to delete key file: %v", err)
 		}
 	}
 
+	// Nothing left to renew
+	forgetManagedCert(strings.TrimSuffix(filepath.Base(certPath), filepath.Ext(certPath)))
+
 	sendJSON(w, map[string]interface{}{
 		"success": true,
 		"message": "Certificate deleted successfully",
 	})
 }
 
-// Find log path from nginx configuration
-func findLogPath(logType string) string {
-	// Default paths
-	defaultPaths := map[string]string{
-		"access_log": "/var/log/nginx/access.log",
-		"error_log":  "/var/log/nginx/error.log",
-	}
-
-	// Try to find nginx.conf in config directory
-	nginxConf := filepath.Join(configDir, "nginx.conf")
-	if _, err := os.Stat(nginxConf); err != nil {
-		// Try common nginx config locations
-		nginxConf = "/etc/nginx/nginx.conf"
-		if _, err := os.Stat(nginxConf); err != nil {
-			return defaultPaths[logType]
-		}
-	}
-
-	// Parse the config file
-	logPath := parseLogFromConfig(nginxConf, logType)
-	if logPath != "" {
-		return logPath
-	}
-
-	return defaultPaths[logType]
-}
-
-// Parse log path from nginx config file
-func parseLogFromConfig(configPath, logType string) string {
-	file, err := os.Open(configPath)
-	if err != nil {
-		return ""
-	}
-	defer file.Close()
-
-	// Regex to match log directives
-	// access_log /path/to/file [format];
-	// error_log /path/to/file [level];
-	logRegex := regexp.MustCompile(`^\s*` + logType + `\s+([^\s;]+)`)
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Skip comments
-		if strings.HasPrefix(strings.TrimSpace(line), "#") {
-			continue
-		}
-
-		matches := logRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			logPath := matches[1]
-
-			// Skip special values
-			if logPath == "off" || logPath == "syslog:" || strings.HasPrefix(logPath, "syslog:") {
-				continue
-			}
-
-			// Handle relative paths
-			if !filepath.IsAbs(logPath) {
-				logPath = filepath.Join(filepath.Dir(configPath), logPath)
-			}
-
-			return logPath
-		}
-	}
-
-	return ""
-}
-
 // List all certificates
 func handleCertificates(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -750,15 +806,20 @@ func handleCertificates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	certs := listCertificates()
+	if usages, err := discoverCertUsages(); err == nil {
+		attachCertUsages(certs, usages)
+	} else {
+		log.Printf("Warning: Failed to check certificate usage: %v", err)
+	}
+	sendJSON(w, certs)
+}
+
+// Parse every certificate under ssl/
+func listCertificates() []CertificateInfo {
 	certsDir := filepath.Join(configDir, "ssl")
 	certs := []CertificateInfo{}
 
-	// Check if ssl directory exists
-	if _, err := os.Stat(certsDir); os.IsNotExist(err) {
-		sendJSON(w, certs)
-		return
-	}
-
 	// Walk through ssl directory
 	filepath.Walk(certsDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
@@ -775,57 +836,10 @@ func handleCertificates(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	sendJSON(w, certs)
-}
-
-// Parse certificate file
-func parseCertificate(certPath string) *CertificateInfo {
-	// Use openssl to get certificate info
-	cmd := exec.Command("openssl", "x509", "-in", certPath, "-noout", "-subject", "-dates")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil
-	}
-
-	lines := strings.Split(string(output), "\n")
-	info := &CertificateInfo{
-		Path:     certPath,
-		CertFile: certPath,
-	}
-
-	// Find corresponding key file
-	keyPath := strings.TrimSuffix(certPath, filepath.Ext(certPath)) + ".key"
-	if _, err := os.Stat(keyPath); err == nil {
-		info.KeyFile = keyPath
-	}
-
-	for _, line := range lines {
-		if strings.HasPrefix(line, "subject=") {
-			// Extract domain from subject
-			subjectParts := strings.Split(line, "CN = ")
-			if len(subjectParts) > 1 {
-				domain := strings.TrimSpace(subjectParts[1])
-				info.Domain = domain
-				info.IsWildcard = strings.HasPrefix(domain, "*.")
-			}
-		} else if strings.HasPrefix(line, "notBefore=") {
-			info.NotBefore = strings.TrimPrefix(line, "notBefore=")
-		} else if strings.HasPrefix(line, "notAfter=") {
-			notAfter := strings.TrimPrefix(line, "notAfter=")
-			info.NotAfter = notAfter
-
-			// Calculate days left
-			if t, err := time.Parse("Jan 2 15:04:05 2006 MST", notAfter); err == nil {
-				daysLeft := int(time.Until(t).Hours() / 24)
-				info.DaysLeft = daysLeft
-			}
-		}
-	}
-
-	return info
+	return certs
 }
 
-// Obtain certificate using acme.sh
+// Start obtaining a certificate from the ACME server as a background job
 func handleObtainCertificate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -838,24 +852,9 @@ func handleObtainCertificate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log file for certificate operations
-	logFile := "/var/log/cert-obtain.log"
-	logCertOp := func(message string) {
-		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err == nil {
-			defer f.Close()
-			f.WriteString(fmt.Sprintf("%s: %s\n", time.Now().Format(time.RFC3339), message))
-		}
-		log.Println(message) // Also log to stdout
-	}
-
-	logCertOp(fmt.Sprintf("========================================\nCertificate obtain request started - Domains: %v, Challenge: %s, Provider: %s, Staging: %v, Force: %v",
-		req.Domains, req.Challenge, req.Provider, req.Staging, req.Force))
-
 	// Validate request
-	if len(req.Domains) == 0 || req.Email == "" {
-		logCertOp("ERROR: At least one domain and email are required")
-		sendError(w, "At least one domain and email are required", http.StatusBadRequest)
+	if len(req.Domains) == 0 {
+		sendError(w, "At least one domain is required", http.StatusBadRequest)
 		return
 	}
 
@@ -864,205 +863,29 @@ func handleObtainCertificate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Challenge == "dns-01" && req.Provider == "" {
-		sendError(w, "DNS provider is required for dns-01 challenge", http.StatusBadRequest)
-		return
-	}
-
-	// Prepare acme.sh directory
-	acmeDir := "/root/.acme.sh"
-	os.MkdirAll(acmeDir, 0755)
-
-	// Prepare certificate output directory
-	sslDir := filepath.Join(configDir, "ssl")
-	os.MkdirAll(sslDir, 0755)
-
-	// Build acme.sh command
-	args := []string{
-		"--issue",
-		"--email", req.Email,
-		"--debug", // Add debug output
-	}
-
-	// Add force flag if requested
-	if req.Force {
-		args = append(args, "--force")
-		logCertOp("Force renewal enabled")
-	}
-
-	// Add all domains
-	for _, domain := range req.Domains {
-		args = append(args, "--domain", domain)
-		logCertOp(fmt.Sprintf("Adding domain: %s", domain))
-	}
-
-	// Use staging server if requested (for testing)
-	if req.Staging {
-		args = append(args, "--server", "letsencrypt_test")
-		logCertOp("Using Let's Encrypt STAGING server (test certificates)")
-	} else {
-		args = append(args, "--server", "letsencrypt")
-		logCertOp("Using Let's Encrypt production server")
-	}
-
-	// Add challenge type
-	if req.Challenge == "http-01" {
-		args = append(args, "--webroot", "/var/www/html")
-	} else if req.Challenge == "dns-01" {
-		// Convert provider name to acme.sh format (usually dns_<provider>)
-		dnsProvider := "dns_" + strings.ToLower(req.Provider)
-		args = append(args, "--dns", dnsProvider)
-	} else if req.Challenge == "tls-alpn-01" {
-		args = append(args, "--alpn")
-	}
-
-	logCertOp(fmt.Sprintf("Acme.sh command: acme.sh %s", strings.Join(args, " ")))
-
-	// Set environment variables for DNS providers
-	cmd := exec.Command("acme.sh", args...)
-	env := os.Environ()
-
-	// Add all credentials as environment variables
-	if req.Challenge == "dns-01" {
-		// Map provider names to acme.sh environment variable names
-		envVarMap := map[string]string{
-			"duckdns":    "DuckDNS_Token",
-			"cloudflare": "CF_Token", // or CF_Key/CF_Email
-			"digitalocean": "DO_API_KEY",
-			"godaddy":    "GD_Key", // and GD_Secret
-			"namecheap":  "NAMECHEAP_API_USER", // and NAMECHEAP_API_KEY
-			// Add other providers as needed
-		}
-
-		for key, value := range req.Credentials {
-			if value != "" {
-				// Use mapped env var name if available, otherwise use the key as-is
-				envVarName := key
-				if mapped, exists := envVarMap[strings.ToLower(req.Provider)]; exists {
-					envVarName = mapped
-				}
-				env = append(env, envVarName+"="+value)
-				logCertOp(fmt.Sprintf("Setting environment variable: %s", envVarName))
-			}
-		}
-		logCertOp("DNS-01 challenge selected")
-	}
-
-	cmd.Env = env
-
-	// Execute acme.sh with timeout
-	logCertOp("Executing acme.sh command...")
-
-	// Create a channel to signal command completion
-	done := make(chan error, 1)
-	var output []byte
-
-	go func() {
-		var err error
-		output, err = cmd.CombinedOutput()
-		done <- err
-	}()
-
-	// Wait for command to complete or timeout (10 minutes for DNS-01, 2 minutes for HTTP-01)
-	timeout := 2 * time.Minute
-	if req.Challenge == "dns-01" {
-		timeout = 10 * time.Minute
-		logCertOp("Using 10-minute timeout for DNS-01 challenge")
-	} else {
-		logCertOp("Using 2-minute timeout for HTTP-01 challenge")
-	}
-
-	var err error
-	select {
-	case err = <-done:
-		// Command completed
-		logCertOp(fmt.Sprintf("Acme.sh command completed. Output length: %d bytes", len(output)))
-	case <-time.After(timeout):
-		cmd.Process.Kill()
-		err = fmt.Errorf("certificate obtain timeout after %v", timeout)
-		logCertOp(fmt.Sprintf("ERROR: %s", err.Error()))
-	}
-
-	// Log output
-	logCertOp(fmt.Sprintf("Acme.sh output:\n%s", string(output)))
-
-	if err != nil {
-		logCertOp(fmt.Sprintf("ERROR: Certificate obtain failed: %v", err))
-		sendJSON(w, map[string]interface{}{
-			"success": false,
-			"output":  string(output),
-			"error":   err.Error(),
-		})
+	if req.Challenge == "dns-01" && req.Provider == "" && req.CredentialProfile == "" {
+		sendError(w, "DNS provider or credential profile is required for dns-01 challenge", http.StatusBadRequest)
 		return
 	}
-
-	// Copy certificates to ssl directory
-	// acme.sh stores certs in ~/.acme.sh/domain_ecc/
-	// Use the first domain as the primary domain for certificate storage
-	primaryDomain := req.Domains[0]
-
-	// For source paths, use the actual domain name (acme.sh keeps wildcard in folder names)
-	sourceDomain := primaryDomain
-
-	// For destination paths, remove wildcard prefix to create clean filenames
-	destDomain := primaryDomain
-	if strings.HasPrefix(destDomain, "*.") {
-		destDomain = destDomain[2:]
-	}
-
-	domainDir := sourceDomain + "_ecc"
-	// acme.sh uses fullchain.cer for the certificate (without domain prefix)
-	// but uses domain.key for the key file (with full domain name including wildcard)
-	certSource := filepath.Join(acmeDir, domainDir, "fullchain.cer")
-	keySource := filepath.Join(acmeDir, domainDir, sourceDomain+".key")
-
-	certDest := filepath.Join(sslDir, destDomain+".crt")
-	keyDest := filepath.Join(sslDir, destDomain+".key")
-
-	logCertOp(fmt.Sprintf("Copying certificates from %s to %s", certSource, certDest))
-
-	// Copy cert file
-	if data, err := os.ReadFile(certSource); err == nil {
-		if err := os.WriteFile(certDest, data, 0644); err != nil {
-			logCertOp(fmt.Sprintf("ERROR: Failed to write cert file: %v", err))
-		} else {
-			logCertOp(fmt.Sprintf("Successfully copied certificate to %s", certDest))
-		}
-	} else {
-		logCertOp(fmt.Sprintf("ERROR: Failed to read cert file: %v", err))
-	}
-
-	// Copy key file
-	if data, err := os.ReadFile(keySource); err == nil {
-		if err := os.WriteFile(keyDest, data, 0600); err != nil {
-			logCertOp(fmt.Sprintf("ERROR: Failed to write key file: %v", err))
-		} else {
-			logCertOp(fmt.Sprintf("Successfully copied key to %s", keyDest))
+	if req.Challenge == "dns-01" && req.CredentialProfile != "" {
+		if _, _, err := resolveDNSCredentials(req); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	} else {
-		logCertOp(fmt.Sprintf("ERROR: Failed to read key file: %v", err))
 	}
 
-	logCertOp(fmt.Sprintf("Certificate obtain completed successfully for domains: %v\n========================================", req.Domains))
+	job := startCertJob("obtain", req)
 
-	sendJSON(w, map[string]interface{}{
-		"success":  true,
-		"output":   string(output),
-		"certFile": certDest,
-		"keyFile":  keyDest,
+	w.Header().Set("Location", "/api/certificates/jobs?id="+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"jobId":   job.ID,
+		"job":     certJobSnapshot(job.ID, false),
 	})
 }
 
-// Read last N lines of a file
-func readLastLines(filePath, lines string) string {
-	cmd := exec.Command("tail", "-n", lines, filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Sprintf("Error reading log: %v", err)
-	}
-	return string(output)
-}
-
 // Dashboard handlers
 
 // Get system stats
@@ -1077,6 +900,7 @@ func handleSystemStats(w http.ResponseWriter, r *http.Request) {
 		Memory:  getMemoryStats(),
 		Disk:    getDiskStats(),
 		Network: getNetworkStats(),
+		Nginx:   getNginxMetrics(),
 	}
 
 	sendJSON(w, stats)
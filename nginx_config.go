@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Effective config types
+type ConfigSection struct {
+	File     string `json:"file"`
+	Path     string `json:"path,omitempty"` // Relative to configDir when the file lives inside it
+	External bool   `json:"external"`       // Loaded by nginx from outside configDir
+	Modified bool   `json:"modified"`       // On-disk content differs from what nginx loaded
+	Lines    int    `json:"lines"`
+	Content  string `json:"content"`
+}
+
+type ConfigLine struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Depth int    `json:"depth"` // Include nesting depth
+	Text  string `json:"text"`
+}
+
+type EffectiveConfig struct {
+	MainFile string          `json:"mainFile"`
+	Sections []ConfigSection `json:"sections"`
+	Lines    []ConfigLine    `json:"lines"`
+	Unused   []string        `json:"unused"` // Files under configDir that nginx did not load
+	Output   string          `json:"output"` // nginx -T stderr (syntax check messages)
+}
+
+var dumpSectionRegex = regexp.MustCompile(`^# configuration file (.+):$`)
+
+// maxIncludeDepth guards against include cycles when expanding the dump
+const maxIncludeDepth = 16
+
+// Get effective (merged) nginx configuration
+func handleNginxEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, err := loadEffectiveConfig()
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Optional search filter over the expanded lines
+	if q := r.URL.Query().Get("q"); q != "" {
+		matcher, err := lineMatcher(q, r.URL.Query().Get("regex") == "true")
+		if err != nil {
+			sendError(w, "Invalid search pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filtered := []ConfigLine{}
+		for _, line := range cfg.Lines {
+			if matcher(line.Text) {
+				filtered = append(filtered, line)
+			}
+		}
+		cfg.Lines = filtered
+	}
+
+	// Plain text output is easy to grep and diff
+	if r.URL.Query().Get("format") == "text" {
+		var buf bytes.Buffer
+		for _, line := range cfg.Lines {
+			fmt.Fprintf(&buf, "%s:%d: %s%s\n", line.File, line.Line, strings.Repeat("    ", line.Depth), line.Text)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	sendJSON(w, cfg)
+}
+
+// Run nginx -T and build the effective configuration
+func loadEffectiveConfig() (*EffectiveConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("nginx", "-T")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nginx -T failed: %v\n%s", err, stderr.String())
+	}
+
+	files, order := splitNginxDump(stdout.String())
+	if len(order) == 0 {
+		return nil, fmt.Errorf("nginx -T produced no configuration sections")
+	}
+
+	cfg := &EffectiveConfig{
+		MainFile: order[0],
+		Sections: []ConfigSection{},
+		Lines:    []ConfigLine{},
+		Unused:   []string{},
+		Output:   stderr.String(),
+	}
+
+	loaded := map[string]bool{}
+	for _, file := range order {
+		content := strings.Join(files[file], "\n")
+		section := ConfigSection{
+			File:    file,
+			Lines:   len(files[file]),
+			Content: content,
+		}
+		if rel, ok := configRelPath(file); ok {
+			section.Path = rel
+		} else {
+			section.External = true
+		}
+		if data, err := os.ReadFile(file); err == nil {
+			section.Modified = strings.TrimRight(string(data), "\n") != content
+		}
+		cfg.Sections = append(cfg.Sections, section)
+		loaded[file] = true
+	}
+
+	expandDump(files, order, order[0], 0, &cfg.Lines)
+
+	// Files under configDir that nginx never loaded
+	filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !loaded[path] && strings.HasSuffix(path, ".conf") {
+			rel, _ := configRelPath(path)
+			cfg.Unused = append(cfg.Unused, rel)
+		}
+		return nil
+	})
+
+	return cfg, nil
+}
+
+// Split nginx -T output into per-file line slices, preserving load order
+func splitNginxDump(dump string) (map[string][]string, []string) {
+	files := map[string][]string{}
+	order := []string{}
+	current := ""
+
+	for _, line := range strings.Split(dump, "\n") {
+		if matches := dumpSectionRegex.FindStringSubmatch(line); matches != nil {
+			current = matches[1]
+			if _, seen := files[current]; !seen {
+				order = append(order, current)
+			}
+			files[current] = []string{}
+			continue
+		}
+		if current != "" {
+			files[current] = append(files[current], line)
+		}
+	}
+
+	// nginx separates sections with a blank line
+	for file, lines := range files {
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		files[file] = lines
+	}
+
+	return files, order
+}
+
+// Inline include directives recursively, annotating every line with its source
+func expandDump(files map[string][]string, order []string, file string, depth int, out *[]ConfigLine) {
+	// Included files follow the line their include directive ends on
+	includes := map[int][]string{}
+	for _, ref := range findIncludes(strings.Join(files[file], "\n")) {
+		includes[ref.line] = append(includes[ref.line], ref.pattern)
+	}
+
+	for i, text := range files[file] {
+		*out = append(*out, ConfigLine{File: file, Line: i + 1, Depth: depth, Text: text})
+		if depth >= maxIncludeDepth {
+			continue
+		}
+
+		for _, pattern := range includes[i+1] {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(order[0]), pattern)
+			}
+
+			// nginx expands globs in sorted order
+			included := []string{}
+			for _, candidate := range order {
+				if ok, _ := filepath.Match(pattern, candidate); ok {
+					included = append(included, candidate)
+				}
+			}
+			sort.Strings(included)
+
+			for _, inc := range included {
+				expandDump(files, order, inc, depth+1, out)
+			}
+		}
+	}
+}
+
+// Return path relative to configDir (with leading slash) if it lives inside it
+func configRelPath(path string) (string, bool) {
+	rel, err := filepath.Rel(configDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return "/" + rel, true
+}
+
+// Build a line matcher from a substring or regular expression
+func lineMatcher(q string, isRegex bool) (func(string) bool, error) {
+	if !isRegex {
+		lower := strings.ToLower(q)
+		return func(s string) bool {
+			return strings.Contains(strings.ToLower(s), lower)
+		}, nil
+	}
+	re, err := regexp.Compile(q)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
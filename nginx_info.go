@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NginxInfo struct {
+	Version       string          `json:"version"`
+	BuiltBy       string          `json:"builtBy,omitempty"`
+	BuiltWith     string          `json:"builtWith,omitempty"`
+	ConfigureArgs []string        `json:"configureArgs"`
+	Modules       []string        `json:"modules"`
+	Features      map[string]bool `json:"features"`
+}
+
+var (
+	nginxInfoCache     *NginxInfo
+	nginxInfoBinaryMod time.Time
+	nginxInfoLock      sync.Mutex
+)
+
+// Well-known module names mapped from the shared object or add-module
+// directory names they ship under
+var thirdPartyModules = map[string]string{
+	"ngx_http_brotli_filter_module":       "brotli",
+	"ngx_http_brotli_static_module":       "brotli",
+	"ngx_brotli":                          "brotli",
+	"ngx_http_headers_more_filter_module": "headers_more",
+	"headers-more-nginx-module":           "headers_more",
+	"ngx_http_geoip_module":               "http_geoip",
+	"ngx_stream_geoip_module":             "stream_geoip",
+	"ngx_http_geoip2_module":              "geoip2",
+	"ngx_stream_module":                   "stream",
+}
+
+// Get nginx version and compiled modules
+func handleNginxInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := getNginxInfo()
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, info)
+}
+
+// Return cached nginx -V details, refreshed when the binary changes
+func getNginxInfo() (*NginxInfo, error) {
+	nginxInfoLock.Lock()
+	defer nginxInfoLock.Unlock()
+
+	var binaryMod time.Time
+	if path, err := exec.LookPath("nginx"); err == nil {
+		if st, err := os.Stat(path); err == nil {
+			binaryMod = st.ModTime()
+		}
+	}
+	if nginxInfoCache != nil && binaryMod.Equal(nginxInfoBinaryMod) {
+		return nginxInfoCache, nil
+	}
+
+	output, err := exec.Command("nginx", "-V").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nginx -V failed: %v", err)
+	}
+
+	info := parseNginxV(string(output))
+	nginxInfoCache = info
+	nginxInfoBinaryMod = binaryMod
+	return info, nil
+}
+
+// Parse nginx -V output
+func parseNginxV(output string) *NginxInfo {
+	info := &NginxInfo{
+		ConfigureArgs: []string{},
+		Modules:       []string{},
+		Features:      map[string]bool{},
+	}
+	modules := map[string]bool{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "nginx version:"):
+			version := strings.TrimSpace(strings.TrimPrefix(line, "nginx version:"))
+			if idx := strings.Index(version, "/"); idx >= 0 {
+				version = version[idx+1:]
+			}
+			// Strip vendor suffixes such as "1.24.0 (Ubuntu)"
+			info.Version = strings.Fields(version + " ")[0]
+		case strings.HasPrefix(line, "built by"):
+			info.BuiltBy = strings.TrimPrefix(line, "built by ")
+		case strings.HasPrefix(line, "built with"):
+			info.BuiltWith = strings.TrimPrefix(line, "built with ")
+		case strings.HasPrefix(line, "configure arguments:"):
+			info.ConfigureArgs = strings.Fields(strings.TrimPrefix(line, "configure arguments:"))
+		}
+	}
+
+	modulesPath := ""
+	for _, arg := range info.ConfigureArgs {
+		key, value, _ := strings.Cut(arg, "=")
+		switch {
+		case key == "--with-stream":
+			modules["stream"] = true
+		case strings.HasPrefix(key, "--with-") && strings.HasSuffix(key, "_module"):
+			modules[strings.TrimSuffix(strings.TrimPrefix(key, "--with-"), "_module")] = true
+		case key == "--add-module" || key == "--add-dynamic-module":
+			name := filepath.Base(value)
+			if mapped, ok := thirdPartyModules[name]; ok {
+				name = mapped
+			}
+			modules[name] = true
+		case key == "--modules-path":
+			modulesPath = value
+		}
+	}
+
+	// Distribution packages ship extra dynamic modules as separate .so files
+	if modulesPath == "" {
+		modulesPath = "/usr/lib/nginx/modules"
+	}
+	if entries, err := os.ReadDir(modulesPath); err == nil {
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), ".so")
+			if mapped, ok := thirdPartyModules[name]; ok {
+				modules[mapped] = true
+			} else if strings.HasPrefix(name, "ngx_") && strings.HasSuffix(name, "_module") {
+				modules[strings.TrimSuffix(strings.TrimPrefix(name, "ngx_"), "_module")] = true
+			}
+		}
+	}
+
+	for name := range modules {
+		info.Modules = append(info.Modules, name)
+	}
+	sort.Strings(info.Modules)
+
+	info.Features["http2"] = modules["http_v2"]
+	info.Features["http3"] = modules["http_v3"]
+	info.Features["http2Directive"] = modules["http_v2"] && versionAtLeast(info.Version, 1, 25, 1)
+	info.Features["stream"] = modules["stream"]
+	info.Features["ssl"] = modules["http_ssl"]
+	info.Features["geoip"] = modules["http_geoip"] || modules["geoip2"]
+	info.Features["brotli"] = modules["brotli"]
+	info.Features["headersMore"] = modules["headers_more"]
+
+	return info
+}
+
+// Compare a dotted version string against major.minor.patch
+func versionAtLeast(version string, major, minor, patch int) bool {
+	want := []int{major, minor, patch}
+	parts := strings.Split(version, ".")
+	for i := 0; i < len(want); i++ {
+		have := 0
+		if i < len(parts) {
+			have, _ = strconv.Atoi(parts[i])
+		}
+		if have != want[i] {
+			return have > want[i]
+		}
+	}
+	return true
+}
+
+// Check the config rooted at mainFile against the running binary's features
+func lintNginxConfig(mainFile string) []ConfigError {
+	info, err := getNginxInfo()
+	if err != nil {
+		return []ConfigError{}
+	}
+	directives, err := parseConfigFile(mainFile, filepath.Dir(mainFile), 0)
+	if err != nil {
+		return []ConfigError{}
+	}
+	return lintConfigFeatures(info, directives)
+}
+
+// Flag directives the running binary does not support
+func lintConfigFeatures(info *NginxInfo, directives []*Directive) []ConfigError {
+	warnings := []ConfigError{}
+	warn := func(d *Directive, message string) {
+		ce := ConfigError{Level: "warn", Message: message, File: d.File, Line: d.Line}
+		if rel, ok := configRelPath(d.File); ok {
+			ce.Path = rel
+		}
+		warnings = append(warnings, ce)
+	}
+
+	walkDirectives(directives, func(d *Directive, parents []*Directive) {
+		switch {
+		case d.Name == "listen":
+			for _, arg := range d.Args[min(1, len(d.Args)):] {
+				switch arg {
+				case "http2":
+					if !info.Features["http2"] {
+						warn(d, "\"listen ... http2\" requires ngx_http_v2_module, which this nginx was built without")
+					} else if info.Features["http2Directive"] {
+						warn(d, "\"listen ... http2\" is deprecated since nginx 1.25.1, use \"http2 on;\" instead")
+					}
+				case "quic":
+					if !info.Features["http3"] {
+						warn(d, "\"listen ... quic\" requires ngx_http_v3_module, which this nginx was built without")
+					}
+				}
+			}
+		case d.Name == "http2":
+			if !info.Features["http2Directive"] {
+				warn(d, fmt.Sprintf("\"http2\" directive requires nginx 1.25.1 with ngx_http_v2_module (found %s)", info.Version))
+			}
+		case d.Name == "http3" && !info.Features["http3"]:
+			warn(d, "\"http3\" directive requires ngx_http_v3_module")
+		case d.Name == "stream" && len(parents) == 0 && !info.Features["stream"]:
+			warn(d, "\"stream\" block requires the stream module")
+		case strings.HasPrefix(d.Name, "brotli") && !info.Features["brotli"]:
+			warn(d, fmt.Sprintf("\"%s\" requires the brotli module", d.Name))
+		case strings.HasPrefix(d.Name, "more_") && !info.Features["headersMore"]:
+			warn(d, fmt.Sprintf("\"%s\" requires the headers-more module", d.Name))
+		case strings.HasPrefix(d.Name, "geoip_") && !info.Features["geoip"]:
+			warn(d, fmt.Sprintf("\"%s\" requires the GeoIP module", d.Name))
+		}
+	})
+
+	return warnings
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StubStatusSettings struct {
+	Enabled  bool   `json:"enabled"`
+	URL      string `json:"url"`      // stub_status URL to scrape
+	Managed  bool   `json:"managed"`  // Let server-manager maintain a local-only status location
+	Port     int    `json:"port"`     // Listen port for the managed location
+	Interval int    `json:"interval"` // Scrape interval in seconds
+}
+
+type NginxMetrics struct {
+	Active            uint64  `json:"active"`
+	Reading           uint64  `json:"reading"`
+	Writing           uint64  `json:"writing"`
+	Waiting           uint64  `json:"waiting"`
+	Accepts           uint64  `json:"accepts"`
+	Handled           uint64  `json:"handled"`
+	Requests          uint64  `json:"requests"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	UpdatedAt         string  `json:"updatedAt"`
+	Error             string  `json:"error,omitempty"`
+}
+
+var (
+	stubStatusSettings = StubStatusSettings{Port: 8081, Interval: 5}
+	stubStatusLock     sync.RWMutex
+	stubStatusFile     = filepath.Join("/app/data", "stub-status.json")
+
+	nginxMetrics     *NginxMetrics
+	nginxMetricsLock sync.RWMutex
+	lastStubRequests uint64
+	lastStubTime     time.Time
+)
+
+const managedStatusConf = "conf.d/server-manager-status.conf"
+
+// Get current nginx connection metrics
+func handleNginxMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	metrics := getNginxMetrics()
+	if metrics == nil {
+		sendError(w, "stub_status collection is not enabled", http.StatusNotFound)
+		return
+	}
+
+	sendJSON(w, metrics)
+}
+
+// Get or update stub_status settings
+func handleNginxMetricsSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stubStatusLock.RLock()
+		defer stubStatusLock.RUnlock()
+		sendJSON(w, stubStatusSettings)
+	case http.MethodPost:
+		var settings StubStatusSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Interval <= 0 {
+			settings.Interval = 5
+		}
+		if settings.Port <= 0 {
+			settings.Port = 8081
+		}
+
+		if settings.Enabled && settings.Managed {
+			if err := writeManagedStatusLocation(settings.Port); err != nil {
+				sendError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			settings.URL = fmt.Sprintf("http://127.0.0.1:%d/nginx_status", settings.Port)
+		} else if err := removeManagedStatusLocation(); err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if settings.Enabled && settings.URL == "" {
+			sendError(w, "A stub_status URL is required", http.StatusBadRequest)
+			return
+		}
+
+		stubStatusLock.Lock()
+		stubStatusSettings = settings
+		stubStatusLock.Unlock()
+
+		if !settings.Enabled {
+			nginxMetricsLock.Lock()
+			nginxMetrics = nil
+			nginxMetricsLock.Unlock()
+		}
+
+		if err := saveStubStatusSettings(); err != nil {
+			log.Printf("Warning: Failed to save stub_status settings: %v", err)
+		}
+
+		sendJSON(w, map[string]interface{}{"status": "ok", "settings": settings})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Stub status settings persistence
+func saveStubStatusSettings() error {
+	stubStatusLock.RLock()
+	defer stubStatusLock.RUnlock()
+
+	data, err := json.MarshalIndent(stubStatusSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(stubStatusFile, data, 0644)
+}
+
+func loadStubStatusSettings() error {
+	data, err := os.ReadFile(stubStatusFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	stubStatusLock.Lock()
+	defer stubStatusLock.Unlock()
+
+	return json.Unmarshal(data, &stubStatusSettings)
+}
+
+// Write a localhost-only stub_status server and reload nginx
+func writeManagedStatusLocation(port int) error {
+	confPath := filepath.Join(configDir, managedStatusConf)
+	content := fmt.Sprintf(`# Managed by server-manager - local stub_status endpoint
+server {
+    listen 127.0.0.1:%d;
+    server_name localhost;
+    access_log off;
+
+    location = /nginx_status {
+        stub_status;
+        allow 127.0.0.1;
+        deny all;
+    }
+}
+`, port)
+
+	previous, readErr := os.ReadFile(confPath)
+	if readErr == nil && string(previous) == content {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(confPath, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	// Roll back if nginx rejects the new location
+	if err := applyManagedConfig(); err != nil {
+		if readErr == nil {
+			os.WriteFile(confPath, previous, 0644)
+		} else {
+			os.Remove(confPath)
+		}
+		return err
+	}
+	return nil
+}
+
+func removeManagedStatusLocation() error {
+	confPath := filepath.Join(configDir, managedStatusConf)
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(confPath); err != nil {
+		return err
+	}
+	return applyManagedConfig()
+}
+
+// Test and reload after server-manager edits the config itself
+func applyManagedConfig() error {
+	if output, err := execNginxTest(); err != nil {
+		return fmt.Errorf("nginx config test failed: %s", output)
+	}
+	if output, err := signalNginx("reload"); err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
+
+func getNginxMetrics() *NginxMetrics {
+	nginxMetricsLock.RLock()
+	defer nginxMetricsLock.RUnlock()
+
+	if nginxMetrics == nil {
+		return nil
+	}
+	metrics := *nginxMetrics
+	return &metrics
+}
+
+// Scrape stub_status on the configured interval
+func runStubStatusCollector() {
+	for {
+		stubStatusLock.RLock()
+		settings := stubStatusSettings
+		stubStatusLock.RUnlock()
+
+		if settings.Enabled && settings.URL != "" {
+			collectStubStatus(settings.URL)
+		}
+
+		interval := settings.Interval
+		if interval <= 0 {
+			interval = 5
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func collectStubStatus(url string) {
+	metrics, err := scrapeStubStatus(url)
+	now := time.Now()
+	if err != nil {
+		metrics = &NginxMetrics{Error: err.Error()}
+	} else if !lastStubTime.IsZero() && metrics.Requests >= lastStubRequests {
+		if elapsed := now.Sub(lastStubTime).Seconds(); elapsed > 0 {
+			metrics.RequestsPerSecond = float64(metrics.Requests-lastStubRequests) / elapsed
+		}
+	}
+	metrics.UpdatedAt = now.Format(time.RFC3339)
+
+	if err == nil {
+		lastStubRequests = metrics.Requests
+		lastStubTime = now
+	}
+
+	nginxMetricsLock.Lock()
+	nginxMetrics = metrics
+	nginxMetricsLock.Unlock()
+}
+
+func scrapeStubStatus(url string) (*NginxMetrics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stub_status returned %s", resp.Status)
+	}
+
+	return parseStubStatus(resp.Body)
+}
+
+// Parse stub_status output:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func parseStubStatus(r io.Reader) (*NginxMetrics, error) {
+	metrics := &NginxMetrics{}
+	scanner := bufio.NewScanner(r)
+	found := false
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+
+		switch {
+		case strings.HasPrefix(line, "Active connections:") && len(fields) >= 3:
+			metrics.Active, _ = strconv.ParseUint(fields[2], 10, 64)
+			found = true
+		case strings.HasPrefix(line, "Reading:") && len(fields) >= 6:
+			metrics.Reading, _ = strconv.ParseUint(fields[1], 10, 64)
+			metrics.Writing, _ = strconv.ParseUint(fields[3], 10, 64)
+			metrics.Waiting, _ = strconv.ParseUint(fields[5], 10, 64)
+		case len(fields) == 3:
+			if accepts, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+				metrics.Accepts = accepts
+				metrics.Handled, _ = strconv.ParseUint(fields[1], 10, 64)
+				metrics.Requests, _ = strconv.ParseUint(fields[2], 10, 64)
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("response is not stub_status output")
+	}
+	return metrics, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directive is a single parsed nginx directive. Include directives keep the
+// directives of the files they pulled in as their block.
+type Directive struct {
+	Name  string       `json:"name"`
+	Args  []string     `json:"args"`
+	File  string       `json:"file"`
+	Line  int          `json:"line"`
+	Block []*Directive `json:"block,omitempty"`
+}
+
+// Find the main nginx.conf, preferring the managed config directory
+func findMainConfig() string {
+	nginxConf := filepath.Join(configDir, "nginx.conf")
+	if _, err := os.Stat(nginxConf); err != nil {
+		return "/etc/nginx/nginx.conf"
+	}
+	return nginxConf
+}
+
+// Parse the main config and everything it includes
+func parseNginxConfig() ([]*Directive, error) {
+	mainFile := findMainConfig()
+	return parseConfigFile(mainFile, filepath.Dir(mainFile), 0)
+}
+
+func parseConfigFile(path, prefix string, depth int) ([]*Directive, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("include depth exceeded at %s", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := tokenizeConfig(string(data))
+	pos := 0
+	directives, err := parseBlock(tokens, &pos, path, prefix, depth, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return directives, nil
+}
+
+type configToken struct {
+	text   string
+	line   int
+	quoted bool
+}
+
+func parseBlock(tokens []configToken, pos *int, file, prefix string, depth int, nested bool) ([]*Directive, error) {
+	directives := []*Directive{}
+	var current *Directive
+
+	for *pos < len(tokens) {
+		tok := tokens[*pos]
+		*pos++
+
+		if !tok.quoted {
+			switch tok.text {
+			case ";":
+				if current == nil {
+					return nil, fmt.Errorf("unexpected \";\" on line %d", tok.line)
+				}
+				if current.Name == "include" && len(current.Args) == 1 {
+					current.Block = resolveInclude(current.Args[0], prefix, depth)
+				}
+				directives = append(directives, current)
+				current = nil
+				continue
+			case "{":
+				if current == nil {
+					return nil, fmt.Errorf("unexpected \"{\" on line %d", tok.line)
+				}
+				block, err := parseBlock(tokens, pos, file, prefix, depth, true)
+				if err != nil {
+					return nil, err
+				}
+				current.Block = block
+				directives = append(directives, current)
+				current = nil
+				continue
+			case "}":
+				if !nested {
+					return nil, fmt.Errorf("unexpected \"}\" on line %d", tok.line)
+				}
+				return directives, nil
+			}
+		}
+
+		if current == nil {
+			current = &Directive{Name: tok.text, Args: []string{}, File: file, Line: tok.line}
+		} else {
+			current.Args = append(current.Args, tok.text)
+		}
+	}
+
+	if nested {
+		return nil, fmt.Errorf("unexpected end of file, expecting \"}\"")
+	}
+	return directives, nil
+}
+
+// Load every file matched by an include pattern; unreadable files are skipped
+// the same way a missing glob match is
+func resolveInclude(pattern, prefix string, depth int) []*Directive {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(prefix, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil
+	}
+	sort.Strings(matches)
+
+	included := []*Directive{}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || info.IsDir() {
+			continue
+		}
+		directives, err := parseConfigFile(match, prefix, depth+1)
+		if err != nil {
+			continue
+		}
+		included = append(included, directives...)
+	}
+	return included
+}
+
+// Split config text into words, quoted strings and ; { } punctuation
+func tokenizeConfig(text string) []configToken {
+	tokens := []configToken{}
+	line := 1
+	i := 0
+
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, configToken{text: string(c), line: line})
+			i++
+		case c == '"' || c == '\'':
+			start := line
+			var sb strings.Builder
+			i++
+			for i < len(text) && text[i] != c {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				if text[i] == '\n' {
+					line++
+				}
+				sb.WriteByte(text[i])
+				i++
+			}
+			i++ // closing quote
+			tokens = append(tokens, configToken{text: sb.String(), line: start, quoted: true})
+		default:
+			var sb strings.Builder
+			for i < len(text) {
+				c := text[i]
+				if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '}' {
+					break
+				}
+				// ${var} is part of the word, a bare { opens a block
+				if c == '{' {
+					if i == 0 || text[i-1] != '$' {
+						break
+					}
+					for i < len(text) && text[i] != '}' {
+						sb.WriteByte(text[i])
+						i++
+					}
+					if i >= len(text) {
+						break
+					}
+				}
+				if c == '\\' && i+1 < len(text) {
+					sb.WriteByte(c)
+					i++
+				}
+				sb.WriteByte(text[i])
+				i++
+			}
+			tokens = append(tokens, configToken{text: sb.String(), line: line})
+		}
+	}
+
+	return tokens
+}
+
+// An include directive found in config text, left unresolved
+type includeRef struct {
+	pattern string
+	line    int // Line of the pattern
+}
+
+// Find include directives wherever they sit: after another directive on
+// the same line, inside a one-line block or split over several lines
+func findIncludes(text string) []includeRef {
+	tokens := tokenizeConfig(text)
+	punct := func(tok configToken) bool {
+		return !tok.quoted && (tok.text == ";" || tok.text == "{" || tok.text == "}")
+	}
+
+	refs := []includeRef{}
+	start := true
+	for i, tok := range tokens {
+		if punct(tok) {
+			start = true
+			continue
+		}
+		if !start {
+			continue
+		}
+		start = false
+		if tok.quoted || tok.text != "include" || i+2 >= len(tokens) {
+			continue
+		}
+		if arg, end := tokens[i+1], tokens[i+2]; !punct(arg) && !end.quoted && end.text == ";" {
+			refs = append(refs, includeRef{pattern: arg.text, line: arg.line})
+		}
+	}
+	return refs
+}
+
+// Walk directives depth-first. Include directives are transparent: their
+// contents are visited with the includer's parents, and the include itself
+// is not reported.
+func walkDirectives(directives []*Directive, fn func(d *Directive, parents []*Directive)) {
+	walkDirectivesWith(directives, nil, fn)
+}
+
+func walkDirectivesWith(directives []*Directive, parents []*Directive, fn func(d *Directive, parents []*Directive)) {
+	for _, d := range directives {
+		if d.Name == "include" {
+			walkDirectivesWith(d.Block, parents, fn)
+			continue
+		}
+		fn(d, parents)
+		if len(d.Block) > 0 {
+			// Copy so callbacks can keep the slice
+			next := make([]*Directive, len(parents), len(parents)+1)
+			copy(next, parents)
+			walkDirectivesWith(d.Block, append(next, d), fn)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type NginxStatus struct {
+	Running    bool   `json:"running"`
+	PID        int    `json:"pid,omitempty"`
+	PIDFile    string `json:"pidFile"`
+	Workers    int    `json:"workers"`
+	WorkerPIDs []int  `json:"workerPids"`
+	StartedAt  string `json:"startedAt,omitempty"`
+	Uptime     int64  `json:"uptime,omitempty"` // seconds
+	Version    string `json:"version,omitempty"`
+	LastReload string `json:"lastReload,omitempty"`
+}
+
+var (
+	lastNginxReload     time.Time
+	lastNginxReloadLock sync.Mutex
+
+	// The [program:...] name nginx runs under in supervisord.conf
+	nginxSupervisorProgram = "nginx"
+)
+
+// Get nginx process status
+func handleNginxStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendJSON(w, getNginxStatus())
+}
+
+// Lifecycle handlers
+func handleNginxStart(w http.ResponseWriter, r *http.Request) {
+	nginxAction(w, r, "start")
+}
+
+func handleNginxStop(w http.ResponseWriter, r *http.Request) {
+	nginxAction(w, r, "stop")
+}
+
+func handleNginxQuit(w http.ResponseWriter, r *http.Request) {
+	nginxAction(w, r, "quit")
+}
+
+func handleNginxReopen(w http.ResponseWriter, r *http.Request) {
+	nginxAction(w, r, "reopen")
+}
+
+func handleNginxUpgrade(w http.ResponseWriter, r *http.Request) {
+	nginxAction(w, r, "upgrade")
+}
+
+// Generic nginx lifecycle action handler
+func nginxAction(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var output string
+	var err error
+	switch {
+	case action == "upgrade":
+		output, err = upgradeNginxBinary()
+	case nginxSupervised():
+		output, err = supervisorNginxAction(action)
+	case action == "start":
+		output, err = startNginx()
+	default:
+		output, err = signalNginx(action)
+	}
+
+	result := map[string]interface{}{
+		"success": err == nil,
+		"output":  output,
+		"status":  getNginxStatus(),
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+
+	sendJSON(w, result)
+}
+
+// Send a control signal via nginx -s (stop, quit, reopen, reload). A
+// successful reload makes the config the rollback target for safe reloads.
+func signalNginx(signal string) (string, error) {
+	output, err := sendNginxSignal(signal)
+	if err == nil && signal == "reload" {
+		refreshLastGoodConfig()
+	}
+	return output, err
+}
+
+func sendNginxSignal(signal string) (string, error) {
+	cmd := exec.Command("nginx", "-s", signal)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("nginx -s %s failed: %v", signal, err)
+	}
+	if signal == "reload" {
+		lastNginxReloadLock.Lock()
+		lastNginxReload = time.Now()
+		lastNginxReloadLock.Unlock()
+	}
+	return string(output), nil
+}
+
+// Run nginx -t against the live configuration
+func execNginxTest() (string, error) {
+	cmd := exec.Command("nginx", "-t")
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func startNginx() (string, error) {
+	if pid := readNginxPID(findPidPath()); pid > 0 && processAlive(pid) {
+		return "", fmt.Errorf("nginx is already running (pid %d)", pid)
+	}
+
+	cmd := exec.Command("nginx")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("failed to start nginx: %v", err)
+	}
+	refreshLastGoodConfig()
+	return string(output), nil
+}
+
+// Whether supervisord runs nginx, as in the Docker image. It restarts a
+// master that exits, so stopping nginx by signal or starting a second master
+// beside it would fight it.
+func nginxSupervised() bool {
+	if pid := readNginxPID(findPidPath()); pid > 0 && processAlive(pid) {
+		fields := readProcStat(pid)
+		if len(fields) > 1 {
+			cmdline, _ := os.ReadFile("/proc/" + fields[1] + "/cmdline")
+			if strings.Contains(string(cmdline), "supervisord") {
+				return true
+			}
+		}
+	}
+	// Stopped through supervisord: ask it whether it knows the program
+	if os.Getenv("SUPERVISOR_ENABLED") == "" {
+		return false
+	}
+	output, _ := exec.Command("supervisorctl", "status", nginxSupervisorProgram).CombinedOutput()
+	status := string(output)
+	return strings.HasPrefix(status, nginxSupervisorProgram) && !strings.Contains(status, "no such process")
+}
+
+// Start and stop go through supervisorctl so supervisord doesn't undo them;
+// reopen and reload don't restart the master and are signalled as usual
+func supervisorNginxAction(action string) (string, error) {
+	var args []string
+	switch action {
+	case "start":
+		if output, err := execNginxTest(); err != nil {
+			return output, fmt.Errorf("nginx config test failed, not starting")
+		}
+		args = []string{"start", nginxSupervisorProgram}
+	case "stop", "quit":
+		// supervisord sends its configured stop signal either way
+		args = []string{"stop", nginxSupervisorProgram}
+	default:
+		return signalNginx(action)
+	}
+
+	output, err := exec.Command("supervisorctl", args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("supervisorctl %s failed: %v", strings.Join(args, " "), err)
+	}
+	if action == "start" {
+		refreshLastGoodConfig()
+	}
+	return string(output), nil
+}
+
+// Upgrade the running binary in place: USR2 starts a new master,
+// WINCH drains the old workers and QUIT retires the old master
+func upgradeNginxBinary() (string, error) {
+	var steps []string
+	pidFile := findPidPath()
+
+	oldPID := readNginxPID(pidFile)
+	if oldPID <= 0 || !processAlive(oldPID) {
+		return "", fmt.Errorf("nginx is not running")
+	}
+	if nginxSupervised() {
+		// supervisord would restart the retired master into the new one's ports
+		return "", fmt.Errorf("nginx runs under supervisord, which can't follow a binary upgrade; restart it with supervisorctl restart %s instead", nginxSupervisorProgram)
+	}
+
+	// The new binary starts with the current config; don't trade a working
+	// master for one that fails to start
+	if output, err := execNginxTest(); err != nil {
+		return output, fmt.Errorf("nginx config test failed, upgrade skipped")
+	}
+	steps = append(steps, "Config test passed")
+
+	if err := syscall.Kill(oldPID, syscall.SIGUSR2); err != nil {
+		return "", fmt.Errorf("failed to send USR2 to %d: %v", oldPID, err)
+	}
+	steps = append(steps, fmt.Sprintf("Sent USR2 to old master %d", oldPID))
+
+	// The new master rewrites the pid file once it is up
+	newPID := 0
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if pid := readNginxPID(pidFile); pid > 0 && pid != oldPID && processAlive(pid) {
+			newPID = pid
+			break
+		}
+	}
+	if newPID == 0 {
+		return strings.Join(steps, "\n"), fmt.Errorf("new master did not start; old master %d left running", oldPID)
+	}
+	steps = append(steps, fmt.Sprintf("New master started with pid %d", newPID))
+
+	if err := syscall.Kill(oldPID, syscall.SIGWINCH); err != nil {
+		return strings.Join(steps, "\n"), fmt.Errorf("failed to send WINCH to %d: %v", oldPID, err)
+	}
+	steps = append(steps, fmt.Sprintf("Sent WINCH to old master %d", oldPID))
+
+	if err := syscall.Kill(oldPID, syscall.SIGQUIT); err != nil {
+		return strings.Join(steps, "\n"), fmt.Errorf("failed to send QUIT to %d: %v", oldPID, err)
+	}
+	steps = append(steps, fmt.Sprintf("Sent QUIT to old master %d", oldPID))
+
+	return strings.Join(steps, "\n"), nil
+}
+
+func getNginxStatus() NginxStatus {
+	status := NginxStatus{
+		PIDFile:    findPidPath(),
+		WorkerPIDs: []int{},
+	}
+	if info, err := getNginxInfo(); err == nil {
+		status.Version = info.Version
+	}
+
+	pid := readNginxPID(status.PIDFile)
+	if pid <= 0 || !processAlive(pid) {
+		return status
+	}
+
+	status.Running = true
+	status.PID = pid
+
+	if started, ok := processStartTime(pid); ok {
+		status.StartedAt = started.Format(time.RFC3339)
+		status.Uptime = int64(time.Since(started).Seconds())
+	}
+
+	// Workers are respawned on reload, so the youngest one also tells us
+	// when nginx was last reloaded even if it happened outside of this process
+	var newestWorker time.Time
+	for _, child := range childProcesses(pid) {
+		status.WorkerPIDs = append(status.WorkerPIDs, child)
+		if started, ok := processStartTime(child); ok && started.After(newestWorker) {
+			newestWorker = started
+		}
+	}
+	status.Workers = len(status.WorkerPIDs)
+
+	lastNginxReloadLock.Lock()
+	lastReload := lastNginxReload
+	lastNginxReloadLock.Unlock()
+	if newestWorker.After(lastReload) {
+		lastReload = newestWorker
+	}
+	if !lastReload.IsZero() {
+		status.LastReload = lastReload.Format(time.RFC3339)
+	}
+
+	return status
+}
+
+// Find pid file path from nginx configuration
+func findPidPath() string {
+	pidPath := "/var/run/nginx.pid"
+	if directives, err := parseNginxConfig(); err == nil {
+		walkDirectives(directives, func(d *Directive, parents []*Directive) {
+			if d.Name == "pid" && len(parents) == 0 && len(d.Args) == 1 {
+				pidPath = d.Args[0]
+				if !filepath.IsAbs(pidPath) {
+					pidPath = filepath.Join(filepath.Dir(findMainConfig()), pidPath)
+				}
+			}
+		})
+	}
+	return pidPath
+}
+
+func readNginxPID(pidFile string) int {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// List pids whose parent is the given pid
+func childProcesses(parent int) []int {
+	children := []int{}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return children
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fields := readProcStat(pid)
+		if len(fields) > 1 {
+			if ppid, _ := strconv.Atoi(fields[1]); ppid == parent {
+				children = append(children, pid)
+			}
+		}
+	}
+
+	return children
+}
+
+// Read /proc/<pid>/stat fields after the command name
+// (fields[0] is the state, fields[1] the parent pid, fields[19] the start time)
+func readProcStat(pid int) []string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil
+	}
+	// The command name may contain spaces, so split after the closing paren
+	stat := string(data)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return nil
+	}
+	return strings.Fields(stat[idx+1:])
+}
+
+func processStartTime(pid int) (time.Time, bool) {
+	fields := readProcStat(pid)
+	if len(fields) < 20 {
+		return time.Time{}, false
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, false
+	}
+	var bootTime int64
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			bootTime, _ = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "btime ")), 10, 64)
+			break
+		}
+	}
+	if bootTime == 0 {
+		return time.Time{}, false
+	}
+
+	// USER_HZ is 100 on all mainstream Linux builds
+	const clockTicks = 100
+	return time.Unix(bootTime, 0).Add(time.Duration(ticks) * time.Second / clockTicks), true
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HealthProbe struct {
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	Host         string `json:"host,omitempty"`         // Host header / SNI, for probing a vhost via 127.0.0.1
+	ExpectStatus int    `json:"expectStatus,omitempty"` // Defaults to 200
+	BodyContains string `json:"bodyContains,omitempty"`
+	Timeout      int    `json:"timeout,omitempty"` // seconds, defaults to 5
+}
+
+type ProbeResult struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration"` // milliseconds
+}
+
+type SafeReloadSettings struct {
+	Probes      []HealthProbe `json:"probes"`
+	SettleDelay int           `json:"settleDelay"` // seconds to wait after reload before probing
+}
+
+type SafeReloadReport struct {
+	Success        bool          `json:"success"`
+	Output         string        `json:"output"`
+	Probes         []ProbeResult `json:"probes"`
+	RolledBack     bool          `json:"rolledBack"`
+	RollbackOutput string        `json:"rollbackOutput,omitempty"`
+	RollbackProbes []ProbeResult `json:"rollbackProbes,omitempty"`
+	Restored       []string      `json:"restored,omitempty"`       // Files put back from the last good config
+	Removed        []string      `json:"removed,omitempty"`        // Files added since then, kept only in the failed snapshot
+	Kept           []string      `json:"kept,omitempty"`           // Files added since then, left in place when no failed snapshot could be saved
+	FailedSnapshot string        `json:"failedSnapshot,omitempty"` // Copy of the rejected config
+	Error          string        `json:"error,omitempty"`
+}
+
+var (
+	safeReloadSettings = SafeReloadSettings{Probes: []HealthProbe{}, SettleDelay: 2}
+	safeReloadLock     sync.RWMutex
+	safeReloadFile     = filepath.Join("/app/data", "reload-probes.json")
+	configSnapshotDir  = filepath.Join("/app/data", "config-snapshots")
+
+	// Serializes safe reloads so snapshots and rollbacks don't interleave
+	safeReloadRunLock sync.Mutex
+)
+
+// Certificates are managed separately and must never be rolled back
+var snapshotSkip = map[string]bool{"ssl": true}
+
+// Rejected configs kept for inspection
+const maxFailedSnapshots = 10
+
+// Get or update safe reload probes
+func handleReloadProbes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		safeReloadLock.RLock()
+		defer safeReloadLock.RUnlock()
+		sendJSON(w, safeReloadSettings)
+	case http.MethodPost:
+		var settings SafeReloadSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.Probes == nil {
+			settings.Probes = []HealthProbe{}
+		}
+		for _, probe := range settings.Probes {
+			if !strings.HasPrefix(probe.URL, "http://") && !strings.HasPrefix(probe.URL, "https://") {
+				sendError(w, "Probe URL must start with http:// or https://: "+probe.URL, http.StatusBadRequest)
+				return
+			}
+		}
+
+		safeReloadLock.Lock()
+		safeReloadSettings = settings
+		safeReloadLock.Unlock()
+
+		if err := saveSafeReloadSettings(); err != nil {
+			log.Printf("Warning: Failed to save reload probes: %v", err)
+		}
+
+		sendJSON(w, map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Safe reload settings persistence
+func saveSafeReloadSettings() error {
+	safeReloadLock.RLock()
+	defer safeReloadLock.RUnlock()
+
+	data, err := json.MarshalIndent(safeReloadSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(safeReloadFile, data, 0644)
+}
+
+func loadSafeReloadSettings() error {
+	data, err := os.ReadFile(safeReloadFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	safeReloadLock.Lock()
+	defer safeReloadLock.Unlock()
+
+	return json.Unmarshal(data, &safeReloadSettings)
+}
+
+// The running config is assumed good at startup; record it as the
+// rollback target unless an earlier snapshot exists
+func initConfigSnapshot() error {
+	lastGood := filepath.Join(configSnapshotDir, "last-good")
+	if _, err := os.Stat(lastGood); err == nil {
+		return nil
+	}
+	return snapshotConfig(lastGood)
+}
+
+// Record the config as the rollback target after nginx accepted it, so a
+// later safe reload never rolls back past changes that were already live
+func refreshLastGoodConfig() {
+	if output, err := execNginxTest(); err != nil {
+		log.Printf("Warning: Not updating the last good config, nginx config test failed: %s", strings.TrimSpace(output))
+		return
+	}
+
+	safeReloadRunLock.Lock()
+	defer safeReloadRunLock.Unlock()
+	if err := snapshotConfig(filepath.Join(configSnapshotDir, "last-good")); err != nil {
+		log.Printf("Warning: Failed to snapshot config: %v", err)
+	}
+}
+
+// Reload nginx, probe health and roll back to the last good config on failure
+func safeReload(probes []HealthProbe) SafeReloadReport {
+	safeReloadRunLock.Lock()
+	defer safeReloadRunLock.Unlock()
+
+	safeReloadLock.RLock()
+	settle := time.Duration(safeReloadSettings.SettleDelay) * time.Second
+	if probes == nil {
+		probes = safeReloadSettings.Probes
+	}
+	safeReloadLock.RUnlock()
+
+	report := SafeReloadReport{Probes: []ProbeResult{}}
+	lastGood := filepath.Join(configSnapshotDir, "last-good")
+
+	// Never reload a config nginx rejects outright
+	if output, err := execNginxTest(); err != nil {
+		report.Output = output
+		report.Error = "nginx config test failed, reload skipped"
+		return report
+	}
+
+	// The config only becomes the last good one once the probes pass
+	output, err := sendNginxSignal("reload")
+	report.Output = output
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	time.Sleep(settle)
+	report.Probes = runProbes(probes)
+	if probesPassed(report.Probes) {
+		report.Success = true
+		if err := snapshotConfig(lastGood); err != nil {
+			log.Printf("Warning: Failed to snapshot config: %v", err)
+		}
+		return report
+	}
+
+	// Probes failed: keep the broken config for inspection and restore the last good one
+	if _, err := os.Stat(lastGood); err != nil {
+		report.Error = "health probes failed and no previous snapshot exists to roll back to"
+		return report
+	}
+
+	failed := filepath.Join(configSnapshotDir, "failed-"+time.Now().Format("20060102-150405"))
+	if err := snapshotConfig(failed); err != nil {
+		log.Printf("Warning: Failed to save rejected config: %v", err)
+	} else {
+		report.FailedSnapshot = failed
+		pruneFailedSnapshots()
+	}
+
+	// Added files (a new vhost, a sites-enabled link) are the usual culprit;
+	// they can only go once the failed snapshot holds a copy
+	var added []string
+	report.Restored, added, err = restoreConfig(lastGood, report.FailedSnapshot != "")
+	if report.FailedSnapshot != "" {
+		report.Removed = added
+	} else {
+		report.Kept = added
+	}
+	if err != nil {
+		report.Error = "health probes failed and rollback failed: " + err.Error()
+		return report
+	}
+
+	report.RolledBack = true
+	report.Error = "health probes failed, configuration rolled back"
+	if len(report.Kept) > 0 {
+		report.Error += "; files added since the last good config were left in place because the rejected config couldn't be saved: " + strings.Join(report.Kept, ", ")
+	}
+	report.RollbackOutput, err = sendNginxSignal("reload")
+	if err != nil {
+		report.Error += "; reload after rollback failed: " + err.Error()
+		return report
+	}
+
+	time.Sleep(settle)
+	report.RollbackProbes = runProbes(probes)
+	return report
+}
+
+func runProbes(probes []HealthProbe) []ProbeResult {
+	results := make([]ProbeResult, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe HealthProbe) {
+			defer wg.Done()
+			results[i] = runProbe(probe)
+		}(i, probe)
+	}
+	wg.Wait()
+	return results
+}
+
+func runProbe(probe HealthProbe) ProbeResult {
+	result := ProbeResult{Name: probe.Name, URL: probe.URL}
+	if result.Name == "" {
+		result.Name = probe.Host
+	}
+
+	timeout := time.Duration(probe.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	expect := probe.ExpectStatus
+	if expect == 0 {
+		expect = http.StatusOK
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// Probes usually target 127.0.0.1, so certificates are not verified
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if probe.Host != "" {
+		req.Host = probe.Host
+		tlsConfig.ServerName = probe.Host
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		result.Duration = time.Since(start).Milliseconds()
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	result.Duration = time.Since(start).Milliseconds()
+	result.Status = resp.StatusCode
+
+	switch {
+	case resp.StatusCode != expect:
+		result.Error = fmt.Sprintf("expected status %d, got %d", expect, resp.StatusCode)
+	case probe.BodyContains != "" && !strings.Contains(string(body), probe.BodyContains):
+		result.Error = fmt.Sprintf("response body does not contain %q", probe.BodyContains)
+	default:
+		result.OK = true
+	}
+
+	return result
+}
+
+func probesPassed(results []ProbeResult) bool {
+	for _, result := range results {
+		if !result.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy configDir (minus certificates) into dir, replacing its contents
+func snapshotConfig(dir string) error {
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := copyConfigTree(configDir, tmp, false, snapshotSkip); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
+
+// Put back the files that changed or disappeared since a snapshot, leaving
+// certificates untouched. Files the snapshot doesn't know about are returned,
+// and removed too with removeAdded so the tree matches the snapshot exactly.
+func restoreConfig(dir string, removeAdded bool) (restored, added []string, err error) {
+	restored, added = []string{}, []string{}
+
+	err = filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == configDir {
+			return err
+		}
+		rel, err := filepath.Rel(configDir, path)
+		if err != nil {
+			return err
+		}
+		if snapshotSkip[rel] && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if _, err := os.Lstat(filepath.Join(dir, rel)); os.IsNotExist(err) {
+			added = append(added, rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if removeAdded {
+		for _, rel := range added {
+			if err := os.RemoveAll(filepath.Join(configDir, rel)); err != nil {
+				return nil, added, err
+			}
+		}
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(configDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if sameConfigEntry(path, target, info) {
+			return nil
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			// Replace symlinks rather than writing through them
+			if st, err := os.Lstat(target); err == nil && !st.Mode().IsRegular() {
+				os.RemoveAll(target)
+			}
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		restored = append(restored, rel)
+		return nil
+	})
+	return restored, added, err
+}
+
+// Drop all but the newest failed-* snapshots; the timestamped names sort
+// oldest first
+func pruneFailedSnapshots() {
+	failed, err := filepath.Glob(filepath.Join(configSnapshotDir, "failed-*"))
+	if err != nil || len(failed) <= maxFailedSnapshots {
+		return
+	}
+	sort.Strings(failed)
+	for _, dir := range failed[:len(failed)-maxFailedSnapshots] {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: Failed to remove old config snapshot %s: %v", dir, err)
+		}
+	}
+}
+
+// Whether target still matches the snapshot entry at path
+func sameConfigEntry(path, target string, info os.FileInfo) bool {
+	st, err := os.Lstat(target)
+	if err != nil || st.Mode().Type() != info.Mode().Type() {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		a, errA := os.Readlink(path)
+		b, errB := os.Readlink(target)
+		return errA == nil && errB == nil && a == b
+	}
+	if st.Mode().Perm() != info.Mode().Perm() || st.Size() != info.Size() {
+		return false
+	}
+	a, errA := os.ReadFile(path)
+	b, errB := os.ReadFile(target)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
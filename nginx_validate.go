@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type NginxTestRequest struct {
+	Files map[string]string `json:"files"` // Unsaved buffers keyed by path relative to configDir
+}
+
+type ConfigError struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+	Path    string `json:"path,omitempty"` // Relative to configDir when the file lives inside it
+	Line    int    `json:"line,omitempty"`
+}
+
+// nginx: [emerg] unknown directive "foo" in /etc/nginx/conf.d/a.conf:12
+var nginxMessageRegex = regexp.MustCompile(`^nginx: \[(\w+)\] (.*?)(?: in (\S+):(\d+))?$`)
+
+// Validate config with overrides applied in a temporary copy of configDir
+func testConfigWithOverrides(overrides map[string]string) (string, bool, []ConfigError, error) {
+	mainConf := filepath.Join(configDir, "nginx.conf")
+	if _, err := os.Stat(mainConf); err != nil {
+		return "", false, nil, fmt.Errorf("nginx.conf not found in %s", configDir)
+	}
+
+	shadow, err := os.MkdirTemp("", "nginx-shadow-")
+	if err != nil {
+		return "", false, nil, err
+	}
+	defer os.RemoveAll(shadow)
+
+	if err := copyConfigTree(configDir, shadow, true, nil); err != nil {
+		return "", false, nil, fmt.Errorf("failed to copy config tree: %v", err)
+	}
+
+	for path, content := range overrides {
+		target := filepath.Join(shadow, path)
+		if !strings.HasPrefix(target, shadow+string(filepath.Separator)) {
+			return "", false, nil, fmt.Errorf("invalid path: %s", path)
+		}
+		target, err = materializeShadowDir(shadow, path)
+		if err != nil {
+			return "", false, nil, err
+		}
+		// Replace symlinks instead of writing through them into the live tree
+		os.Remove(target)
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			return "", false, nil, err
+		}
+	}
+
+	if err := rewriteShadowIncludes(shadow); err != nil {
+		return "", false, nil, fmt.Errorf("failed to rewrite includes: %v", err)
+	}
+
+	cmd := exec.Command("nginx", "-t", "-p", shadow+"/", "-c", filepath.Join(shadow, "nginx.conf"))
+	output, runErr := cmd.CombinedOutput()
+
+	// Map shadow paths back to the real config directory
+	mapped := strings.ReplaceAll(string(output), shadow, configDir)
+
+	warnings := lintNginxConfig(filepath.Join(shadow, "nginx.conf"))
+	for i := range warnings {
+		warnings[i].File = strings.Replace(warnings[i].File, shadow, configDir, 1)
+		warnings[i].Path, _ = configRelPath(warnings[i].File)
+	}
+
+	return mapped, runErr == nil, warnings, nil
+}
+
+// Copy a config tree. With retargetLinks, absolute symlinks pointing inside
+// configDir are rewritten to point inside dst instead. Relative paths listed
+// in skip are left out.
+func copyConfigTree(src, dst string, retargetLinks bool, skip map[string]bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if skip[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if retargetLinks && filepath.IsAbs(link) {
+				if linkRel, ok := configRelPath(link); ok {
+					link = filepath.Join(dst, linkRel)
+				}
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// Create the directories for a file in the shadow tree. Symlinked
+// directories that lead out of the tree (e.g. sites-enabled pointing at
+// /etc/nginx) are replaced by copies, so writing the file can't reach the
+// live config.
+func materializeShadowDir(shadow, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(shadow)
+	if err != nil {
+		return "", err
+	}
+	inside := func(dir string) bool {
+		return dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))
+	}
+
+	dir := shadow
+	for _, part := range strings.Split(filepath.Dir(filepath.Clean(path)), string(filepath.Separator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		resolved, resolveErr := filepath.EvalSymlinks(dir)
+		if resolveErr == nil && inside(resolved) {
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			return "", err
+		}
+		if resolveErr != nil {
+			// Dangling link; nginx wouldn't find anything there either
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := copyConfigTree(resolved, dir, true, nil); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %v", resolved, err)
+		}
+	}
+
+	parent, err := filepath.EvalSymlinks(dir)
+	if err != nil || !inside(parent) {
+		return "", fmt.Errorf("invalid path: %s", path)
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Point absolute include paths under configDir at the shadow tree
+func rewriteShadowIncludes(shadow string) error {
+	return filepath.Walk(shadow, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		lines := strings.Split(string(data), "\n")
+		changed := false
+		for _, ref := range findIncludes(string(data)) {
+			rel, ok := configRelPath(ref.pattern)
+			if !ok || ref.line > len(lines) {
+				continue
+			}
+			i := ref.line - 1
+			lines[i] = strings.Replace(lines[i], ref.pattern, filepath.Join(shadow, rel), 1)
+			changed = true
+		}
+
+		if !changed {
+			return nil
+		}
+		return os.WriteFile(path, []byte(strings.Join(lines, "\n")), info.Mode().Perm())
+	})
+}
+
+// Extract file and line locations from nginx -t output
+func parseNginxMessages(output string) []ConfigError {
+	errors := []ConfigError{}
+	for _, line := range strings.Split(output, "\n") {
+		matches := nginxMessageRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		ce := ConfigError{Level: matches[1], Message: matches[2]}
+		if matches[3] != "" {
+			ce.File = matches[3]
+			ce.Line, _ = strconv.Atoi(matches[4])
+			if rel, ok := configRelPath(ce.File); ok {
+				ce.Path = rel
+			}
+		}
+		errors = append(errors, ce)
+	}
+	return errors
+}